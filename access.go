@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	accessPrefix   = "access/"
+	accessInterval = 5 * time.Minute
+)
+
+// accessRecord tracks what a token has pushed. Each token has its own
+// record under access/, so pushes from different tokens don't contend.
+type accessRecord struct {
+	LastUsed       int64    `json:"last_used"`
+	SourceIPHashes []string `json:"source_ip_hashes"`
+	Files          []string `json:"files"`
+}
+
+// tokenAccess is every token's access record, keyed by token name
+type tokenAccess map[string]*accessRecord
+
+var (
+	accessLock sync.Mutex
+	accessSeen = map[string]int64{}
+)
+
+// accessRow is one token in the access review. Tokens and secrets are never
+// included, only whether they are set.
+type accessRow struct {
+	Name           string   `json:"name"`
+	Configured     bool     `json:"configured"`
+	ReadPrefixes   []string `json:"read_prefixes"`
+	CertSubjects   []string `json:"cert_subjects"`
+	NotBefore      string   `json:"not_before,omitempty"`
+	Expires        string   `json:"expires,omitempty"`
+	HMAC           bool     `json:"hmac"`
+	PendingRotate  bool     `json:"pending_rotation"`
+	RateLimit      int      `json:"rate_limit"`
+	SeriesQuota    int      `json:"series_quota"`
+	BytesQuota     int64    `json:"bytes_quota"`
+	LastUsed       int64    `json:"last_used"`
+	SourceIPHashes []string `json:"source_ip_hashes"`
+	Files          []string `json:"files"`
+}
+
+func addUnique(list []string, value string) []string {
+	if value == "" {
+		return list
+	}
+	i := sort.SearchStrings(list, value)
+	if i < len(list) && list[i] == value {
+		return list
+	}
+	list = append(list, "")
+	copy(list[i+1:], list[i:])
+	list[i] = value
+	return list
+}
+
+func (r *accessRecord) record(mf metricFile) {
+	if mf.PushedAt > r.LastUsed {
+		r.LastUsed = mf.PushedAt
+	}
+	r.SourceIPHashes = addUnique(r.SourceIPHashes, mf.Source.SourceIPHash)
+	r.Files = addUnique(r.Files, mf.FileName)
+}
+
+func (a tokenAccess) record(mf metricFile) {
+	if mf.Source == nil || mf.Source.Token == "" {
+		return
+	}
+	r, ok := a[mf.Source.Token]
+	if !ok {
+		r = &accessRecord{SourceIPHashes: []string{}, Files: []string{}}
+		a[mf.Source.Token] = r
+	}
+	r.record(mf)
+}
+
+// recordAccess notes the pushing token's use of a file, so the access review
+// covers source IPs and files beyond each file's latest push. A token,
+// source, and file this environment recorded within accessInterval are
+// skipped, so repeated pushes don't each cost a write and last_used is only
+// accurate to the interval.
+func recordAccess(client *s3.Client, mf metricFile) error {
+	if mf.Source == nil || mf.Source.Token == "" {
+		return nil
+	}
+	seen := strings.Join([]string{mf.Source.Token, mf.Source.SourceIPHash, mf.FileName}, "\x00")
+	accessLock.Lock()
+	if last, ok := accessSeen[seen]; ok && mf.PushedAt-last < int64(accessInterval/time.Second) {
+		accessLock.Unlock()
+		return nil
+	}
+	accessSeen[seen] = mf.PushedAt
+	accessLock.Unlock()
+
+	err := writeAccess(client, mf)
+	if err != nil {
+		accessLock.Lock()
+		delete(accessSeen, seen)
+		accessLock.Unlock()
+	}
+	return err
+}
+
+func writeAccess(client *s3.Client, mf metricFile) error {
+	key := accessPrefix + mf.Source.Token
+	release, err := lockFile(internalPrefix + key)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	r := accessRecord{SourceIPHashes: []string{}, Files: []string{}}
+	if _, err := readInternalObject(client, key, &r); err != nil {
+		return err
+	}
+	r.record(mf)
+	return writeInternalObject(client, key, r)
+}
+
+func readAccess(client *s3.Client) (tokenAccess, error) {
+	keys, err := listInternalObjects(client, accessPrefix)
+	if err != nil {
+		return nil, err
+	}
+	access := tokenAccess{}
+	for _, key := range keys {
+		r := &accessRecord{SourceIPHashes: []string{}, Files: []string{}}
+		if _, err := readInternalObject(client, key, r); err != nil {
+			return nil, err
+		}
+		access[strings.TrimPrefix(key, accessPrefix)] = r
+	}
+	return access, nil
+}
+
+// accessReview lists every configured token alongside its recorded use,
+// followed by any token names seen in use that are no longer configured.
+// Stored files are folded in too, covering pushes from before use was
+// recorded.
+func accessReview(access tokenAccess, files []metricFile) []accessRow {
+	for _, mf := range files {
+		access.record(mf)
+	}
+
+	tokens := c.Tokens
+	if c.AuthToken != "" {
+		tokens = append([]tokenConfig{{Name: "default"}}, tokens...)
+	}
+	rows := []accessRow{}
+	seen := map[string]bool{}
+	for _, t := range tokens {
+		seen[t.Name] = true
+		row := accessRow{
+			Name:          t.Name,
+			Configured:    true,
+			ReadPrefixes:  t.ReadPrefixes,
+			CertSubjects:  t.CertSubjects,
+			NotBefore:     t.NotBefore,
+			Expires:       t.Expires,
+			HMAC:          t.HMACSecret != "",
+			PendingRotate: t.PendingToken != "" || t.PendingHMACSecret != "",
+			RateLimit:     t.RateLimit,
+			SeriesQuota:   t.SeriesQuota,
+			BytesQuota:    t.BytesQuota,
+		}
+		rows = append(rows, row.withAccess(access[t.Name]))
+	}
+
+	stale := []string{}
+	for name := range access {
+		if !seen[name] {
+			stale = append(stale, name)
+		}
+	}
+	sort.Strings(stale)
+	for _, name := range stale {
+		rows = append(rows, accessRow{Name: name}.withAccess(access[name]))
+	}
+	return rows
+}
+
+func (row accessRow) withAccess(r *accessRecord) accessRow {
+	if row.ReadPrefixes == nil {
+		row.ReadPrefixes = []string{}
+	}
+	if row.CertSubjects == nil {
+		row.CertSubjects = []string{}
+	}
+	row.SourceIPHashes = []string{}
+	row.Files = []string{}
+	if r != nil {
+		row.LastUsed = r.LastUsed
+		row.SourceIPHashes = r.SourceIPHashes
+		row.Files = r.Files
+	}
+	return row
+}
+
+func accessCSV(rows []accessRow) (string, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	err := w.Write([]string{
+		"name", "configured", "read_prefixes", "cert_subjects", "not_before", "expires",
+		"hmac", "pending_rotation", "rate_limit", "series_quota", "bytes_quota",
+		"last_used", "source_ip_hashes", "files",
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, row := range rows {
+		err := w.Write([]string{
+			row.Name,
+			strconv.FormatBool(row.Configured),
+			strings.Join(row.ReadPrefixes, ";"),
+			strings.Join(row.CertSubjects, ";"),
+			row.NotBefore,
+			row.Expires,
+			strconv.FormatBool(row.HMAC),
+			strconv.FormatBool(row.PendingRotate),
+			strconv.Itoa(row.RateLimit),
+			strconv.Itoa(row.SeriesQuota),
+			strconv.FormatInt(row.BytesQuota, 10),
+			strconv.FormatInt(row.LastUsed, 10),
+			strings.Join(row.SourceIPHashes, ";"),
+			strings.Join(row.Files, ";"),
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	w.Flush()
+	return buf.String(), w.Error()
+}
+
+// accessHandler reports every token's scopes, last push, source IP hashes,
+// and files written, as JSON or, with ?format=csv or a text/csv Accept
+// header, as CSV
+func accessHandler(req events.Request) (events.Response, error) {
+	format := req.QueryStringParameters["format"]
+	if format == "" {
+		format = "json"
+		if strings.Contains(requestHeader(req, "Accept"), "text/csv") {
+			format = "csv"
+		}
+	}
+	if format != "json" && format != "csv" {
+		return events.Respond(400, fmt.Sprintf("unsupported format: %s", format))
+	}
+
+	client, err := getClient()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+	}
+	access, err := readAccess(client)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to read token access: %s", err))
+	}
+	files, err := readMetricFiles(client)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to read metrics: %s", err))
+	}
+	rows := accessReview(access, files)
+
+	if format == "json" {
+		return respondJSON(200, rows)
+	}
+	body, err := accessCSV(rows)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to write csv: %s", err))
+	}
+	return events.Response{
+		StatusCode: 200,
+		Body:       body,
+		Headers: map[string]string{
+			"Content-Type":        "text/csv",
+			"Content-Disposition": "attachment; filename=\"access-review.csv\"",
+		},
+	}, nil
+}
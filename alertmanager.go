@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+const alertmanagerPrefix = "alertmanager/"
+
+type alertmanagerPayload struct {
+	Receiver string              `json:"receiver"`
+	Alerts   []alertmanagerAlert `json:"alerts"`
+}
+
+type alertmanagerAlert struct {
+	Status      string            `json:"status"`
+	Labels      map[string]string `json:"labels"`
+	StartsAt    time.Time         `json:"startsAt"`
+	Fingerprint string            `json:"fingerprint"`
+}
+
+// alertmanagerHandler accepts Alertmanager webhook notifications and records
+// each alert as alertmanager_alert_firing, 1 while firing and 0 once
+// resolved, in the file given by ?name= (default alertmanager/<receiver>).
+// Alerts not in the notification are kept.
+func alertmanagerHandler(req events.Request) (events.Response, error) {
+	body, err := req.DecodedBody()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+	}
+	if err := checkJSONLimits([]byte(body)); err != nil {
+		return events.Respond(400, fmt.Sprintf("rejected body: %s", err))
+	}
+	var payload alertmanagerPayload
+	if err := json.Unmarshal([]byte(body), &payload); err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to unmarshal: %s", err))
+	}
+
+	name := req.QueryStringParameters["name"]
+	if name == "" {
+		name = alertmanagerPrefix + sanitizeLabel(payload.Receiver)
+	}
+	mf := metricFile{FileName: name, Metrics: alertMetrics(payload.Alerts)}
+	if len(mf.Metrics) == 0 {
+		return events.Succeed("")
+	}
+	mf.mergeSeries = true
+	return pushMetricFile(req, mf)
+}
+
+func alertMetrics(alerts []alertmanagerAlert) []metric {
+	metrics := []metric{}
+	for _, a := range alerts {
+		tags := map[string]string{
+			"alertname":   sanitizeLabel(a.Labels["alertname"]),
+			"fingerprint": sanitizeLabel(a.Fingerprint),
+		}
+		if severity := a.Labels["severity"]; severity != "" {
+			tags["severity"] = sanitizeLabel(severity)
+		}
+		firing := "0"
+		if a.Status == "firing" {
+			firing = "1"
+		}
+		metrics = append(metrics, metric{
+			Name:  "alertmanager_alert_firing",
+			Type:  "gauge",
+			Tags:  tags,
+			Value: firing,
+		})
+		if a.StartsAt.IsZero() {
+			continue
+		}
+		metrics = append(metrics, metric{
+			Name:  "alertmanager_alert_started_timestamp_seconds",
+			Type:  "gauge",
+			Tags:  tags,
+			Value: fmt.Sprintf("%d", a.StartsAt.Unix()),
+		})
+	}
+	return metrics
+}
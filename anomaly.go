@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type metricBounds struct {
+	Min      *float64 `json:"min"`
+	Max      *float64 `json:"max"`
+	MaxDelta *float64 `json:"max_delta"`
+}
+
+type anomaly struct {
+	File     string `json:"file"`
+	Metric   string `json:"metric"`
+	Labels   string `json:"labels"`
+	Value    string `json:"value"`
+	Previous string `json:"previous,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+func seriesKey(m metric) string {
+	return m.Name + m.TagString()
+}
+
+// flagAnomalies marks metrics in mf that fall outside their configured bounds.
+// Pushes are never rejected for anomalies, only recorded and announced.
+func flagAnomalies(client *s3.Client, mf *metricFile) {
+	if len(c.Bounds) == 0 {
+		return
+	}
+
+	previous := map[string]string{}
+	if old, err := readMetricFile(client, mf.FileName); err == nil {
+		for _, m := range old.Metrics {
+			previous[seriesKey(m)] = m.Value
+		}
+	}
+
+	flagged := map[string]bool{}
+	for _, m := range mf.Metrics {
+		b, ok := c.Bounds[m.Name]
+		if !ok {
+			continue
+		}
+		reason := b.Check(m.Value, previous[seriesKey(m)])
+		if reason == "" {
+			continue
+		}
+		a := anomaly{
+			File:     mf.FileName,
+			Metric:   m.Name,
+			Labels:   labelString(m.Tags),
+			Value:    m.Value,
+			Previous: previous[seriesKey(m)],
+			Reason:   reason,
+		}
+		if err := publishEvent("Metric Value Anomaly", a); err != nil {
+			fmt.Printf("failed to publish anomaly event: %s\n", err)
+		}
+		if !flagged[m.Name] {
+			flagged[m.Name] = true
+			mf.Anomalies = append(mf.Anomalies, m.Name)
+		}
+	}
+}
+
+func (b metricBounds) Check(value, previous string) string {
+	v, err := parseValue(value)
+	if err != nil {
+		return ""
+	}
+	if b.Min != nil && v < *b.Min {
+		return fmt.Sprintf("value below minimum %g", *b.Min)
+	}
+	if b.Max != nil && v > *b.Max {
+		return fmt.Sprintf("value above maximum %g", *b.Max)
+	}
+	if b.MaxDelta != nil && previous != "" {
+		p, err := parseValue(previous)
+		if err == nil && math.Abs(v-p) > *b.MaxDelta {
+			return fmt.Sprintf("change from previous exceeds %g", *b.MaxDelta)
+		}
+	}
+	return ""
+}
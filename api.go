@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+type seriesValue struct {
+	File     string            `json:"file"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Value    string            `json:"value"`
+	PushedAt int64             `json:"pushed_at,omitempty"`
+}
+
+func valuesHandler(req events.Request) (events.Response, error) {
+	names := strings.Split(req.QueryStringParameters["names"], ",")
+	wanted := map[string]bool{}
+	for _, n := range names {
+		n = strings.TrimSpace(n)
+		if n != "" {
+			wanted[n] = true
+		}
+	}
+	if len(wanted) == 0 {
+		return events.Respond(400, "names parameter is required")
+	}
+
+	client, err := getClient()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+	}
+
+	list := make([]string, 0, len(wanted))
+	for n := range wanted {
+		list = append(list, n)
+	}
+	files, err := readFamilyFiles(client, newMemoryGuard(), list)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to read metrics: %s", err))
+	}
+	files, ok := scopeMetricFiles(req, files)
+	if !ok {
+		return events.Reject("bad auth token")
+	}
+	files = redactMetricFiles(files)
+
+	values := map[string][]seriesValue{}
+	for n := range wanted {
+		values[n] = []seriesValue{}
+	}
+	for _, mf := range files {
+		for _, m := range mf.Metrics {
+			if !wanted[m.Name] {
+				continue
+			}
+			values[m.Name] = append(values[m.Name], seriesValue{
+				File:     mf.FileName,
+				Tags:     m.Tags,
+				Value:    m.Value,
+				PushedAt: mf.PushedAt,
+			})
+		}
+	}
+
+	return respondJSON(200, values)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+type batchResponse struct {
+	Results []pushResult `json:"results"`
+}
+
+// batchHandler accepts an array of metricFiles. By default the batch is
+// atomic: any rejected file blocks the whole batch. With ?mode=partial each
+// file is handled independently and a 207 multi-status body is returned.
+// Items that fail to parse are reported as rejected in their own slot.
+func batchHandler(req events.Request) (events.Response, error) {
+	body, err := req.DecodedBody()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+	}
+
+	err = checkJSONLimits([]byte(body))
+	if err != nil {
+		return events.Respond(400, fmt.Sprintf("rejected body: %s", err))
+	}
+
+	var raw []json.RawMessage
+	err = json.Unmarshal([]byte(body), &raw)
+	if err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to unmarshal: %s", err))
+	}
+
+	files := make([]metricFile, len(raw))
+	results := make([]pushResult, len(raw))
+	parsed := make([]bool, len(raw))
+	rejected := false
+	for i, r := range raw {
+		files[i], err = parseMetricFile(r)
+		if err != nil {
+			results[i] = *rejectPush(files[i], 400, fmt.Sprintf("failed to unmarshal item %d: %s", i, err))
+			rejected = true
+			continue
+		}
+		parsed[i] = true
+	}
+
+	client, err := getClient()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+	}
+
+	names := []string{}
+	for i, mf := range files {
+		if parsed[i] {
+			names = append(names, mf.FileName)
+		}
+	}
+	release, err := lockFiles(names)
+	if err != nil {
+		return events.Respond(409, fmt.Sprintf("failed to lock files: %s", err))
+	}
+	defer release()
+
+	callbacks := make([]string, len(files))
+	for i := range files {
+		callbacks[i] = takeCallback(req, &files[i])
+	}
+
+	partial := req.QueryStringParameters["mode"] == "partial"
+	ready := make([]bool, len(files))
+	skipPrepare := rejected && !partial
+	for i := range files {
+		if !parsed[i] || skipPrepare {
+			continue
+		}
+		if r := prepareMetricFile(req, client, &files[i]); r != nil {
+			results[i] = *r
+			rejected = true
+			continue
+		}
+		ready[i] = true
+	}
+
+	if rejected && !partial {
+		for i := range files {
+			if results[i].Status == "" {
+				results[i] = pushResult{
+					File:   files[i].FileName,
+					Status: pushRejected,
+					Reason: "batch rejected due to other invalid files",
+				}
+			}
+		}
+		recordPush(results...)
+		sendCallbacks(req, callbacks, files, results)
+		resp, err := respondJSON(400, batchResponse{Results: results})
+		return withQuotaHeaders(resp, batchQuota(files)), err
+	}
+
+	failed := false
+	for i := range files {
+		if !ready[i] {
+			continue
+		}
+		results[i] = storeMetricFile(client, files[i])
+		if results[i].Status == pushRejected {
+			failed = true
+		}
+	}
+
+	recordPush(results...)
+	sendCallbacks(req, callbacks, files, results)
+
+	code := 200
+	if partial && (rejected || failed) {
+		code = 207
+	} else if failed {
+		code = 500
+	}
+	resp, err := respondJSON(code, batchResponse{Results: results})
+	return withQuotaHeaders(resp, batchQuota(files)), err
+}
+
+// batchQuota returns the quota headers from the last file that was checked,
+// which reflect the headroom left after the whole batch.
+func batchQuota(files []metricFile) map[string]string {
+	for i := len(files) - 1; i >= 0; i-- {
+		if files[i].quota != nil {
+			return files[i].quota
+		}
+	}
+	return nil
+}
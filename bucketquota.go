@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const bucketQuotaObject = "bucket_quota.json"
+
+type bucketQuotaState struct {
+	OverrideUntil int64 `json:"override_until,omitempty"`
+}
+
+type bucketQuotaStatus struct {
+	Bytes         int64 `json:"bytes"`
+	Limit         int64 `json:"limit"`
+	OverrideUntil int64 `json:"override_until,omitempty"`
+}
+
+// bucketBytes totals the stored file sizes recorded in the manifest, which
+// is kept current on each push and repaired by the reconcile job
+func bucketBytes(client *s3.Client) (metricManifest, int64, error) {
+	m := newManifest()
+	found, err := readInternalObject(client, manifestObject, &m)
+	if err != nil {
+		return m, 0, err
+	}
+	if !found {
+		m, err = rebuildManifest(client)
+		if err != nil {
+			return m, 0, err
+		}
+	}
+	var total int64
+	for _, size := range m.Sizes {
+		total += size
+	}
+	return m, total, nil
+}
+
+// checkBucketQuota refuses pushes that would grow a file once the bucket
+// holds max_bucket_bytes, unless an admin override is in effect. Pushes that
+// keep a file the same size or shrink it are always allowed.
+func checkBucketQuota(client *s3.Client, mf *metricFile) *pushResult {
+	if c.MaxBucketBytes == 0 {
+		return nil
+	}
+
+	m, total, err := bucketBytes(client)
+	if err != nil {
+		return rejectPush(*mf, 500, fmt.Sprintf("failed to load bucket usage: %s", err))
+	}
+	content, err := json.Marshal(mf)
+	if err != nil {
+		return rejectPush(*mf, 500, fmt.Sprintf("failed to size push: %s", err))
+	}
+	if total < c.MaxBucketBytes || int64(len(content)) <= m.Sizes[mf.FileName] {
+		return nil
+	}
+
+	var state bucketQuotaState
+	_, err = readInternalObject(client, bucketQuotaObject, &state)
+	if err != nil {
+		return rejectPush(*mf, 500, fmt.Sprintf("failed to load bucket quota override: %s", err))
+	}
+	if state.OverrideUntil > time.Now().Unix() {
+		return nil
+	}
+	return rejectPush(*mf, 507, fmt.Sprintf("bucket holds %d bytes, over the %d byte cap", total, c.MaxBucketBytes))
+}
+
+func bucketQuotaMetrics() []metric {
+	if c.MaxBucketBytes == 0 {
+		return []metric{}
+	}
+	client, err := getClient()
+	if err != nil {
+		fmt.Printf("failed to load client: %s\n", err)
+		return []metric{}
+	}
+	_, total, err := bucketBytes(client)
+	if err != nil {
+		fmt.Printf("failed to load bucket usage: %s\n", err)
+		return []metric{}
+	}
+	return []metric{{
+		Name:  "hook_exporter_bucket_bytes",
+		Type:  "gauge",
+		Value: strconv.FormatInt(total, 10),
+		Unit:  "bytes",
+	}, {
+		Name:  "hook_exporter_bucket_bytes_limit",
+		Type:  "gauge",
+		Value: strconv.FormatInt(c.MaxBucketBytes, 10),
+		Unit:  "bytes",
+	}}
+}
+
+// bucketQuotaHandler reports bucket usage on GET. POST with a body of
+// {"override_seconds": N} lifts the cap for N seconds, and 0 clears it.
+func bucketQuotaHandler(req events.Request) (events.Response, error) {
+	client, err := getClient()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+	}
+
+	var state bucketQuotaState
+	switch req.HTTPMethod {
+	case "GET":
+		_, err = readInternalObject(client, bucketQuotaObject, &state)
+		if err != nil {
+			return events.Fail(fmt.Sprintf("failed to load override: %s", err))
+		}
+	case "POST":
+		body, err := req.DecodedBody()
+		if err != nil {
+			return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+		}
+		var override struct {
+			Seconds int64 `json:"override_seconds"`
+		}
+		if err := json.Unmarshal([]byte(body), &override); err != nil {
+			return events.Respond(400, fmt.Sprintf("failed to unmarshal: %s", err))
+		}
+		if override.Seconds > 0 {
+			state.OverrideUntil = time.Now().Unix() + override.Seconds
+		}
+		if err := writeInternalObject(client, bucketQuotaObject, state); err != nil {
+			return events.Fail(fmt.Sprintf("failed to save override: %s", err))
+		}
+	default:
+		return events.Respond(405, "bucket quota requires GET or POST")
+	}
+
+	_, total, err := bucketBytes(client)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load bucket usage: %s", err))
+	}
+	return respondJSON(200, bucketQuotaStatus{
+		Bytes:         total,
+		Limit:         c.MaxBucketBytes,
+		OverrideUntil: state.OverrideUntil,
+	})
+}
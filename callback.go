@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+const (
+	callbackHeader  = "X-Callback-URL"
+	callbackTimeout = 5 * time.Second
+)
+
+// pushAck is the acknowledgement POSTed to a push's callback_url once the
+// push has been stored or rejected
+type pushAck struct {
+	File      string   `json:"file"`
+	Status    string   `json:"status"`
+	Reason    string   `json:"reason,omitempty"`
+	Version   string   `json:"version,omitempty"`
+	Reference string   `json:"reference,omitempty"`
+	Anomalies []string `json:"anomalies,omitempty"`
+	Skewed    []string `json:"skewed,omitempty"`
+	AckedAt   int64    `json:"acked_at"`
+}
+
+// takeCallback returns the push's callback URL, from its callback_url field
+// or the X-Callback-URL header, and clears the field so it isn't stored
+func takeCallback(req events.Request, mf *metricFile) string {
+	callback := mf.CallbackURL
+	mf.CallbackURL = ""
+	if callback == "" {
+		callback = requestHeader(req, callbackHeader)
+	}
+	return callback
+}
+
+// callbackAllowed only permits https URLs on hosts listed in callback_hosts,
+// so pushes can't direct requests at arbitrary endpoints
+func callbackAllowed(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("callback url must use https")
+	}
+	for _, host := range c.CallbackHosts {
+		if u.Hostname() == host {
+			return nil
+		}
+	}
+	return fmt.Errorf("callback host not allowed: %s", u.Hostname())
+}
+
+func sendCallbacks(req events.Request, callbacks []string, files []metricFile, results []pushResult) {
+	for i := range files {
+		sendCallback(req, callbacks[i], files[i], results[i])
+	}
+}
+
+// sendCallback POSTs the push result to callback, if set. The body is signed
+// with the pushing token's hmac_secret in X-Hub-Signature-256, and with the
+// KMS signing key when signing_key_id is set. Failures are only logged.
+func sendCallback(req events.Request, callback string, mf metricFile, result pushResult) {
+	if callback == "" {
+		return
+	}
+	if err := postCallback(req, callback, mf, result); err != nil {
+		fmt.Printf("failed to send callback for %s: %s\n", mf.FileName, err)
+	}
+}
+
+func postCallback(req events.Request, callback string, mf metricFile, result pushResult) error {
+	if err := callbackAllowed(callback); err != nil {
+		return err
+	}
+	body, err := json.Marshal(pushAck{
+		File:      result.File,
+		Status:    result.Status,
+		Reason:    result.Reason,
+		Version:   result.Version,
+		Reference: result.Reference,
+		Anomalies: mf.Anomalies,
+		Skewed:    mf.Skewed,
+		AckedAt:   time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	signed := events.Response{Headers: map[string]string{"Content-Type": "application/json"}}
+	if err := signResponse(&signed, body); err != nil {
+		return err
+	}
+	if t, ok := lookupToken(req); ok && t.HMACSecret != "" {
+		mac := hmac.New(sha256.New, []byte(t.HMACSecret))
+		mac.Write(body)
+		signed.Headers["X-Hub-Signature-256"] = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	httpReq, err := http.NewRequest("POST", callback, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range signed.Headers {
+		httpReq.Header.Set(k, v)
+	}
+	client := &http.Client{Timeout: callbackTimeout}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("callback returned %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+const (
+	defaultChecksFile = "checks"
+	maxCheckOutput    = 200
+)
+
+// checkStates names Nagios plugin exit codes, as used by Sensu and NSCA
+var checkStates = []string{"ok", "warning", "critical", "unknown"}
+
+// checkResult is a passive check result. An empty service is a host check.
+type checkResult struct {
+	Host    string `json:"host"`
+	Service string `json:"service"`
+	Status  int    `json:"status"`
+	Output  string `json:"output"`
+}
+
+// parseCheckResults reads a JSON result or array of results, or send_nsca
+// style lines of tab separated host, service, status, and output, where
+// lines with three fields are host checks
+func parseCheckResults(body, contentType string) ([]checkResult, error) {
+	if strings.HasPrefix(contentType, "text/plain") {
+		return parseNSCALines(body)
+	}
+
+	trimmed := strings.TrimSpace(body)
+	if strings.HasPrefix(trimmed, "[") {
+		var results []checkResult
+		err := json.Unmarshal([]byte(trimmed), &results)
+		return results, err
+	}
+	var result checkResult
+	if err := json.Unmarshal([]byte(trimmed), &result); err != nil {
+		return nil, err
+	}
+	return []checkResult{result}, nil
+}
+
+func parseNSCALines(body string) ([]checkResult, error) {
+	results := []checkResult{}
+	for i, line := range strings.Split(body, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		var r checkResult
+		var status string
+		switch len(fields) {
+		case 3:
+			r.Host, status, r.Output = fields[0], fields[1], fields[2]
+		case 4:
+			r.Host, r.Service, status, r.Output = fields[0], fields[1], fields[2], fields[3]
+		default:
+			return nil, fmt.Errorf("line %d: expected 3 or 4 tab separated fields", i+1)
+		}
+		var err error
+		if r.Status, err = strconv.Atoi(strings.TrimSpace(status)); err != nil {
+			return nil, fmt.Errorf("line %d: invalid status %q", i+1, status)
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// checkOutputLabel keeps the first line of plugin output, without perfdata,
+// as a label value
+func checkOutputLabel(output string) string {
+	output = strings.SplitN(output, "\n", 2)[0]
+	output = strings.SplitN(output, "|", 2)[0]
+	output = strings.TrimSpace(output)
+	if len(output) > maxCheckOutput {
+		output = output[:maxCheckOutput]
+	}
+	return sanitizeLabel(output)
+}
+
+func checkMetrics(results []checkResult, now int64) ([]metric, error) {
+	metrics := []metric{}
+	for _, r := range results {
+		if r.Host == "" {
+			return nil, fmt.Errorf("check result is missing a host")
+		}
+		if r.Status < 0 || r.Status >= len(checkStates) {
+			return nil, fmt.Errorf("%s: invalid status %d", r.Host, r.Status)
+		}
+		tags := map[string]string{"host": sanitizeLabel(r.Host)}
+		if r.Service != "" {
+			tags["service"] = sanitizeLabel(r.Service)
+		}
+		info := map[string]string{"state": checkStates[r.Status]}
+		if output := checkOutputLabel(r.Output); output != "" {
+			info["output"] = output
+		}
+		for k, v := range tags {
+			info[k] = v
+		}
+
+		metrics = append(metrics,
+			metric{
+				Name:  "check_status",
+				Type:  "gauge",
+				Help:  "Passive check status: 0 ok, 1 warning, 2 critical, 3 unknown",
+				Tags:  tags,
+				Value: strconv.Itoa(r.Status),
+			},
+			metric{
+				Name:  "check_info",
+				Type:  "gauge",
+				Help:  "Latest passive check state and plugin output",
+				Tags:  info,
+				Value: "1",
+			},
+			metric{
+				Name:  "check_last_result_timestamp_seconds",
+				Type:  "gauge",
+				Tags:  tags,
+				Value: strconv.FormatInt(now, 10),
+			},
+		)
+	}
+	return metrics, nil
+}
+
+// latestCheckInfo keeps one check_info series per host and service. Pushed
+// series are merged after stored ones, so the last one seen is the newest.
+func latestCheckInfo(mf *metricFile) {
+	latest := map[string]int{}
+	for i, m := range mf.Metrics {
+		if m.Name == "check_info" {
+			latest[m.Tags["host"]+"\x00"+m.Tags["service"]] = i
+		}
+	}
+	keep := make([]int, 0, len(latest))
+	for _, i := range latest {
+		keep = append(keep, i)
+	}
+	sort.Ints(keep)
+
+	kept := []metric{}
+	for i, m := range mf.Metrics {
+		if m.Name == "check_info" {
+			if len(keep) == 0 || keep[0] != i {
+				continue
+			}
+			keep = keep[1:]
+		}
+		kept = append(kept, m)
+	}
+	mf.Metrics = kept
+}
+
+// checksHandler accepts Nagios, Icinga, or Sensu style passive check results
+// and records each as check_status, with check_info carrying the state and
+// plugin output as labels. Results are stored in the file given by ?name=
+// (default checks), and checks not in the request are kept.
+func checksHandler(req events.Request) (events.Response, error) {
+	body, err := req.DecodedBody()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+	}
+	contentType := requestHeader(req, "Content-Type")
+	if strings.HasPrefix(contentType, "text/plain") {
+		if max := effectiveJSONLimits().MaxBodyBytes; len(body) > max {
+			return events.Respond(400, fmt.Sprintf("rejected body: body exceeds %d bytes", max))
+		}
+	} else if err := checkJSONLimits([]byte(body)); err != nil {
+		return events.Respond(400, fmt.Sprintf("rejected body: %s", err))
+	}
+	results, err := parseCheckResults(body, contentType)
+	if err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to parse: %s", err))
+	}
+	metrics, err := checkMetrics(results, time.Now().Unix())
+	if err != nil {
+		return events.Respond(400, err.Error())
+	}
+	if len(metrics) == 0 {
+		return events.Succeed("")
+	}
+
+	name := req.QueryStringParameters["name"]
+	if name == "" {
+		name = defaultChecksFile
+	}
+	mf := metricFile{FileName: name, Metrics: metrics}
+	mf.mergeSeries = true
+	mf.derive = latestCheckInfo
+	return pushMetricFile(req, mf)
+}
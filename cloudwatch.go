@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	cloudWatchPrefix    = "cloudwatch/"
+	alarmChangeType     = "CloudWatch Alarm State Change"
+	alarmChangeSource   = "aws.cloudwatch"
+	alarmStateTimestamp = "2006-01-02T15:04:05.000-0700"
+)
+
+// alarmStates maps alarm states to cloudwatch_alarm_state values
+var alarmStates = map[string]string{
+	"OK":                "0",
+	"ALARM":             "1",
+	"INSUFFICIENT_DATA": "2",
+}
+
+// cloudWatchAlarmMessage is the SNS message body CloudWatch alarms publish
+type cloudWatchAlarmMessage struct {
+	AlarmName       string `json:"AlarmName"`
+	AlarmArn        string `json:"AlarmArn"`
+	AWSAccountID    string `json:"AWSAccountId"`
+	Region          string `json:"Region"`
+	NewStateValue   string `json:"NewStateValue"`
+	StateChangeTime string `json:"StateChangeTime"`
+}
+
+// cloudWatchAlarmDetail is the detail of an EventBridge alarm state change
+type cloudWatchAlarmDetail struct {
+	AlarmName string `json:"alarmName"`
+	State     struct {
+		Value     string `json:"value"`
+		Timestamp string `json:"timestamp"`
+	} `json:"state"`
+}
+
+// alarmFile records an alarm's state in cloudwatch/<account>. Other alarms
+// in the file are kept.
+func alarmFile(account, region, alarm, state, changed string) (metricFile, error) {
+	value, ok := alarmStates[state]
+	if !ok {
+		return metricFile{}, fmt.Errorf("unknown alarm state: %s", state)
+	}
+	tags := map[string]string{"alarm": sanitizeLabel(alarm)}
+	if region != "" {
+		tags["region"] = sanitizeLabel(region)
+	}
+	mf := metricFile{
+		FileName: cloudWatchPrefix + sanitizeLabel(account),
+		Metrics: []metric{{
+			Name:  "cloudwatch_alarm_state",
+			Type:  "gauge",
+			Help:  "CloudWatch alarm state: 0 OK, 1 ALARM, 2 INSUFFICIENT_DATA",
+			Tags:  tags,
+			Value: value,
+		}},
+	}
+	if t, err := time.Parse(alarmStateTimestamp, changed); err == nil {
+		mf.Metrics = append(mf.Metrics, metric{
+			Name:  "cloudwatch_alarm_state_change_timestamp_seconds",
+			Type:  "gauge",
+			Tags:  tags,
+			Value: fmt.Sprintf("%d", t.Unix()),
+		})
+	}
+	mf.mergeSeries = true
+	return mf, nil
+}
+
+// parseAlarmMessage converts an SNS message from a CloudWatch alarm. It
+// reports false for messages that aren't alarm notifications.
+func parseAlarmMessage(message string) (metricFile, bool, error) {
+	var msg cloudWatchAlarmMessage
+	if err := json.Unmarshal([]byte(message), &msg); err != nil {
+		return metricFile{}, false, nil
+	}
+	if msg.AlarmName == "" || msg.NewStateValue == "" {
+		return metricFile{}, false, nil
+	}
+	// Region is the display name, e.g. "US East (N. Virginia)"; the ARN
+	// carries the region code that EventBridge events use
+	region := msg.Region
+	if parts := strings.Split(msg.AlarmArn, ":"); len(parts) > 3 && parts[3] != "" {
+		region = parts[3]
+	}
+	mf, err := alarmFile(msg.AWSAccountID, region, msg.AlarmName, msg.NewStateValue, msg.StateChangeTime)
+	return mf, true, err
+}
+
+// parseAlarmEvent converts an EventBridge alarm state change
+func parseAlarmEvent(account, region string, detail json.RawMessage) (metricFile, error) {
+	var d cloudWatchAlarmDetail
+	if err := json.Unmarshal(detail, &d); err != nil {
+		return metricFile{}, err
+	}
+	return alarmFile(account, region, d.AlarmName, d.State.Value, d.State.Timestamp)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/akerl/go-lambda/mux"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	scrapePrefix        = "scrapes/"
+	scrapePruneInterval = 10 * time.Minute
+)
+
+// scrapeCall is a scrape being rendered, which identical requests arriving
+// meanwhile wait on instead of rendering again
+type scrapeCall struct {
+	done chan struct{}
+	resp events.Response
+	err  error
+}
+
+// sharedScrape is a rendered scrape stored for other environments
+type sharedScrape struct {
+	RenderedAt int64           `json:"rendered_at"`
+	Response   events.Response `json:"response"`
+}
+
+var (
+	scrapeLock      sync.Mutex
+	scrapeCalls     = map[string]*scrapeCall{}
+	lastScrapePrune time.Time
+)
+
+// scrapeParams are the query parameters the index handler reads, besides
+// format, which is covered by the selected formatter
+var scrapeParams = []string{"family", "shard", "shards"}
+
+// scrapeKey identifies requests that render the same output: the same
+// selected format, scrape parameters, and credentials, since tokens can
+// scope the output. Other parameters and headers are ignored, so they can't
+// be varied to make new keys.
+func scrapeKey(req events.Request) string {
+	contentType := ""
+	if f, err := selectFormatter(req); err == nil {
+		contentType = f.ContentType()
+	}
+	parts := []string{req.Path, contentType, requestHeader(req, "Authorization")}
+	if c.ClientCertHeader != "" {
+		parts = append(parts, requestHeader(req, c.ClientCertHeader))
+	}
+	for _, name := range scrapeParams {
+		parts = append(parts, name+"="+req.QueryStringParameters[name])
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// coalesceRoute shares one render between identical scrapes that arrive
+// together, such as from an HA pair of Prometheus servers. Within this
+// environment, concurrent requests wait for the first. With
+// coalesce_seconds set, a rendered scrape is also stored in the bucket, and
+// other environments serve it until it is that old, with a lock making sure
+// only one of them renders a new one. In Lambda mode stageLock already
+// serializes requests within an environment, so waiting on a render in
+// flight only happens in standalone mode, and coalesce_seconds is what
+// shares renders between Lambda environments.
+func coalesceRoute(handler mux.HandleFunc) mux.HandleFunc {
+	return func(req events.Request) (events.Response, error) {
+		if requestHeader(req, "X-Debug") == "true" && debugAuthorized(req) {
+			return handler(req)
+		}
+		key := scrapeKey(req)
+
+		scrapeLock.Lock()
+		if call, ok := scrapeCalls[key]; ok {
+			scrapeLock.Unlock()
+			<-call.done
+			traceCache("scrape_coalesced")
+			return copyResponse(call.resp), call.err
+		}
+		call := &scrapeCall{done: make(chan struct{})}
+		scrapeCalls[key] = call
+		scrapeLock.Unlock()
+
+		call.resp, call.err = sharedRender(key, req, handler)
+
+		scrapeLock.Lock()
+		delete(scrapeCalls, key)
+		scrapeLock.Unlock()
+		close(call.done)
+		return copyResponse(call.resp), call.err
+	}
+}
+
+// copyResponse copies the headers, which later receivers may add to, so
+// each caller gets its own map
+func copyResponse(resp events.Response) events.Response {
+	if resp.Headers != nil {
+		headers := make(map[string]string, len(resp.Headers))
+		for k, v := range resp.Headers {
+			headers[k] = v
+		}
+		resp.Headers = headers
+	}
+	return resp
+}
+
+// sharedRender serves a recent scrape rendered by another environment, or
+// renders and stores one
+func sharedRender(key string, req events.Request, handler mux.HandleFunc) (events.Response, error) {
+	if c.CoalesceSeconds <= 0 || c.ReadOnly {
+		return handler(req)
+	}
+	client, err := getClient()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+	}
+
+	name := scrapePrefix + key
+	recent := func() (events.Response, bool) {
+		var shared sharedScrape
+		found, err := readInternalObject(client, name, &shared)
+		if err != nil {
+			fmt.Printf("failed to read shared scrape: %s\n", err)
+			return events.Response{}, false
+		}
+		age := time.Since(time.Unix(shared.RenderedAt, 0))
+		return shared.Response, found && age < time.Duration(c.CoalesceSeconds)*time.Second
+	}
+	if resp, ok := recent(); ok {
+		traceCache("scrape_shared")
+		return resp, nil
+	}
+
+	release, err := lockFile(internalPrefix + name)
+	if err != nil {
+		return handler(req)
+	}
+	defer release()
+	if resp, ok := recent(); ok {
+		traceCache("scrape_shared")
+		return resp, nil
+	}
+
+	resp, err := handler(req)
+	if err != nil || resp.StatusCode != 200 {
+		return resp, err
+	}
+	shared := sharedScrape{RenderedAt: time.Now().Unix(), Response: resp}
+	if err := writeInternalObject(client, name, shared); err != nil {
+		fmt.Printf("failed to store shared scrape: %s\n", err)
+	}
+	if err := pruneSharedScrapes(client); err != nil {
+		fmt.Printf("failed to prune shared scrapes: %s\n", err)
+	}
+	return resp, nil
+}
+
+// pruneSharedScrapes deletes stored scrapes too old to be served, at most
+// once per scrapePruneInterval per environment
+func pruneSharedScrapes(client *s3.Client) error {
+	scrapeLock.Lock()
+	if time.Since(lastScrapePrune) < scrapePruneInterval {
+		scrapeLock.Unlock()
+		return nil
+	}
+	lastScrapePrune = time.Now()
+	scrapeLock.Unlock()
+
+	prefix := internalPrefix + scrapePrefix
+	paginator := s3.NewListObjectsV2Paginator(
+		client,
+		&s3.ListObjectsV2Input{Bucket: &c.MetricBucket, Prefix: &prefix},
+	)
+	cutoff := time.Now().Add(-time.Duration(c.CoalesceSeconds) * time.Second)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			if obj.LastModified == nil || obj.LastModified.After(cutoff) {
+				continue
+			}
+			_, err := client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+				Bucket: &c.MetricBucket,
+				Key:    obj.Key,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+const collectdPrefix = "collectd/"
+
+// collectdTypes maps data source types to stored types. counter and derive
+// values are cumulative; absolute values reset on each read, so they are
+// kept as gauges of the last interval.
+var collectdTypes = map[string]string{
+	"gauge":    "gauge",
+	"absolute": "gauge",
+	"counter":  "counter",
+	"derive":   "counter",
+}
+
+// collectdValueList is one entry of write_http's JSON format. Unknown
+// values are sent as null.
+type collectdValueList struct {
+	Values         []*float64 `json:"values"`
+	DSTypes        []string   `json:"dstypes"`
+	DSNames        []string   `json:"dsnames"`
+	Host           string     `json:"host"`
+	Plugin         string     `json:"plugin"`
+	PluginInstance string     `json:"plugin_instance"`
+	Type           string     `json:"type"`
+	TypeInstance   string     `json:"type_instance"`
+}
+
+// collectdHandler accepts collectd write_http posts in the JSON format. Each
+// data source becomes collectd_<dsname>, with _total added for counters,
+// and plugin, plugin_instance, type, and type_instance become tags. Values
+// are stored in the file given by ?name= (default collectd/<host>), and
+// series missing from a post are kept.
+func collectdHandler(req events.Request) (events.Response, error) {
+	body, err := req.DecodedBody()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+	}
+	if err := checkJSONLimits([]byte(body)); err != nil {
+		return events.Respond(400, fmt.Sprintf("rejected body: %s", err))
+	}
+	var lists []collectdValueList
+	if err := json.Unmarshal([]byte(body), &lists); err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to unmarshal: %s", err))
+	}
+
+	metrics := []metric{}
+	for _, vl := range lists {
+		converted, err := collectdMetrics(vl)
+		if err != nil {
+			return events.Respond(400, err.Error())
+		}
+		metrics = append(metrics, converted...)
+	}
+	if len(metrics) == 0 {
+		return events.Succeed("")
+	}
+
+	name := req.QueryStringParameters["name"]
+	if name == "" {
+		name = collectdPrefix + sanitizeLabel(lists[0].Host)
+	}
+	mf := metricFile{FileName: name, Metrics: combineSeries(metrics)}
+	mf.mergeSeries = true
+	return pushMetricFile(req, mf)
+}
+
+func collectdMetrics(vl collectdValueList) ([]metric, error) {
+	if len(vl.DSTypes) != len(vl.Values) || len(vl.DSNames) != len(vl.Values) {
+		return nil, fmt.Errorf("%s/%s: values, dstypes, and dsnames differ in length", vl.Plugin, vl.Type)
+	}
+
+	tags := map[string]string{
+		"host":   sanitizeLabel(vl.Host),
+		"plugin": sanitizeLabel(vl.Plugin),
+		"type":   sanitizeLabel(vl.Type),
+	}
+	if vl.PluginInstance != "" {
+		tags["plugin_instance"] = sanitizeLabel(vl.PluginInstance)
+	}
+	if vl.TypeInstance != "" {
+		tags["type_instance"] = sanitizeLabel(vl.TypeInstance)
+	}
+
+	metrics := []metric{}
+	for i, v := range vl.Values {
+		if v == nil {
+			continue
+		}
+		kind, ok := collectdTypes[vl.DSTypes[i]]
+		if !ok {
+			return nil, fmt.Errorf("%s/%s: unsupported dstype %s", vl.Plugin, vl.Type, vl.DSTypes[i])
+		}
+		name := "collectd_" + sanitizeLabel(vl.DSNames[i])
+		if kind == "counter" {
+			name += "_total"
+		}
+		series := make(map[string]string, len(tags))
+		for k, v := range tags {
+			series[k] = v
+		}
+		metrics = append(metrics, statsdMetric(name, kind, series, *v))
+	}
+	return metrics, nil
+}
@@ -7,21 +7,139 @@ import (
 )
 
 type config struct {
-	AuthToken    string `json:"auth_token"`
-	MetricBucket string `json:"metric_bucket"`
+	AuthToken        string                       `json:"auth_token"`
+	MetricBucket     string                       `json:"metric_bucket"`
+	AdminToken       string                       `json:"admin_token"`
+	Tokens           []tokenConfig                `json:"tokens"`
+	IPHashSalt       string                       `json:"ip_hash_salt"`
+	Bounds           map[string]metricBounds      `json:"bounds"`
+	EventBus         string                       `json:"event_bus"`
+	EnforceUnits     bool                         `json:"enforce_units"`
+	LabelRules       []labelRule                  `json:"label_rules"`
+	PIIScan          piiConfig                    `json:"pii_scan"`
+	Graphite         graphiteConfig               `json:"graphite"`
+	SLOs             map[string]int64             `json:"slos"`
+	DeadLetterBucket string                       `json:"dead_letter_bucket"`
+	ClientCertHeader string                       `json:"client_cert_header"`
+	RequireReadToken bool                         `json:"require_read_token"`
+	EMFNamespace     string                       `json:"emf_namespace"`
+	ResponseHeaders  map[string]map[string]string `json:"response_headers"`
+	Routes           map[string]routeConfig       `json:"routes"`
+	Retention        map[string]int64             `json:"retention"`
+	ReadOnly         bool                         `json:"read_only"`
+	MaxScrapeBytes   int                          `json:"max_scrape_bytes"`
+	DropEmptyLabels  bool                         `json:"drop_empty_labels"`
+	StrictSeries     bool                         `json:"strict_series"`
+	TypeConsistency  string                       `json:"type_consistency"`
+
+	ValidationRules    map[string]string `json:"validation_rules"`
+	MaxSeriesPerMetric int               `json:"max_series_per_metric"`
+
+	MaxFutureSkew       int64  `json:"max_future_skew_seconds"`
+	MaxPastAge          int64  `json:"max_past_age_seconds"`
+	PastTimestampAction string `json:"past_timestamp_action"`
+
+	CounterTable         string    `json:"counter_table"`
+	CounterFlushInterval int64     `json:"counter_flush_seconds"`
+	UnchangedRefresh     int64     `json:"unchanged_refresh_seconds"`
+	LatencyBuckets       []float64 `json:"latency_buckets"`
+
+	RequireRegistration bool     `json:"require_registration"`
+	RegisteredFiles     []string `json:"registered_files"`
+
+	JSONLimits       jsonLimits `json:"json_limits"`
+	MemoryGuardRatio float64    `json:"memory_guard_ratio"`
+	NegativeCacheTTL int64      `json:"negative_cache_seconds"`
+	SelectMinBytes   int64      `json:"select_min_bytes"`
+	CacheDir         string     `json:"cache_dir"`
+	CacheFresh       int64      `json:"cache_fresh_seconds"`
+	CacheLease       int64      `json:"cache_lease_seconds"`
+	CoalesceSeconds  int64      `json:"coalesce_seconds"`
+	ArchivePayloads  bool       `json:"archive_hook_payloads"`
+	MaxBucketBytes   int64      `json:"max_bucket_bytes"`
+
+	Schedule map[string]string `json:"schedule"`
+
+	PinnedFamilies   []string `json:"pinned_families"`
+	ExcludedFamilies []string `json:"excluded_families"`
+
+	MaintenanceMessage string              `json:"maintenance_message"`
+	MaintenanceWindows []maintenanceWindow `json:"maintenance_windows"`
+
+	LockTable string `json:"lock_table"`
+	LockTTL   int64  `json:"lock_ttl_seconds"`
+	LockWait  int64  `json:"lock_wait_seconds"`
+
+	SigningKeyID     string `json:"signing_key_id"`
+	SigningAlgorithm string `json:"signing_algorithm"`
+
+	HotTable        string `json:"hot_table"`
+	HotMaxItemBytes int    `json:"hot_max_item_bytes"`
+
+	SNSTopics     []string `json:"sns_topics"`
+	CallbackHosts []string `json:"callback_hosts"`
+
+	Transforms []transformRuleset `json:"transforms"`
+
+	DropBucket       string `json:"drop_bucket"`
+	DropPrefix       string `json:"drop_prefix"`
+	QuarantinePrefix string `json:"quarantine_prefix"`
+}
+
+// normalize checks and canonicalizes settings that are used on every
+// request, once when the config loads rather than on each use
+func (cfg *config) normalize() error {
+	buckets, err := normalizeLatencyBuckets(cfg.LatencyBuckets)
+	if err != nil {
+		return err
+	}
+	cfg.LatencyBuckets = buckets
+	return nil
+}
+
+type tokenConfig struct {
+	Name         string   `json:"name"`
+	Token        string   `json:"token"`
+	ReadPrefixes []string `json:"read_prefixes"`
+	CertSubjects []string `json:"cert_subjects"`
+	NotBefore    string   `json:"not_before"`
+	Expires      string   `json:"expires"`
+
+	PendingToken      string `json:"pending_token"`
+	HMACSecret        string `json:"hmac_secret"`
+	PendingHMACSecret string `json:"pending_hmac_secret"`
+
+	RateLimit   int   `json:"rate_limit"`
+	SeriesQuota int   `json:"series_quota"`
+	BytesQuota  int64 `json:"bytes_quota"`
 }
 
 var c *config
 
+// cf is the config file backing c, used when writing config changes back
+var cf *s3.ConfigFile
+
+// defaultConfig and defaultFile are the config named by S3_BUCKET and
+// S3_KEY, which c and cf point to outside of stage requests
+var (
+	defaultConfig *config
+	defaultFile   *s3.ConfigFile
+)
+
 func loadConfig() error {
-	cf, err := s3.GetConfigFromEnv(&c)
+	var err error
+	defaultFile, err = s3.GetConfigFromEnv(&defaultConfig)
 	if err != nil {
 		return err
 	}
-	cf.OnError = func(_ *s3.ConfigFile, err error) {
+	defaultFile.OnError = func(_ *s3.ConfigFile, err error) {
 		fmt.Println(err)
 	}
-	cf.Autoreload(60)
+	c, cf = defaultConfig, defaultFile
+	if err := reloadConfig(defaultFile); err != nil {
+		return err
+	}
+	watchConfig(defaultFile)
 
 	return nil
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+// costRow attributes stored series to one value of the chosen label. Series
+// without the label are grouped under an empty value.
+type costRow struct {
+	Value  string `json:"value"`
+	Series int    `json:"series"`
+	Bytes  int64  `json:"bytes"`
+	Files  int    `json:"files"`
+}
+
+// attributeCost groups every stored series by the value of label, sized by
+// its stored JSON encoding, largest first
+func attributeCost(files []metricFile, label string) []costRow {
+	rows := map[string]*costRow{}
+	seen := map[string]map[string]bool{}
+	for _, mf := range files {
+		for _, m := range mf.Metrics {
+			value := m.Tags[label]
+			row, ok := rows[value]
+			if !ok {
+				row = &costRow{Value: value}
+				rows[value] = row
+				seen[value] = map[string]bool{}
+			}
+			row.Series++
+			if content, err := json.Marshal(m); err == nil {
+				row.Bytes += int64(len(content))
+			}
+			if !seen[value][mf.FileName] {
+				seen[value][mf.FileName] = true
+				row.Files++
+			}
+		}
+	}
+
+	report := make([]costRow, 0, len(rows))
+	for _, row := range rows {
+		report = append(report, *row)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Bytes != report[j].Bytes {
+			return report[i].Bytes > report[j].Bytes
+		}
+		return report[i].Value < report[j].Value
+	})
+	return report
+}
+
+func costCSV(label string, rows []costRow) (string, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write([]string{label, "series", "bytes", "files"}); err != nil {
+		return "", err
+	}
+	for _, row := range rows {
+		err := w.Write([]string{
+			row.Value,
+			strconv.Itoa(row.Series),
+			strconv.FormatInt(row.Bytes, 10),
+			strconv.Itoa(row.Files),
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	w.Flush()
+	return buf.String(), w.Error()
+}
+
+// costHandler reports series counts and stored bytes grouped by the label
+// given in ?label=, as JSON or, with ?format=csv or a text/csv Accept
+// header, as CSV
+func costHandler(req events.Request) (events.Response, error) {
+	label := req.QueryStringParameters["label"]
+	if label == "" {
+		return events.Respond(400, "cost reports require a ?label= to group by")
+	}
+	format := req.QueryStringParameters["format"]
+	if format == "" {
+		format = "json"
+		if strings.Contains(requestHeader(req, "Accept"), "text/csv") {
+			format = "csv"
+		}
+	}
+	if format != "json" && format != "csv" {
+		return events.Respond(400, fmt.Sprintf("unsupported format: %s", format))
+	}
+
+	client, err := getClient()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+	}
+	files, err := readMetricFiles(client)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to read metrics: %s", err))
+	}
+	rows := attributeCost(files, label)
+
+	if format == "json" {
+		return respondJSON(200, rows)
+	}
+	body, err := costCSV(label, rows)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to write csv: %s", err))
+	}
+	return events.Response{
+		StatusCode: 200,
+		Body:       body,
+		Headers: map[string]string{
+			"Content-Type":        "text/csv",
+			"Content-Disposition": fmt.Sprintf("attachment; filename=\"cost-%s.csv\"", label),
+		},
+	}, nil
+}
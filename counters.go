@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	counterItemID               = "counters"
+	defaultCounterFlushInterval = 60
+)
+
+var (
+	counterLock   sync.Mutex
+	counterDeltas = map[string]int64{}
+	counterTotals = map[string]int64{}
+	lastFlush     = time.Now()
+
+	// counterFlushes counts flushes to counter_table, so a read of the
+	// table can tell whether a flush landed while it was in flight
+	counterFlushes int64
+)
+
+func incCounter(name string) {
+	counterLock.Lock()
+	defer counterLock.Unlock()
+	counterDeltas[name]++
+}
+
+func recordPush(results ...pushResult) {
+	for _, r := range results {
+		incCounter("pushes_" + r.Status)
+	}
+	maybeFlushCounters()
+}
+
+// maybeFlushCounters persists accumulated counter deltas once the flush
+// interval has passed, so that self-metrics survive cold starts without a
+// table write on every request.
+func maybeFlushCounters() {
+	interval := c.CounterFlushInterval
+	if interval == 0 {
+		interval = defaultCounterFlushInterval
+	}
+	if time.Since(lastFlush) < time.Duration(interval)*time.Second {
+		return
+	}
+	if err := flushCounters(); err != nil {
+		fmt.Printf("failed to flush counters: %s\n", err)
+	}
+}
+
+func flushCounters() error {
+	counterLock.Lock()
+	defer counterLock.Unlock()
+	lastFlush = time.Now()
+
+	if len(counterDeltas) == 0 {
+		return nil
+	}
+	if c.CounterTable == "" {
+		for k, v := range counterDeltas {
+			counterTotals[k] += v
+		}
+		counterDeltas = map[string]int64{}
+		return nil
+	}
+
+	client, err := getDynamoClient()
+	if err != nil {
+		return err
+	}
+
+	names := map[string]string{}
+	values := map[string]types.AttributeValue{}
+	clauses := []string{}
+	i := 0
+	for k, v := range counterDeltas {
+		names[fmt.Sprintf("#c%d", i)] = k
+		values[fmt.Sprintf(":c%d", i)] = &types.AttributeValueMemberN{Value: strconv.FormatInt(v, 10)}
+		clauses = append(clauses, fmt.Sprintf("#c%d :c%d", i, i))
+		i++
+	}
+	expr := "ADD " + strings.Join(clauses, ", ")
+
+	out, err := client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:                 &c.CounterTable,
+		Key:                       counterKey(),
+		UpdateExpression:          &expr,
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+	if err != nil {
+		return err
+	}
+
+	counterDeltas = map[string]int64{}
+	counterTotals = parseCounterItem(out.Attributes)
+	counterFlushes++
+	return nil
+}
+
+// loadCounters re-reads the persisted totals on every scrape, so that each
+// Lambda environment serves the same totals plus its own unflushed deltas,
+// rather than ones that stopped moving when it last flushed. The table is
+// read without holding counterLock, so pushes don't wait on it.
+func loadCounters() error {
+	if c.CounterTable == "" {
+		return nil
+	}
+	counterLock.Lock()
+	flushes := counterFlushes
+	counterLock.Unlock()
+
+	client, err := getDynamoClient()
+	if err != nil {
+		return err
+	}
+	consistent := true
+	out, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName:      &c.CounterTable,
+		Key:            counterKey(),
+		ConsistentRead: &consistent,
+	})
+	if err != nil {
+		return err
+	}
+
+	counterLock.Lock()
+	defer counterLock.Unlock()
+	// A flush that landed meanwhile already set newer totals, which include
+	// the deltas it cleared
+	if counterFlushes == flushes {
+		counterTotals = parseCounterItem(out.Item)
+	}
+	return nil
+}
+
+func counterKey() map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"id": &types.AttributeValueMemberS{Value: counterItemID},
+	}
+}
+
+func parseCounterItem(item map[string]types.AttributeValue) map[string]int64 {
+	totals := map[string]int64{}
+	for k, v := range item {
+		n, ok := v.(*types.AttributeValueMemberN)
+		if !ok {
+			continue
+		}
+		if i, err := strconv.ParseInt(n.Value, 10, 64); err == nil {
+			totals[k] = i
+		}
+	}
+	return totals
+}
+
+func counterMetrics() []metric {
+	if err := loadCounters(); err != nil {
+		fmt.Printf("failed to load counters: %s\n", err)
+	}
+
+	counterLock.Lock()
+	defer counterLock.Unlock()
+
+	totals := map[string]int64{}
+	for k, v := range counterTotals {
+		totals[k] += v
+	}
+	for k, v := range counterDeltas {
+		totals[k] += v
+	}
+
+	metrics := []metric{}
+	for k, v := range totals {
+		if !strings.HasPrefix(k, "pushes_") {
+			continue
+		}
+		metrics = append(metrics, metric{
+			Name:  "hook_exporter_pushes_total",
+			Type:  "counter",
+			Tags:  map[string]string{"result": strings.TrimPrefix(k, "pushes_")},
+			Value: strconv.FormatInt(v, 10),
+		})
+	}
+	metrics = append(metrics, requestMetrics(totals)...)
+	return append(metrics, latencyMetrics(totals)...)
+}
+
+func getDynamoClient() (*dynamodb.Client, error) {
+	cfg, err := awsConfig.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	return dynamodb.NewFromConfig(cfg), nil
+}
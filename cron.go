@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed five-field cron expression
+// (minute hour day-of-month month day-of-week).
+type cronSchedule struct {
+	fields [5]map[int]bool
+}
+
+var cronBounds = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+func parseCron(expr string) (cronSchedule, error) {
+	parts := strings.Fields(expr)
+	if len(parts) != 5 {
+		return cronSchedule{}, fmt.Errorf("cron expression needs 5 fields: %q", expr)
+	}
+
+	var cs cronSchedule
+	for i, part := range parts {
+		values, err := parseCronField(part, cronBounds[i][0], cronBounds[i][1])
+		if err != nil {
+			return cronSchedule{}, fmt.Errorf("invalid cron field %q: %s", part, err)
+		}
+		cs.fields[i] = values
+	}
+	return cs, nil
+}
+
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := map[int]bool{}
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		if idx := strings.Index(item, "/"); idx != -1 {
+			s, err := strconv.Atoi(item[idx+1:])
+			if err != nil || s < 1 {
+				return nil, fmt.Errorf("bad step")
+			}
+			step = s
+			item = item[:idx]
+		}
+
+		lo, hi := min, max
+		if item != "*" {
+			bounds := strings.SplitN(item, "-", 2)
+			var err error
+			lo, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, err
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("out of range %d-%d", min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// Matches reports whether the schedule fires in the minute containing t
+func (cs cronSchedule) Matches(t time.Time) bool {
+	return cs.fields[0][t.Minute()] &&
+		cs.fields[1][t.Hour()] &&
+		cs.fields[2][t.Day()] &&
+		cs.fields[3][int(t.Month())] &&
+		cs.fields[4][int(t.Weekday())]
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const csvTagPrefix = "tag:"
+
+func isCSV(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/csv")
+}
+
+// parseCSV converts a CSV body into a metricFile. The header row names the
+// columns: name and value are required, type (default gauge), help, and unit
+// are optional, and each tag:<key> column sets that tag, with empty cells
+// leaving it unset. Rows are read as a spreadsheet exports them, so a
+// leading byte order mark and blank rows are ignored.
+func parseCSV(name, body string) (metricFile, error) {
+	if name == "" {
+		return metricFile{}, fmt.Errorf(
+			"csv pushes require a ?name= file name or %s header", ndjsonFileHeader,
+		)
+	}
+
+	r := csv.NewReader(strings.NewReader(strings.TrimPrefix(body, "\ufeff")))
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err == io.EOF {
+		return metricFile{}, fmt.Errorf("no metrics in body")
+	} else if err != nil {
+		return metricFile{}, err
+	}
+	columns := map[string]int{}
+	for i, h := range header {
+		h = strings.TrimSpace(h)
+		if !strings.HasPrefix(h, csvTagPrefix) {
+			h = strings.ToLower(h)
+		}
+		if _, ok := columns[h]; ok {
+			return metricFile{}, fmt.Errorf("duplicate column %q", h)
+		}
+		columns[h] = i
+	}
+	for _, required := range []string{"name", "value"} {
+		if _, ok := columns[required]; !ok {
+			return metricFile{}, fmt.Errorf("missing %s column", required)
+		}
+	}
+
+	mf := metricFile{FileName: name}
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return metricFile{}, err
+		}
+		line, _ := r.FieldPos(0)
+		cell := func(column string) string {
+			if i, ok := columns[column]; ok {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		if strings.Join(row, "") == "" {
+			continue
+		}
+
+		m := metric{
+			Name:  cell("name"),
+			Type:  cell("type"),
+			Value: cell("value"),
+			Help:  cell("help"),
+			Unit:  cell("unit"),
+			Tags:  map[string]string{},
+		}
+		if m.Name == "" {
+			return metricFile{}, fmt.Errorf("line %d: missing name", line)
+		}
+		if m.Type == "" {
+			m.Type = "gauge"
+		}
+		for column := range columns {
+			if key := strings.TrimPrefix(column, csvTagPrefix); key != column {
+				if v := cell(column); v != "" {
+					m.Tags[key] = v
+				}
+			}
+		}
+		mf.Metrics = append(mf.Metrics, m)
+	}
+	if len(mf.Metrics) == 0 {
+		return metricFile{}, fmt.Errorf("no metrics in body")
+	}
+	return mf, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+const defaultDatadogFile = "datadog"
+
+// datadogStates maps $ALERT_TRANSITION values to datadog_monitor_state
+var datadogStates = map[string]string{
+	"recovered":    "0",
+	"warn":         "1",
+	"triggered":    "2",
+	"re-triggered": "2",
+	"no data":      "3",
+	"re-no data":   "3",
+}
+
+// datadogPayload is the custom payload the webhook integration must be
+// configured to send, using Datadog's template variables
+type datadogPayload struct {
+	MonitorID  string `json:"monitor_id"`
+	Monitor    string `json:"monitor"`
+	Transition string `json:"transition"`
+}
+
+// datadogHandler accepts Datadog monitor notifications and records each
+// monitor's state as datadog_monitor_state: 0 ok, 1 warn, 2 alert, or 3 no
+// data. Datadog webhooks aren't signed, so the route takes a bearer token
+// set as a custom header on the webhook.
+func datadogHandler(req events.Request) (events.Response, error) {
+	body, err := req.DecodedBody()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+	}
+	if err := checkJSONLimits([]byte(body)); err != nil {
+		return events.Respond(400, fmt.Sprintf("rejected body: %s", err))
+	}
+	var payload datadogPayload
+	if err := json.Unmarshal([]byte(body), &payload); err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to unmarshal: %s", err))
+	}
+	if payload.MonitorID == "" {
+		return events.Respond(400, "payload is missing monitor_id")
+	}
+	state, ok := datadogStates[strings.ToLower(payload.Transition)]
+	if !ok {
+		return events.Respond(400, fmt.Sprintf("unknown transition: %s", payload.Transition))
+	}
+
+	name := req.QueryStringParameters["name"]
+	if name == "" {
+		name = defaultDatadogFile
+	}
+	tags := map[string]string{"monitor_id": sanitizeLabel(payload.MonitorID)}
+	if payload.Monitor != "" {
+		tags["monitor"] = sanitizeLabel(payload.Monitor)
+	}
+	mf := metricFile{FileName: name, Metrics: []metric{{
+		Name:  "datadog_monitor_state",
+		Type:  "gauge",
+		Help:  "Datadog monitor state: 0 ok, 1 warn, 2 alert, 3 no data",
+		Tags:  tags,
+		Value: state,
+	}}}
+	mf.mergeSeries = true
+	return pushMetricFile(req, mf)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+const datadogAgentPrefix = "datadog/"
+
+// datadogIntakeTypes maps Datadog metric types to stored types. Counts are
+// deltas, so they accumulate into counters; rates are already per second.
+var datadogIntakeTypes = map[string]string{
+	"":      "gauge",
+	"gauge": "gauge",
+	"rate":  "gauge",
+	"count": "counter",
+}
+
+type datadogSeriesPayload struct {
+	Series []datadogSeries `json:"series"`
+}
+
+type datadogSeries struct {
+	Metric string      `json:"metric"`
+	Points [][]float64 `json:"points"`
+	Type   string      `json:"type"`
+	Host   string      `json:"host"`
+	Device string      `json:"device"`
+	Tags   []string    `json:"tags"`
+}
+
+// datadogKeyRequest authenticates the Datadog agent's API key, sent in
+// DD-API-KEY or ?api_key=, as a bearer token
+func datadogKeyRequest(req events.Request) events.Request {
+	key := requestHeader(req, "DD-API-KEY")
+	if key == "" {
+		key = req.QueryStringParameters["api_key"]
+	}
+	if key == "" {
+		return req
+	}
+	return bearerRequest(req, key)
+}
+
+// seriesRoute serves the Prometheus series API on GET and the Datadog
+// series intake on POST, which share /api/v1/series
+func seriesRoute(req events.Request) (events.Response, error) {
+	if req.HTTPMethod == "POST" {
+		return datadogIntakeRoute(req)
+	}
+	return seriesHandler(req)
+}
+
+var datadogIntakeRoute = pushRoute(datadogIntakeHandler)
+
+// datadogValidateHandler answers the agent's API key check
+func datadogValidateHandler(req events.Request) (events.Response, error) {
+	req = datadogKeyRequest(req)
+	if resp, err := metricAuth(req); resp.StatusCode != 0 || err != nil {
+		return resp, err
+	}
+	return respondJSON(200, map[string]bool{"valid": true})
+}
+
+// datadogIntakeHandler accepts v1 series payloads from the Datadog agent or
+// DogStatsD forwarding. Each series keeps its newest point, except counts,
+// whose points are summed and added to the stored counter. Series are stored
+// in the file given by ?name= (default datadog/<host>).
+func datadogIntakeHandler(req events.Request) (events.Response, error) {
+	req = datadogKeyRequest(req)
+	if resp, err := metricAuth(req); resp.StatusCode != 0 || err != nil {
+		return resp, err
+	}
+
+	body, err := req.DecodedBody()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+	}
+	raw := []byte(body)
+	if strings.EqualFold(strings.TrimSpace(requestHeader(req, "Content-Encoding")), "deflate") {
+		zr, err := zlib.NewReader(bytes.NewReader(raw))
+		if err == nil {
+			raw, err = readDecompressed(zr)
+			zr.Close()
+		}
+		if err != nil {
+			return events.Respond(400, fmt.Sprintf("failed to decompress: %s", err))
+		}
+	}
+	if err := checkJSONLimits(raw); err != nil {
+		return events.Respond(400, fmt.Sprintf("rejected body: %s", err))
+	}
+	var payload datadogSeriesPayload
+	if err := json.Unmarshal(raw, &payload); err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to unmarshal: %s", err))
+	}
+
+	metrics := []metric{}
+	host := ""
+	for _, s := range payload.Series {
+		m, ok, err := datadogSeriesMetric(s)
+		if err != nil {
+			return events.Respond(400, err.Error())
+		} else if !ok {
+			continue
+		}
+		if host == "" {
+			host = m.Tags["host"]
+		}
+		metrics = append(metrics, m)
+	}
+	if len(metrics) == 0 {
+		return respondJSON(202, map[string]string{"status": "ok"})
+	}
+
+	name := req.QueryStringParameters["name"]
+	if name == "" {
+		name = datadogAgentPrefix + "agent"
+		if host != "" {
+			name = datadogAgentPrefix + host
+		}
+	}
+	mf := metricFile{FileName: name, Metrics: combineSeries(metrics)}
+	mf.accumulate = true
+	return pushMetricFile(req, mf)
+}
+
+// datadogSeriesMetric converts one series, reporting false for series
+// without points
+func datadogSeriesMetric(s datadogSeries) (metric, bool, error) {
+	kind, ok := datadogIntakeTypes[s.Type]
+	if !ok {
+		return metric{}, false, fmt.Errorf("%s: unsupported type %s", s.Metric, s.Type)
+	}
+	if len(s.Points) == 0 {
+		return metric{}, false, nil
+	}
+
+	var newest, sum, value float64
+	for _, p := range s.Points {
+		if len(p) != 2 {
+			return metric{}, false, fmt.Errorf("%s: points must be [timestamp, value]", s.Metric)
+		}
+		if p[0] >= newest {
+			newest, value = p[0], p[1]
+		}
+		sum += p[1]
+	}
+	if kind == "counter" {
+		value = sum
+	}
+
+	tags := map[string]string{}
+	for _, tag := range s.Tags {
+		kv := strings.SplitN(tag, ":", 2)
+		if len(kv) == 1 {
+			kv = append(kv, "true")
+		}
+		if k := sanitizeLabel(kv[0]); k != "" && kv[1] != "" {
+			tags[k] = sanitizeLabel(kv[1])
+		}
+	}
+	if s.Host != "" {
+		tags["host"] = sanitizeLabel(s.Host)
+	}
+	if s.Device != "" {
+		tags["device"] = sanitizeLabel(s.Device)
+	}
+	return statsdMetric(sanitizeLabel(s.Metric), kind, tags, value), true, nil
+}
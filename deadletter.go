@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const deadLetterPrefix = "deadletter/"
+
+type deadLetterResult struct {
+	Reference string `json:"reference"`
+	File      string `json:"file,omitempty"`
+	Success   bool   `json:"success"`
+	Error     string `json:"error,omitempty"`
+}
+
+// deadLetter stores a metricFile that could not be written to the metric
+// bucket in the configured fallback bucket, returning its reference.
+func deadLetter(client *s3.Client, mf metricFile) (string, error) {
+	if c.DeadLetterBucket == "" {
+		return "", fmt.Errorf("no dead letter bucket configured")
+	}
+
+	content, err := json.Marshal(mf)
+	if err != nil {
+		return "", err
+	}
+
+	ref := fmt.Sprintf(
+		"%s%d-%s",
+		deadLetterPrefix,
+		time.Now().UnixNano(),
+		strings.ReplaceAll(mf.FileName, "/", "_"),
+	)
+	_, err = client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket: &c.DeadLetterBucket,
+		Key:    &ref,
+		Body:   bytes.NewReader(content),
+	})
+	return ref, err
+}
+
+func listDeadLetters(client *s3.Client) ([]string, error) {
+	prefix := deadLetterPrefix
+	paginator := s3.NewListObjectsV2Paginator(
+		client,
+		&s3.ListObjectsV2Input{Bucket: &c.DeadLetterBucket, Prefix: &prefix},
+	)
+	refs := []string{}
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return []string{}, err
+		}
+		for _, obj := range page.Contents {
+			refs = append(refs, *obj.Key)
+		}
+	}
+	return refs, nil
+}
+
+func reprocessDeadLetter(client *s3.Client, ref string) deadLetterResult {
+	result := deadLetterResult{Reference: ref}
+
+	obj, err := client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: &c.DeadLetterBucket,
+		Key:    &ref,
+	})
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	body, err := io.ReadAll(obj.Body)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	var mf metricFile
+	err = json.Unmarshal(body, &mf)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.File = mf.FileName
+
+	err = writeMetricFile(client, mf)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	_, err = client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+		Bucket: &c.DeadLetterBucket,
+		Key:    &ref,
+	})
+	if err != nil {
+		result.Error = fmt.Sprintf("reprocessed but failed to remove: %s", err)
+		return result
+	}
+	result.Success = true
+	return result
+}
+
+func deadLetterHandler(req events.Request) (events.Response, error) {
+	if c.DeadLetterBucket == "" {
+		return events.Respond(404, "no dead letter bucket configured")
+	}
+
+	client, err := getClient()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+	}
+
+	refs, err := listDeadLetters(client)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to list dead letters: %s", err))
+	}
+
+	if req.HTTPMethod != "POST" {
+		return respondJSON(200, refs)
+	}
+
+	if ref := req.QueryStringParameters["ref"]; ref != "" {
+		refs = []string{ref}
+	}
+	results := []deadLetterResult{}
+	for _, ref := range refs {
+		results = append(results, reprocessDeadLetter(client, ref))
+	}
+	return respondJSON(200, results)
+}
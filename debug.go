@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/akerl/go-lambda/mux"
+	awsMiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+)
+
+type debugS3Call struct {
+	Operation string  `json:"operation"`
+	Key       string  `json:"key,omitempty"`
+	Duration  float64 `json:"duration_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type debugTrace struct {
+	Duration float64        `json:"duration_ms"`
+	S3Calls  []debugS3Call  `json:"s3_calls"`
+	Cache    map[string]int `json:"cache"`
+	Trace    []string       `json:"trace"`
+}
+
+type debugEnvelope struct {
+	StatusCode int               `json:"status_code"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       string            `json:"body"`
+	Debug      *debugTrace       `json:"debug"`
+}
+
+// activeTrace collects diagnostics for the current debug request. Requests
+// are handled one at a time per Lambda environment; in standalone mode,
+// concurrent requests may add their own entries to an active trace.
+var (
+	activeTrace *debugTrace
+	traceLock   sync.Mutex
+)
+
+func tracef(format string, args ...interface{}) {
+	traceLock.Lock()
+	defer traceLock.Unlock()
+	if activeTrace != nil {
+		activeTrace.Trace = append(activeTrace.Trace, fmt.Sprintf(format, args...))
+	}
+}
+
+func tracePhase(name string, start time.Time) {
+	tracef("phase %s: %.3fms", name, float64(time.Since(start).Microseconds())/1000)
+}
+
+func traceCache(event string) {
+	traceLock.Lock()
+	defer traceLock.Unlock()
+	if activeTrace != nil {
+		activeTrace.Cache[event]++
+	}
+}
+
+// debugReceiver wraps handlers so that requests with X-Debug: true and a
+// valid X-Admin-Token get their response wrapped in a diagnostic envelope.
+type debugReceiver struct {
+	mux.Receiver
+}
+
+func (dr *debugReceiver) Handle(req events.Request) (events.Response, error) {
+	if req.Headers["X-Debug"] != "true" || !debugAuthorized(req) {
+		return dr.Receiver.Handle(req)
+	}
+
+	trace := &debugTrace{S3Calls: []debugS3Call{}, Cache: map[string]int{}, Trace: []string{}}
+	traceLock.Lock()
+	activeTrace = trace
+	traceLock.Unlock()
+
+	start := time.Now()
+	resp, err := dr.Receiver.Handle(req)
+
+	traceLock.Lock()
+	activeTrace = nil
+	traceLock.Unlock()
+	trace.Duration = float64(time.Since(start).Microseconds()) / 1000
+
+	if err != nil {
+		trace.Trace = append(trace.Trace, fmt.Sprintf("handler error: %s", err))
+	}
+	body, mErr := json.Marshal(debugEnvelope{
+		StatusCode: resp.StatusCode,
+		Headers:    resp.Headers,
+		Body:       resp.Body,
+		Debug:      trace,
+	})
+	if mErr != nil {
+		return resp, err
+	}
+	return events.Response{
+		StatusCode: resp.StatusCode,
+		Body:       string(body),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
+
+func debugAuthorized(req events.Request) bool {
+	token := req.Headers["X-Admin-Token"]
+	if c.AdminToken == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(c.AdminToken)) == 1
+}
+
+func traceS3Calls(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc(
+		"TraceS3Calls",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (
+			middleware.InitializeOutput, middleware.Metadata, error,
+		) {
+			traceLock.Lock()
+			tracing := activeTrace != nil
+			traceLock.Unlock()
+			if !tracing {
+				return next.HandleInitialize(ctx, in)
+			}
+
+			start := time.Now()
+			out, md, err := next.HandleInitialize(ctx, in)
+			call := debugS3Call{
+				Operation: awsMiddleware.GetOperationName(ctx),
+				Key:       inputKey(in.Parameters),
+				Duration:  float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				call.Error = err.Error()
+			}
+
+			traceLock.Lock()
+			if activeTrace != nil {
+				activeTrace.S3Calls = append(activeTrace.S3Calls, call)
+			}
+			traceLock.Unlock()
+			return out, md, err
+		},
+	), middleware.After)
+}
+
+func inputKey(params interface{}) string {
+	v := reflect.ValueOf(params)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	f := v.FieldByName("Key")
+	if !f.IsValid() || f.Kind() != reflect.Ptr || f.IsNil() {
+		return ""
+	}
+	if s, ok := f.Elem().Interface().(string); ok {
+		return s
+	}
+	return ""
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	contentHashMeta = "content-hash"
+	pushedAtMeta    = "pushed-at"
+
+	defaultUnchangedRefresh = 300
+)
+
+// contentHash returns a hash of the metrics in a file, along with the token
+// that pushed them and the ruleset version that built them, so a push that
+// changes who owns the file is still stored. Other push-time metadata is
+// ignored. Map keys are sorted by json.Marshal, so the hash is canonical.
+func contentHash(mf metricFile) (string, error) {
+	hashed := struct {
+		Metrics []metric    `json:"metrics"`
+		Token   string      `json:"token,omitempty"`
+		Ruleset *rulesetRef `json:"ruleset,omitempty"`
+	}{Metrics: mf.Metrics, Ruleset: mf.Ruleset}
+	if mf.Source != nil {
+		hashed.Token = mf.Source.Token
+	}
+	content, err := json.Marshal(hashed)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// isUnchanged checks the stored object's metadata to see whether a push is
+// identical to what is already stored. Identical pushes only update the
+// stored push time, with touchMetricFile, until it is older than the refresh
+// interval, when they are written again so that copies of the body cached
+// elsewhere catch up.
+func isUnchanged(client *s3.Client, mf metricFile) bool {
+	hash, err := contentHash(mf)
+	if err != nil {
+		return false
+	}
+	if isKnownMissing(mf.FileName) {
+		return false
+	}
+
+	head, err := client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: &c.MetricBucket,
+		Key:    &mf.FileName,
+	})
+	if err != nil {
+		if isNotFound(err) {
+			markMissing(mf.FileName)
+		}
+		return false
+	}
+	if head.Metadata[contentHashMeta] != hash {
+		return false
+	}
+
+	pushedAt, err := strconv.ParseInt(head.Metadata[pushedAtMeta], 10, 64)
+	if err != nil {
+		return false
+	}
+	refresh := c.UnchangedRefresh
+	if refresh == 0 {
+		refresh = defaultUnchangedRefresh
+	}
+	return time.Now().Unix()-pushedAt < refresh
+}
+
+func writeMetadata(mf metricFile) map[string]string {
+	meta := map[string]string{
+		pushedAtMeta: strconv.FormatInt(mf.PushedAt, 10),
+	}
+	if hash, err := contentHash(mf); err == nil {
+		meta[contentHashMeta] = hash
+	}
+	return meta
+}
+
+// touchMetricFile records the push time of an unchanged push by copying the
+// stored object onto itself with new metadata, so the body isn't uploaded
+// again. readMetricFile prefers the newer of the two push times.
+func touchMetricFile(client *s3.Client, mf metricFile) error {
+	source := c.MetricBucket + "/" + (&url.URL{Path: mf.FileName}).EscapedPath()
+	meta := writeMetadata(mf)
+	out, err := client.CopyObject(context.TODO(), &s3.CopyObjectInput{
+		Bucket:            &c.MetricBucket,
+		Key:               &mf.FileName,
+		CopySource:        &source,
+		Metadata:          meta,
+		MetadataDirective: types.MetadataDirectiveReplace,
+	})
+	if err != nil {
+		return err
+	}
+	if entry, ok := loadDiskEntry(mf.FileName); ok && out.CopyObjectResult != nil &&
+		out.CopyObjectResult.ETag != nil && entry.ETag == *out.CopyObjectResult.ETag {
+		storeDiskEntry(mf.FileName, &entry.ETag, entry.Body, meta)
+	}
+	return mirrorMetricFile(mf)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+const defaultCacheLease = 10
+
+// diskEntry is an object body saved under cache_dir with the ETag and
+// metadata it had and when S3 last confirmed it was current
+type diskEntry struct {
+	ETag      string            `json:"etag"`
+	Body      []byte            `json:"body"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	CheckedAt int64             `json:"checked_at"`
+}
+
+func cacheLease() time.Duration {
+	lease := c.CacheLease
+	if lease == 0 {
+		lease = defaultCacheLease
+	}
+	return time.Duration(lease) * time.Second
+}
+
+// fresh reports whether the entry can be served without asking S3
+func (e diskEntry) fresh() bool {
+	age := time.Since(time.Unix(e.CheckedAt, 0))
+	return age < time.Duration(c.CacheFresh)*time.Second
+}
+
+// diskCachePath maps a key to its file under cache_dir. The bucket is
+// included since stages may use different buckets.
+func diskCachePath(key string) string {
+	sum := sha256.Sum256([]byte(c.MetricBucket + "/" + key))
+	return filepath.Join(c.CacheDir, hex.EncodeToString(sum[:])+".json")
+}
+
+func loadDiskEntry(key string) (diskEntry, bool) {
+	var entry diskEntry
+	content, err := os.ReadFile(diskCachePath(key))
+	if err != nil {
+		return entry, false
+	}
+	if err := json.Unmarshal(content, &entry); err != nil || entry.ETag == "" {
+		return entry, false
+	}
+	return entry, true
+}
+
+// storeDiskEntry writes to a temporary file and renames it into place, so
+// concurrent readers never see a partial entry. Failures only cost a later
+// full read, so they are logged and otherwise ignored.
+func storeDiskEntry(key string, etag *string, body []byte, meta map[string]string) {
+	if c.CacheDir == "" || etag == nil {
+		return
+	}
+	entry := diskEntry{ETag: *etag, Body: body, Metadata: meta, CheckedAt: time.Now().Unix()}
+	content, err := json.Marshal(entry)
+	if err == nil {
+		err = os.MkdirAll(c.CacheDir, 0o700)
+	}
+	var tmp *os.File
+	if err == nil {
+		tmp, err = os.CreateTemp(c.CacheDir, ".entry-*")
+	}
+	if err != nil {
+		fmt.Printf("failed to write disk cache: %s\n", err)
+		return
+	}
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), diskCachePath(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		fmt.Printf("failed to write disk cache: %s\n", err)
+	}
+}
+
+func dropDiskEntry(key string) {
+	if c.CacheDir != "" {
+		os.Remove(diskCachePath(key))
+	}
+}
+
+func isNotModified(err error) bool {
+	var re *smithyhttp.ResponseError
+	return errors.As(err, &re) && re.HTTPStatusCode() == 304
+}
+
+// acquireDiskLease claims the right to refresh key's entry, so that when
+// cache_dir is shared over EFS only one environment goes to S3 for it. A
+// lease left behind by an environment that died is taken over once it is
+// older than cache_lease_seconds.
+func acquireDiskLease(key string) (func(), bool) {
+	path := diskCachePath(key) + ".lease"
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, true
+		}
+		if err := os.MkdirAll(c.CacheDir, 0o700); err != nil {
+			return nil, false
+		}
+		info, err := os.Stat(path)
+		if err == nil && time.Since(info.ModTime()) > cacheLease() {
+			os.Remove(path)
+		}
+	}
+	return nil, false
+}
+
+// waitForDiskEntry waits for the lease holder to write key's entry
+func waitForDiskEntry(key string, previous diskEntry) (diskEntry, bool) {
+	deadline := time.Now().Add(cacheLease())
+	for time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		if entry, ok := loadDiskEntry(key); ok && entry.CheckedAt > previous.CheckedAt {
+			return entry, true
+		}
+	}
+	return diskEntry{}, false
+}
+
+// readObject returns the body of key. With cache_dir set, bodies are kept on
+// disk and revalidated with If-None-Match, so a fresh execution environment
+// gets unchanged objects from disk instead of downloading them again.
+// Entries checked within cache_fresh_seconds are served without asking S3.
+// When an entry needs refreshing, one caller holds a lease and the rest
+// serve the existing entry, or wait for the holder when there isn't one.
+// Files locked for a push are always revalidated.
+func readObject(client *s3.Client, key string) ([]byte, error) {
+	entry, err := readObjectEntry(client, key)
+	return entry.Body, err
+}
+
+// readObjectEntry is readObject, also returning the object's metadata
+func readObjectEntry(client *s3.Client, key string) (diskEntry, error) {
+	if c.CacheDir == "" {
+		return fetchObject(client, key, diskEntry{}, false)
+	}
+	entry, cached := loadDiskEntry(key)
+	if lockInFlight(key) {
+		// Reads made while changing a file must see its current contents
+		return fetchObject(client, key, entry, cached)
+	}
+	if cached && entry.fresh() {
+		traceCache("disk_fresh")
+		return entry, nil
+	}
+
+	release, ok := acquireDiskLease(key)
+	if ok {
+		defer release()
+		return fetchObject(client, key, entry, cached)
+	}
+	if cached {
+		traceCache("disk_stale")
+		return entry, nil
+	}
+	if entry, ok := waitForDiskEntry(key, entry); ok {
+		traceCache("disk_wait")
+		return entry, nil
+	}
+	return fetchObject(client, key, entry, cached)
+}
+
+func fetchObject(client *s3.Client, key string, entry diskEntry, cached bool) (diskEntry, error) {
+	input := &s3.GetObjectInput{
+		Bucket: &c.MetricBucket,
+		Key:    &key,
+	}
+	if cached {
+		input.IfNoneMatch = &entry.ETag
+	}
+
+	result, err := client.GetObject(context.TODO(), input)
+	if cached && isNotModified(err) {
+		traceCache("disk_hit")
+		storeDiskEntry(key, &entry.ETag, entry.Body, entry.Metadata)
+		return entry, nil
+	} else if err != nil {
+		if isNotFound(err) {
+			dropDiskEntry(key)
+		}
+		return diskEntry{}, err
+	}
+	defer result.Body.Close()
+	if c.CacheDir != "" {
+		traceCache("disk_miss")
+	}
+
+	body, err := io.ReadAll(result.Body)
+	if err != nil {
+		return diskEntry{}, err
+	}
+	storeDiskEntry(key, result.ETag, body, result.Metadata)
+	return diskEntry{Body: body, Metadata: result.Metadata}, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+// familyDoc describes one metric family as stored, for the docs catalog
+type familyDoc struct {
+	Name      string
+	Type      string
+	Help      string
+	Unit      string
+	Labels    []string
+	Files     []string
+	Tokens    []string
+	UpdatedAt int64
+}
+
+func (d familyDoc) Updated() string {
+	if d.UpdatedAt == 0 {
+		return ""
+	}
+	return time.Unix(d.UpdatedAt, 0).UTC().Format(time.RFC3339)
+}
+
+var docsTemplate = template.Must(template.New("docs").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Metrics</title></head>
+<body>
+<h1>Metrics</h1>
+<table>
+<tr><th>Name</th><th>Type</th><th>Unit</th><th>Help</th><th>Labels</th><th>Files</th><th>Tokens</th><th>Updated</th></tr>
+{{- range .}}
+<tr id="{{.Name}}"><td><code>{{.Name}}</code></td><td>{{.Type}}</td><td>{{.Unit}}</td><td>{{.Help}}</td><td>{{range $i, $l := .Labels}}{{if $i}}, {{end}}<code>{{$l}}</code>{{end}}</td><td>{{range $i, $f := .Files}}{{if $i}}, {{end}}{{$f}}{{end}}</td><td>{{range $i, $t := .Tokens}}{{if $i}}, {{end}}{{$t}}{{end}}</td><td>{{.Updated}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// documentFamilies builds the catalog entries from stored files
+func documentFamilies(files []metricFile) []familyDoc {
+	type sets struct {
+		labels, files, tokens map[string]bool
+	}
+	byName := map[string]*familyDoc{}
+	seen := map[string]*sets{}
+	for _, mf := range files {
+		for _, m := range mf.Metrics {
+			d, ok := byName[m.Name]
+			if !ok {
+				d = &familyDoc{Name: m.Name, Type: m.Type, Help: m.Help, Unit: m.Unit}
+				byName[m.Name] = d
+				seen[m.Name] = &sets{map[string]bool{}, map[string]bool{}, map[string]bool{}}
+			}
+			s := seen[m.Name]
+			for k := range m.Tags {
+				s.labels[k] = true
+			}
+			s.files[mf.FileName] = true
+			if mf.Source != nil && mf.Source.Token != "" {
+				s.tokens[mf.Source.Token] = true
+			}
+			if d.Help == "" {
+				d.Help = m.Help
+			}
+			if mf.PushedAt > d.UpdatedAt {
+				d.UpdatedAt = mf.PushedAt
+			}
+		}
+	}
+
+	docs := make([]familyDoc, 0, len(byName))
+	for name, d := range byName {
+		s := seen[name]
+		d.Labels = sortedKeys(s.labels)
+		d.Files = sortedKeys(s.files)
+		d.Tokens = sortedKeys(s.tokens)
+		docs = append(docs, *d)
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		return docs[i].Name < docs[j].Name
+	})
+	return docs
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func markdownDocs(docs []familyDoc) string {
+	cell := strings.NewReplacer("|", `\|`, "\n", " ")
+	var buf strings.Builder
+	buf.WriteString("# Metrics\n\n")
+	buf.WriteString("| Name | Type | Unit | Help | Labels | Files | Tokens | Updated |\n")
+	buf.WriteString("| --- | --- | --- | --- | --- | --- | --- | --- |\n")
+	for _, d := range docs {
+		fmt.Fprintf(&buf, "| `%s` | %s | %s | %s | %s | %s | %s | %s |\n",
+			d.Name,
+			d.Type,
+			d.Unit,
+			cell.Replace(d.Help),
+			cell.Replace(strings.Join(d.Labels, ", ")),
+			cell.Replace(strings.Join(d.Files, ", ")),
+			cell.Replace(strings.Join(d.Tokens, ", ")),
+			d.Updated(),
+		)
+	}
+	return buf.String()
+}
+
+// docsHandler serves a catalog of stored metric families, as HTML for
+// browsers and markdown otherwise. ?format=html|markdown overrides the
+// Accept header.
+func docsHandler(req events.Request) (events.Response, error) {
+	format := req.QueryStringParameters["format"]
+	if format == "" {
+		format = "markdown"
+		if strings.Contains(requestHeader(req, "Accept"), "text/html") {
+			format = "html"
+		}
+	}
+	if format != "html" && format != "markdown" {
+		return events.Respond(400, fmt.Sprintf("unsupported format: %s", format))
+	}
+
+	client, err := getClient()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+	}
+	files, err := readMetricFiles(client)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to read metrics: %s", err))
+	}
+	files, ok := scopeMetricFiles(req, files)
+	if !ok {
+		return events.Reject("bad auth token")
+	}
+	docs := documentFamilies(redactMetricFiles(files))
+
+	if format == "markdown" {
+		return events.Response{
+			StatusCode: 200,
+			Body:       markdownDocs(docs),
+			Headers:    map[string]string{"Content-Type": "text/markdown; charset=utf-8"},
+		}, nil
+	}
+
+	var buf bytes.Buffer
+	if err := docsTemplate.Execute(&buf, docs); err != nil {
+		return events.Fail(fmt.Sprintf("failed to render docs: %s", err))
+	}
+	return events.Response{
+		StatusCode: 200,
+		Body:       buf.String(),
+		Headers:    map[string]string{"Content-Type": "text/html; charset=utf-8"},
+	}, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maintenanceWindow is planned downtime for the files under Prefix, either
+// a fixed Start/End range in RFC3339 or a recurring window of
+// DurationSeconds starting at each match of the Cron expression. Freshness
+// SLOs are suspended for matching files while a window is active.
+type maintenanceWindow struct {
+	Prefix          string `json:"prefix"`
+	Start           string `json:"start"`
+	End             string `json:"end"`
+	Cron            string `json:"cron"`
+	DurationSeconds int64  `json:"duration_seconds"`
+}
+
+func (w maintenanceWindow) Active(now time.Time) (bool, error) {
+	if w.Cron != "" {
+		cs, err := parseCron(w.Cron)
+		if err != nil {
+			return false, err
+		}
+		if w.DurationSeconds <= 0 {
+			return false, fmt.Errorf("cron windows need duration_seconds")
+		}
+		earliest := now.Add(-time.Duration(w.DurationSeconds) * time.Second)
+		for t := now.Truncate(time.Minute); t.After(earliest); t = t.Add(-time.Minute) {
+			if cs.Matches(t) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	start, err := time.Parse(time.RFC3339, w.Start)
+	if err != nil {
+		return false, fmt.Errorf("invalid start: %s", err)
+	}
+	end, err := time.Parse(time.RFC3339, w.End)
+	if err != nil {
+		return false, fmt.Errorf("invalid end: %s", err)
+	}
+	return !now.Before(start) && now.Before(end), nil
+}
+
+// inMaintenanceWindow reports whether any configured window covering the
+// file is active
+func inMaintenanceWindow(name string, now time.Time) bool {
+	for _, w := range c.MaintenanceWindows {
+		if !strings.HasPrefix(name, w.Prefix) {
+			continue
+		}
+		active, err := w.Active(now)
+		if err != nil {
+			fmt.Printf("invalid maintenance window for %s: %s\n", w.Prefix, err)
+			continue
+		}
+		if active {
+			return true
+		}
+	}
+	return false
+}
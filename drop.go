@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	lambdaEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	defaultQuarantinePrefix = "quarantine/"
+
+	// maxReasonLength keeps the quarantine reason within S3's metadata limits
+	maxReasonLength = 1024
+)
+
+func quarantinePrefix() string {
+	if c.QuarantinePrefix != "" {
+		return c.QuarantinePrefix
+	}
+	return defaultQuarantinePrefix
+}
+
+// handleS3Drop ingests metricFiles uploaded to drop_bucket under
+// drop_prefix. Accepted files are pushed and removed from the drop bucket;
+// rejected ones are moved under the quarantine prefix with the reason in
+// their metadata.
+func (sr *stageReceiver) handleS3Drop(ctx context.Context, raw json.RawMessage) (events.Response, error) {
+	var event lambdaEvents.S3Event
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return events.Response{}, err
+	}
+
+	for _, record := range event.Records {
+		if !strings.HasPrefix(record.EventName, "ObjectCreated:") {
+			continue
+		}
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			return events.Response{}, err
+		}
+		req := events.Request{HTTPMethod: "POST", Path: "/drop"}
+
+		_, err = sr.inStage(ctx, req, func() (events.Response, error) {
+			if record.S3.Bucket.Name != c.DropBucket || !strings.HasPrefix(key, c.DropPrefix) {
+				return events.Succeed("")
+			}
+			if strings.HasPrefix(key, quarantinePrefix()) {
+				return events.Succeed("")
+			}
+			return events.Response{}, ingestDropFile(req, key)
+		})
+		if err != nil {
+			return events.Response{}, fmt.Errorf("failed to ingest %s: %s", key, err)
+		}
+	}
+	return events.Succeed("")
+}
+
+// ingestDropFile pushes one dropped file. Errors are only returned when the
+// outcome is unknown, so the event is retried.
+func ingestDropFile(req events.Request, key string) error {
+	client, err := getClient()
+	if err != nil {
+		return err
+	}
+	result, err := client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: &c.DropBucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return err
+	}
+	defer result.Body.Close()
+	content, err := io.ReadAll(result.Body)
+	if err != nil {
+		return err
+	}
+
+	req.Body = string(content)
+	resp, err := pushRoute(dropFileHandler(key))(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 500 || resp.StatusCode == 409 || resp.StatusCode == 429 {
+		return fmt.Errorf("push failed with %d: %s", resp.StatusCode, resp.Body)
+	}
+	if resp.StatusCode >= 300 {
+		if err := quarantineDropFile(client, key, content, resp.Body); err != nil {
+			return err
+		}
+	}
+
+	_, err = client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+		Bucket: &c.DropBucket,
+		Key:    &key,
+	})
+	return err
+}
+
+// dropFileHandler pushes a dropped metricFile, naming it after its key
+// (less the drop prefix) when the body doesn't name it
+func dropFileHandler(key string) func(events.Request) (events.Response, error) {
+	return func(req events.Request) (events.Response, error) {
+		err := checkJSONLimits([]byte(req.Body))
+		if err != nil {
+			return events.Respond(400, fmt.Sprintf("rejected body: %s", err))
+		}
+		mf, err := parseMetricFile([]byte(req.Body))
+		if err != nil {
+			return events.Respond(400, fmt.Sprintf("failed to unmarshal: %s", err))
+		}
+		if mf.FileName == "" {
+			mf.FileName = strings.TrimSuffix(strings.TrimPrefix(key, c.DropPrefix), ".json")
+		}
+		return pushMetricFile(req, mf)
+	}
+}
+
+func quarantineDropFile(client *s3.Client, key string, content []byte, reason string) error {
+	if len(reason) > maxReasonLength {
+		reason = reason[:maxReasonLength]
+	}
+	dest := quarantinePrefix() + strings.TrimPrefix(key, c.DropPrefix)
+	_, err := client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket:   &c.DropBucket,
+		Key:      &dest,
+		Body:     bytes.NewReader(content),
+		Metadata: map[string]string{"reason": url.QueryEscape(reason)},
+	})
+	return err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	lambdaEvents "github.com/aws/aws-lambda-go/events"
+)
+
+const scheduledEventType = "Scheduled Event"
+
+// handleEventBridge ingests EventBridge invocations. Scheduled rules run the
+// scheduled job named by the end of the rule name (e.g. a rule named
+// hook-exporter-retention runs retention), CloudWatch alarm state changes
+// are recorded as alarm state gauges, and other events are pushed with the
+// metricFile in their detail. Errors are returned so EventBridge retries.
+func (sr *stageReceiver) handleEventBridge(ctx context.Context, raw json.RawMessage) (events.Response, error) {
+	var event lambdaEvents.CloudWatchEvent
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return events.Response{}, err
+	}
+	if event.Source == eventSource {
+		return events.Succeed("ignoring hook-exporter's own event")
+	}
+
+	req := events.Request{
+		HTTPMethod: "POST",
+		Path:       "/eventbridge",
+		Body:       string(event.Detail),
+	}
+	resp, err := sr.inStage(ctx, req, func() (events.Response, error) {
+		if event.DetailType == scheduledEventType && event.Source == "aws.events" {
+			return runScheduledEvent(event)
+		}
+		if event.DetailType == alarmChangeType && event.Source == alarmChangeSource {
+			return pushRoute(func(req events.Request) (events.Response, error) {
+				mf, err := parseAlarmEvent(event.AccountID, event.Region, event.Detail)
+				if err != nil {
+					return events.Respond(400, fmt.Sprintf("failed to parse alarm: %s", err))
+				}
+				return pushMetricFile(req, mf)
+			})(req)
+		}
+		return pushRoute(eventDetailHandler)(req)
+	})
+	if err == nil && resp.StatusCode >= 300 {
+		err = fmt.Errorf("event %s rejected with %d: %s", event.ID, resp.StatusCode, resp.Body)
+	}
+	return resp, err
+}
+
+func runScheduledEvent(event lambdaEvents.CloudWatchEvent) (events.Response, error) {
+	for _, rule := range event.Resources {
+		rule = rule[strings.LastIndex(rule, "/")+1:]
+		for name, job := range scheduledJobs {
+			if rule != name && !strings.HasSuffix(rule, "-"+name) {
+				continue
+			}
+			if err := job(); err != nil {
+				return events.Fail(fmt.Sprintf("scheduled job %s failed: %s", name, err))
+			}
+			return events.Succeed(fmt.Sprintf("ran %s", name))
+		}
+	}
+	return events.Respond(400, fmt.Sprintf("no scheduled job matches %s", strings.Join(event.Resources, ", ")))
+}
+
+func eventDetailHandler(req events.Request) (events.Response, error) {
+	err := checkJSONLimits([]byte(req.Body))
+	if err != nil {
+		return events.Respond(400, fmt.Sprintf("rejected body: %s", err))
+	}
+	mf, err := parseMetricFile([]byte(req.Body))
+	if err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to unmarshal detail: %s", err))
+	}
+	return pushMetricFile(req, mf)
+}
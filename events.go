@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+)
+
+const eventSource = "hook-exporter"
+
+func publishEvent(detailType string, detail interface{}) error {
+	if c.EventBus == "" {
+		return nil
+	}
+
+	body, err := json.Marshal(detail)
+	if err != nil {
+		return err
+	}
+	bodyString := string(body)
+
+	cfg, err := awsConfig.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		return err
+	}
+	client := eventbridge.NewFromConfig(cfg)
+
+	source := eventSource
+	_, err = client.PutEvents(context.TODO(), &eventbridge.PutEventsInput{
+		Entries: []types.PutEventsRequestEntry{{
+			EventBusName: &c.EventBus,
+			Source:       &source,
+			DetailType:   &detailType,
+			Detail:       &bodyString,
+		}},
+	})
+	return err
+}
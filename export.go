@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+func exportCSVHandler(req events.Request) (events.Response, error) {
+	client, err := getClient()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+	}
+
+	files, err := readMetricFiles(client)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to read metrics: %s", err))
+	}
+	files, ok := scopeMetricFiles(req, files)
+	if !ok {
+		return events.Reject("bad auth token")
+	}
+	files = redactMetricFiles(files)
+
+	body, err := csvFormatter{}.Format(mergeMetricFiles(files).Metrics)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to write csv: %s", err))
+	}
+
+	resp := formattedResponse(csvFormatter{}, body)
+	resp.Headers["Content-Disposition"] = "attachment; filename=\"metrics.csv\""
+	if err := signResponse(&resp, body); err != nil {
+		return events.Fail(fmt.Sprintf("failed to sign output: %s", err))
+	}
+	return resp, nil
+}
+
+func labelString(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k, tags[k]))
+	}
+	return strings.Join(pairs, ";")
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// isExposition reports whether a push body is in the Prometheus text format
+func isExposition(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/plain")
+}
+
+// parseExposition converts a Prometheus text exposition body into a
+// metricFile. HELP and TYPE comments apply to the samples of their family;
+// samples without a TYPE are stored as untyped, and the samples of
+// histogram and summary families are folded into those types.
+func parseExposition(name, body string) (metricFile, error) {
+	if name == "" {
+		return metricFile{}, fmt.Errorf("text pushes require a ?name= file name")
+	}
+
+	types := map[string]string{}
+	helps := map[string]string{}
+	mf := metricFile{FileName: name}
+
+	for i, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) < 4 {
+				continue
+			}
+			switch fields[1] {
+			case "TYPE":
+				types[fields[2]] = fields[3]
+			case "HELP":
+				helps[fields[2]] = unescapeHelp(fields[3])
+			}
+			continue
+		}
+
+		m, err := parseSample(line)
+		if err != nil {
+			return metricFile{}, fmt.Errorf("line %d: %s", i+1, err)
+		}
+		m.Type = types[m.Name]
+		if m.Type == "" {
+			m.Type = "untyped"
+		}
+		m.Help = helps[m.Name]
+		mf.Metrics = append(mf.Metrics, m)
+	}
+
+	var err error
+	mf.Metrics, err = foldSamples(mf.Metrics, types, helps)
+	if err != nil {
+		return metricFile{}, err
+	}
+	return mf, nil
+}
+
+// foldSamples collapses the _bucket, _sum, and _count samples of histogram
+// families, and the quantile, _sum, and _count samples of summary families,
+// into one histogram or summary metric per label set, as types declares.
+// Other samples, and metrics that are already folded, are returned as they
+// are.
+func foldSamples(samples []metric, types, helps map[string]string) ([]metric, error) {
+	folded := []metric{}
+	index := map[string]int{}
+	counted := map[int]bool{}
+	for _, s := range samples {
+		base, suffix, kind := sampleFamily(s.Name, types)
+		if kind == "" || s.Histogram != nil || s.Summary != nil {
+			folded = append(folded, s)
+			continue
+		}
+
+		tags := make(map[string]string, len(s.Tags))
+		for k, v := range s.Tags {
+			if (kind == "histogram" && k == "le") || (kind == "summary" && k == "quantile") {
+				continue
+			}
+			tags[k] = v
+		}
+		m := metric{Name: base, Type: kind, Help: helps[base], Tags: tags}
+		key := seriesKey(m)
+		i, ok := index[key]
+		if !ok {
+			if kind == "histogram" {
+				m.Histogram = &histogram{}
+			} else {
+				m.Summary = &summary{Quantiles: map[string]string{}}
+			}
+			i = len(folded)
+			index[key] = i
+			folded = append(folded, m)
+		}
+
+		f := &folded[i]
+		if s.Timestamp > f.Timestamp {
+			f.Timestamp = s.Timestamp
+		}
+		if err := foldSample(f, s, suffix); err != nil {
+			return nil, fmt.Errorf("%s: %s", s.Name, err)
+		}
+		if suffix == "_count" {
+			counted[i] = true
+		}
+	}
+
+	for i := range folded {
+		h := folded[i].Histogram
+		if h == nil {
+			continue
+		}
+		sort.SliceStable(h.Buckets, func(a, b int) bool {
+			x, _ := parseValue(h.Buckets[a].LE)
+			y, _ := parseValue(h.Buckets[b].LE)
+			return x < y
+		})
+		if n := len(h.Buckets); !counted[i] && n > 0 && h.Buckets[n-1].LE == "+Inf" {
+			h.Count = h.Buckets[n-1].Count
+		}
+	}
+	return folded, nil
+}
+
+// sampleFamily returns the histogram or summary family a sample belongs to,
+// with the sample's suffix, or an empty kind for other samples
+func sampleFamily(name string, types map[string]string) (string, string, string) {
+	if types[name] == "summary" {
+		return name, "", "summary"
+	}
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		base := strings.TrimSuffix(name, suffix)
+		if base == name {
+			continue
+		}
+		switch types[base] {
+		case "histogram":
+			return base, suffix, "histogram"
+		case "summary":
+			if suffix != "_bucket" {
+				return base, suffix, "summary"
+			}
+		}
+	}
+	return "", "", ""
+}
+
+func foldSample(m *metric, s metric, suffix string) error {
+	switch suffix {
+	case "_sum":
+		if m.Histogram != nil {
+			m.Histogram.Sum = s.Value
+		} else {
+			m.Summary.Sum = s.Value
+		}
+	case "_count":
+		n, err := sampleCount(s.Value)
+		if err != nil {
+			return err
+		}
+		if m.Histogram != nil {
+			m.Histogram.Count = n
+		} else {
+			m.Summary.Count = n
+		}
+	case "_bucket":
+		le, ok := s.Tags["le"]
+		if !ok {
+			return fmt.Errorf("bucket is missing le")
+		}
+		n, err := sampleCount(s.Value)
+		if err != nil {
+			return err
+		}
+		m.Histogram.Buckets = append(m.Histogram.Buckets, histogramBucket{LE: le, Count: n})
+	default:
+		q, ok := s.Tags["quantile"]
+		if !ok {
+			return fmt.Errorf("summary sample is missing quantile")
+		}
+		m.Summary.Quantiles[q] = s.Value
+	}
+	return nil
+}
+
+// sampleCount parses a count sample, which must be a whole number
+func sampleCount(value string) (uint64, error) {
+	v, err := parseValue(value)
+	if err != nil || v < 0 || v != math.Trunc(v) || v >= math.MaxUint64 {
+		return 0, fmt.Errorf("invalid count %q", value)
+	}
+	return uint64(v), nil
+}
+
+// parseSample parses a single `name{label="value"} value [timestamp]` line
+func parseSample(line string) (metric, error) {
+	m := metric{Tags: map[string]string{}}
+
+	end := strings.IndexAny(line, "{ ")
+	if end == -1 {
+		return metric{}, fmt.Errorf("missing value")
+	}
+	m.Name = line[:end]
+	rest := line[end:]
+
+	if strings.HasPrefix(rest, "{") {
+		var err error
+		rest, err = parseLabels(rest[1:], m.Tags)
+		if err != nil {
+			return metric{}, err
+		}
+	}
+
+	fields := strings.Fields(rest)
+	switch len(fields) {
+	case 2:
+		ts, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return metric{}, fmt.Errorf("invalid timestamp: %s", fields[1])
+		}
+		m.Timestamp = ts
+		fallthrough
+	case 1:
+		m.Value = fields[0]
+	default:
+		return metric{}, fmt.Errorf("expected a value and optional timestamp")
+	}
+	return m, nil
+}
+
+// parseLabels reads label pairs up to the closing brace into tags, returning
+// the remainder of the line
+func parseLabels(s string, tags map[string]string) (string, error) {
+	for {
+		s = strings.TrimLeft(s, " ,")
+		if strings.HasPrefix(s, "}") {
+			return s[1:], nil
+		}
+
+		eq := strings.Index(s, "=")
+		if eq == -1 || len(s) < eq+2 || s[eq+1] != '"' {
+			return "", fmt.Errorf("malformed labels")
+		}
+		key := strings.TrimSpace(s[:eq])
+		s = s[eq+2:]
+
+		var sb strings.Builder
+		closed := false
+		for i := 0; i < len(s); i++ {
+			ch := s[i]
+			if ch == '\\' && i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					sb.WriteByte('\n')
+				default:
+					sb.WriteByte(s[i])
+				}
+				continue
+			}
+			if ch == '"' {
+				s = s[i+1:]
+				closed = true
+				break
+			}
+			sb.WriteByte(ch)
+		}
+		if !closed {
+			return "", fmt.Errorf("unterminated label value for %s", key)
+		}
+		tags[key] = sb.String()
+	}
+}
+
+func unescapeHelp(v string) string {
+	return strings.NewReplacer(`\\`, `\`, `\n`, "\n").Replace(v)
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+// formatter renders scrape output in one exposition format. Formatters are
+// registered in formatters by the name used with ?format=.
+type formatter interface {
+	ContentType() string
+	Format(metrics []metric) ([]byte, error)
+}
+
+var formatters = map[string]formatter{
+	"text":        textFormatter{},
+	"openmetrics": openMetricsFormatter{},
+	"json":        jsonFormatter{},
+	"protobuf":    protobufFormatter{},
+	"csv":         csvFormatter{},
+}
+
+// mediaTypes maps Accept header media types to formatter names
+var mediaTypes = map[string]string{
+	"text/plain":                      "text",
+	"application/openmetrics-text":    "openmetrics",
+	"application/json":                "json",
+	"application/vnd.google.protobuf": "protobuf",
+	"text/csv":                        "csv",
+}
+
+// selectFormatter picks a formatter from ?format=, falling back to the
+// highest-weighted supported type in the Accept header, then classic text.
+// Prometheus offers OpenMetrics ahead of text, so OpenMetrics is only picked
+// from the Accept header when text isn't acceptable.
+func selectFormatter(req events.Request) (formatter, error) {
+	if name := req.QueryStringParameters["format"]; name != "" {
+		f, ok := formatters[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown format: %s", name)
+		}
+		return f, nil
+	}
+
+	best := "text"
+	bestQ := -1.0
+	textAccepted := false
+	for _, part := range strings.Split(requestHeader(req, "Accept"), ",") {
+		params := strings.Split(part, ";")
+		name, ok := mediaTypes[strings.TrimSpace(params[0])]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if name == "text" && q > 0 {
+			textAccepted = true
+		}
+		if q > bestQ {
+			best, bestQ = name, q
+		}
+	}
+	if best == "openmetrics" && textAccepted {
+		best = "text"
+	}
+	return formatters[best], nil
+}
+
+func formattedResponse(f formatter, body []byte) events.Response {
+	resp := events.Response{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": f.ContentType()},
+	}
+	if _, binary := f.(protobufFormatter); binary {
+		resp.Body = base64.StdEncoding.EncodeToString(body)
+		resp.IsBase64Encoded = true
+	} else {
+		resp.Body = string(body)
+	}
+	return resp
+}
+
+type renderFamily struct {
+	Name    string
+	Type    string
+	Help    string
+	Unit    string
+	Metrics []metric
+}
+
+// familiesOf groups metrics into families, keeping the order in which each
+// family first appears
+func familiesOf(metrics []metric) []*renderFamily {
+	byName := map[string]*renderFamily{}
+	families := []*renderFamily{}
+	for _, m := range metrics {
+		f, ok := byName[m.Name]
+		if !ok {
+			f = &renderFamily{Name: m.Name, Type: m.Type, Help: m.Help, Unit: m.Unit}
+			byName[m.Name] = f
+			families = append(families, f)
+		}
+		f.Metrics = append(f.Metrics, m)
+	}
+	return families
+}
+
+type textFormatter struct{}
+
+func (textFormatter) ContentType() string {
+	return "text/plain"
+}
+
+// Format writes each family's HELP, TYPE, and UNIT lines once, followed by
+// all of its series, since parsers reject a family declared twice
+func (textFormatter) Format(metrics []metric) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, f := range familiesOf(metrics) {
+		writeTextHeader(&buf, f.Name, f.Type, f.Help, f.Unit)
+		for _, m := range f.Metrics {
+			m.writeTextSamples(&buf)
+		}
+		buf.WriteString("\n")
+	}
+	return buf.Bytes(), nil
+}
+
+type openMetricsFormatter struct{}
+
+func (openMetricsFormatter) ContentType() string {
+	return "application/openmetrics-text; version=1.0.0; charset=utf-8"
+}
+
+var openMetricsTypes = map[string]string{
+	"counter":   "counter",
+	"gauge":     "gauge",
+	"histogram": "histogram",
+	"summary":   "summary",
+}
+
+func (openMetricsFormatter) Format(metrics []metric) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, f := range familiesOf(metrics) {
+		kind, ok := openMetricsTypes[f.Type]
+		if !ok {
+			kind = "unknown"
+		}
+		// OpenMetrics counter samples must end in _total, so counters named
+		// without it are exposed as unknown to keep their series names stable
+		name := f.Name
+		suffix := ""
+		if kind == "counter" && strings.HasSuffix(name, "_total") {
+			name = strings.TrimSuffix(name, "_total")
+			suffix = "_total"
+		} else if kind == "counter" {
+			kind = "unknown"
+		}
+
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", name, kind)
+		if f.Help != "" {
+			fmt.Fprintf(&buf, "# HELP %s %s\n", name, escapeHelp(f.Help))
+		}
+		if f.Unit != "" && strings.HasSuffix(name, "_"+f.Unit) {
+			fmt.Fprintf(&buf, "# UNIT %s %s\n", name, f.Unit)
+		}
+		for _, m := range f.Metrics {
+			if m.Histogram != nil || m.Summary != nil {
+				for _, s := range m.samples() {
+					fmt.Fprintf(&buf, "%s%s %s", s.Name, s.TagString(), s.Value)
+					if s.Timestamp != 0 {
+						fmt.Fprintf(&buf, " %s", millisToSeconds(s.Timestamp))
+					}
+					buf.WriteString("\n")
+				}
+				continue
+			}
+			fmt.Fprintf(&buf, "%s%s%s %s", name, suffix, m.TagString(), m.Value)
+			if m.Timestamp != 0 {
+				fmt.Fprintf(&buf, " %s", millisToSeconds(m.Timestamp))
+			}
+			if m.Exemplar != nil {
+				e := metric{Tags: m.Exemplar.Labels}
+				fmt.Fprintf(&buf, " # %s %s", exemplarLabels(e), m.Exemplar.Value)
+				if m.Exemplar.Timestamp != 0 {
+					fmt.Fprintf(&buf, " %s", millisToSeconds(m.Exemplar.Timestamp))
+				}
+			}
+			buf.WriteString("\n")
+		}
+	}
+	buf.WriteString("# EOF\n")
+	return buf.Bytes(), nil
+}
+
+func exemplarLabels(e metric) string {
+	if len(e.Tags) == 0 {
+		return "{}"
+	}
+	return e.TagString()
+}
+
+func millisToSeconds(ms int64) string {
+	return strconv.FormatFloat(float64(ms)/1000, 'f', -1, 64)
+}
+
+type jsonFormatter struct{}
+
+func (jsonFormatter) ContentType() string {
+	return "application/json"
+}
+
+// Format emits the same family shape as /api/families
+func (jsonFormatter) Format(metrics []metric) ([]byte, error) {
+	families := []metricFamily{}
+	for _, f := range familiesOf(metrics) {
+		mf := metricFamily{Name: f.Name, Type: f.Type, Help: f.Help, Unit: f.Unit}
+		for _, m := range f.Metrics {
+			mf.Series = append(mf.Series, familySeries{
+				File:      m.file,
+				Tags:      m.Tags,
+				Value:     m.Value,
+				Histogram: m.Histogram,
+				Summary:   m.Summary,
+				PushedAt:  m.pushedAt,
+			})
+		}
+		families = append(families, mf)
+	}
+	return json.Marshal(families)
+}
+
+type csvFormatter struct{}
+
+func (csvFormatter) ContentType() string {
+	return "text/csv"
+}
+
+func (csvFormatter) Format(metrics []metric) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	rows := [][]string{{"file", "name", "labels", "value", "pushed_at"}}
+	for _, m := range metrics {
+		for _, s := range m.samples() {
+			rows = append(rows, []string{
+				m.file,
+				s.Name,
+				labelString(s.Tags),
+				s.Value,
+				fmt.Sprintf("%d", m.pushedAt),
+			})
+		}
+	}
+	err := w.WriteAll(rows)
+	return buf.Bytes(), err
+}
+
+type protobufFormatter struct{}
+
+func (protobufFormatter) ContentType() string {
+	return "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited"
+}
+
+// protobufTypes maps metric types to the io.prometheus.client.MetricType enum
+var protobufTypes = map[string]uint64{
+	"counter":   0,
+	"gauge":     1,
+	"summary":   2,
+	"untyped":   3,
+	"histogram": 4,
+}
+
+// Format writes length-delimited io.prometheus.client.MetricFamily messages.
+// Histograms and summaries are encoded as such; other samples are counter,
+// gauge, or untyped values.
+func (protobufFormatter) Format(metrics []metric) ([]byte, error) {
+	var out []byte
+	for _, f := range familiesOf(metrics) {
+		kind, ok := protobufTypes[f.Type]
+		if !ok || !structuredFamily(f) {
+			kind = protobufTypes["untyped"]
+		}
+
+		var family []byte
+		family = appendProtoString(family, 1, f.Name)
+		if f.Help != "" {
+			family = appendProtoString(family, 2, f.Help)
+		}
+		family = appendProtoVarint(family, 3, kind)
+
+		for _, m := range f.Metrics {
+			var msg []byte
+			keys := make([]string, 0, len(m.Tags))
+			for k := range m.Tags {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				var label []byte
+				label = appendProtoString(label, 1, k)
+				label = appendProtoString(label, 2, m.Tags[k])
+				msg = appendProtoBytes(msg, 1, label)
+			}
+
+			if kind == protobufTypes["histogram"] {
+				var err error
+				msg, err = appendProtoHistogram(msg, 7, m.Histogram)
+				if err != nil {
+					return nil, fmt.Errorf("invalid histogram %s: %s", m.Name, err)
+				}
+			} else if kind == protobufTypes["summary"] {
+				var err error
+				msg, err = appendProtoSummary(msg, 4, m.Summary)
+				if err != nil {
+					return nil, fmt.Errorf("invalid summary %s: %s", m.Name, err)
+				}
+			} else {
+				value, err := parseValue(m.Value)
+				if err != nil {
+					return nil, fmt.Errorf("invalid value for %s: %s", m.Name, m.Value)
+				}
+				// gauge, counter, and untyped values are fields 2, 3, and 5
+				field := 5
+				switch kind {
+				case protobufTypes["gauge"]:
+					field = 2
+				case protobufTypes["counter"]:
+					field = 3
+				}
+				msg = appendProtoBytes(msg, field, appendProtoDouble(nil, 1, value))
+			}
+			if m.Timestamp != 0 {
+				msg = appendProtoVarint(msg, 6, uint64(m.Timestamp))
+			}
+			family = appendProtoBytes(family, 4, msg)
+		}
+
+		out = appendVarint(out, uint64(len(family)))
+		out = append(out, family...)
+	}
+	return out, nil
+}
+
+// structuredFamily reports whether a histogram or summary family can be
+// encoded as one, with every series carrying buckets or quantiles. Series
+// stored as their component values are encoded untyped, as before these
+// types were supported. Other families need no structure.
+func structuredFamily(f *renderFamily) bool {
+	for _, m := range f.Metrics {
+		switch {
+		case f.Type == "histogram" && m.Histogram == nil:
+			return false
+		case f.Type == "summary" && m.Summary == nil:
+			return false
+		}
+	}
+	return true
+}
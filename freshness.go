@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+type fileFreshness struct {
+	File     string `json:"file"`
+	PushedAt int64  `json:"pushed_at"`
+	SLO      int64  `json:"slo_seconds,omitempty"`
+	Overdue  bool   `json:"overdue"`
+	Window   bool   `json:"maintenance_window,omitempty"`
+}
+
+// fileSLO returns the freshness SLO in seconds for a file, using the longest
+// matching prefix from config. Zero means no SLO applies.
+func fileSLO(name string) int64 {
+	var slo int64
+	best := -1
+	for prefix, seconds := range c.SLOs {
+		if strings.HasPrefix(name, prefix) && len(prefix) > best {
+			best = len(prefix)
+			slo = seconds
+		}
+	}
+	return slo
+}
+
+func freshnessFor(mf metricFile, now time.Time) fileFreshness {
+	f := fileFreshness{
+		File:     mf.FileName,
+		PushedAt: mf.PushedAt,
+		SLO:      fileSLO(mf.FileName),
+		Window:   inMaintenanceWindow(mf.FileName, now),
+	}
+	if f.SLO > 0 && !f.Window {
+		f.Overdue = now.Unix()-f.PushedAt > f.SLO
+	}
+	return f
+}
+
+func freshnessHandler(req events.Request) (events.Response, error) {
+	client, err := getClient()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+	}
+
+	files, err := readMetricFiles(client)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to read metrics: %s", err))
+	}
+	files, ok := scopeMetricFiles(req, files)
+	if !ok {
+		return events.Reject("bad auth token")
+	}
+
+	now := time.Now()
+	result := []fileFreshness{}
+	for _, mf := range files {
+		result = append(result, freshnessFor(mf, now))
+	}
+	return respondJSON(200, result)
+}
+
+func freshnessMetrics(files []metricFile) []metric {
+	now := time.Now()
+	metrics := []metric{}
+	for _, mf := range files {
+		f := freshnessFor(mf, now)
+		tags := map[string]string{"file": f.File}
+		metrics = append(metrics, metric{
+			Name:  "hook_exporter_file_last_push_timestamp_seconds",
+			Type:  "gauge",
+			Tags:  tags,
+			Value: fmt.Sprintf("%d", f.PushedAt),
+		})
+		if f.Window {
+			metrics = append(metrics, metric{
+				Name:  "hook_exporter_maintenance_window",
+				Type:  "gauge",
+				Tags:  tags,
+				Value: "1",
+			})
+		}
+		if f.SLO == 0 {
+			continue
+		}
+		overdue := "0"
+		if f.Overdue {
+			overdue = "1"
+		}
+		metrics = append(metrics, metric{
+			Name:  "hook_exporter_file_freshness_slo_seconds",
+			Type:  "gauge",
+			Tags:  tags,
+			Value: fmt.Sprintf("%d", f.SLO),
+		}, metric{
+			Name:  "hook_exporter_file_overdue",
+			Type:  "gauge",
+			Tags:  tags,
+			Value: overdue,
+		})
+	}
+	return metrics
+}
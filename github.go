@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+const githubPrefix = "github/"
+
+type githubRepository struct {
+	FullName string `json:"full_name"`
+}
+
+type githubEvent struct {
+	Action     string           `json:"action"`
+	Ref        string           `json:"ref"`
+	Repository githubRepository `json:"repository"`
+	Commits    []struct {
+		ID string `json:"id"`
+	} `json:"commits"`
+	Deployment struct {
+		Environment string `json:"environment"`
+	} `json:"deployment"`
+	WorkflowRun struct {
+		Name         string `json:"name"`
+		Conclusion   string `json:"conclusion"`
+		RunStartedAt string `json:"run_started_at"`
+		UpdatedAt    string `json:"updated_at"`
+	} `json:"workflow_run"`
+}
+
+// hmacToken returns the token whose hmac_secret (or pending_hmac_secret,
+// during rotation) produced the HMAC-SHA256 signature of body
+func hmacToken(signature, body []byte) (tokenConfig, bool) {
+	for _, t := range c.Tokens {
+		for _, secret := range []string{t.HMACSecret, t.PendingHMACSecret} {
+			if secret == "" {
+				continue
+			}
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write(body)
+			if hmac.Equal(signature, mac.Sum(nil)) {
+				return t, true
+			}
+		}
+	}
+	return tokenConfig{}, false
+}
+
+// signedTokenKey is the authorizer context key that names the token whose
+// signature a request carried. Clients can't set authorizer context, only
+// API Gateway and the exporter itself.
+const signedTokenKey = "hook_exporter_token"
+
+// hmacRequest records the signing token's name in the request's authorizer
+// context, so downstream quota and source tracking identify it as they
+// would a bearer push. Tokens with only an hmac_secret have no bearer token
+// to stand in for them.
+func hmacRequest(req events.Request, t tokenConfig) events.Request {
+	authorizer := map[string]interface{}{signedTokenKey: t.Name}
+	for k, v := range req.RequestContext.Authorizer {
+		if k != signedTokenKey {
+			authorizer[k] = v
+		}
+	}
+	req.RequestContext.Authorizer = authorizer
+	return bearerRequest(req, "")
+}
+
+// bearerRequest replaces the Authorization header with a bearer token, or
+// removes it when token is empty
+func bearerRequest(req events.Request, token string) events.Request {
+	headers := map[string]string{}
+	if token != "" {
+		headers["Authorization"] = "Bearer " + token
+	}
+	for k, v := range req.Headers {
+		if !strings.EqualFold(k, "Authorization") {
+			headers[k] = v
+		}
+	}
+	req.Headers = headers
+	return req
+}
+
+// githubHandler accepts GitHub webhooks signed with a token's hmac_secret,
+// converting push, deployment, and completed workflow_run events into
+// metrics in github/<owner>/<repo>. Counters accumulate across deliveries.
+func githubHandler(req events.Request) (events.Response, error) {
+	body, err := req.DecodedBody()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+	}
+	signature := requestHeader(req, "X-Hub-Signature-256")
+	if !strings.HasPrefix(signature, "sha256=") {
+		return events.Reject("bad signature")
+	}
+	given, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return events.Reject("bad signature")
+	}
+	t, ok := hmacToken(given, []byte(body))
+	if !ok {
+		return events.Reject("bad signature")
+	}
+	req = hmacRequest(req, t)
+
+	if err := checkWebhookLimits([]byte(body)); err != nil {
+		return events.Respond(400, fmt.Sprintf("rejected body: %s", err))
+	}
+	var event githubEvent
+	if err := json.Unmarshal([]byte(body), &event); err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to unmarshal: %s", err))
+	}
+
+	kind := requestHeader(req, "X-GitHub-Event")
+	if kind == "ping" {
+		return events.Succeed("")
+	}
+	if event.Repository.FullName == "" {
+		return events.Respond(400, "event has no repository")
+	}
+	metrics := githubMetrics(kind, event, time.Now())
+	if len(metrics) == 0 {
+		return events.Succeed("")
+	}
+
+	mf := metricFile{
+		FileName: githubPrefix + sanitizeLabel(event.Repository.FullName),
+		Metrics:  metrics,
+	}
+	mf.accumulate = true
+	return pushMetricFile(req, mf)
+}
+
+func githubMetrics(kind string, event githubEvent, now time.Time) []metric {
+	repo := sanitizeLabel(event.Repository.FullName)
+	gauge := func(name string, tags map[string]string, value float64) metric {
+		tags["repo"] = repo
+		return metric{
+			Name:  name,
+			Type:  "gauge",
+			Tags:  tags,
+			Value: formatValue(value),
+		}
+	}
+	counter := func(name string, tags map[string]string, value float64) metric {
+		m := gauge(name, tags, value)
+		m.Type = "counter"
+		return m
+	}
+
+	switch kind {
+	case "push":
+		ref := sanitizeLabel(event.Ref)
+		return []metric{
+			counter("github_pushes_total", map[string]string{"ref": ref}, 1),
+			counter("github_push_commits_total", map[string]string{"ref": ref}, float64(len(event.Commits))),
+			gauge("github_last_push_timestamp_seconds", map[string]string{"ref": ref}, float64(now.Unix())),
+		}
+	case "deployment":
+		if event.Action != "" && event.Action != "created" {
+			return nil
+		}
+		env := sanitizeLabel(event.Deployment.Environment)
+		return []metric{
+			counter("github_deploys_total", map[string]string{"environment": env}, 1),
+			gauge("github_last_deploy_timestamp_seconds", map[string]string{"environment": env}, float64(now.Unix())),
+		}
+	case "workflow_run":
+		if event.Action != "completed" {
+			return nil
+		}
+		run := event.WorkflowRun
+		workflow := sanitizeLabel(run.Name)
+		metrics := []metric{counter("github_workflow_runs_total", map[string]string{
+			"workflow":   workflow,
+			"conclusion": sanitizeLabel(run.Conclusion),
+		}, 1)}
+		started, err := time.Parse(time.RFC3339, run.RunStartedAt)
+		if err != nil {
+			return metrics
+		}
+		updated, err := time.Parse(time.RFC3339, run.UpdatedAt)
+		if err != nil {
+			return metrics
+		}
+		return append(metrics, gauge(
+			"github_workflow_duration_seconds",
+			map[string]string{"workflow": workflow},
+			updated.Sub(started).Seconds(),
+		))
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+const defaultGraphiteSeparator = "_"
+
+type graphiteConfig struct {
+	Separator string `json:"separator"`
+}
+
+// graphiteName converts a dotted Graphite path into a metric name, joining
+// the path components with the configured separator
+func graphiteName(path string) string {
+	sep := c.Graphite.Separator
+	if sep == "" {
+		sep = defaultGraphiteSeparator
+	}
+	return strings.ReplaceAll(path, ".", sep)
+}
+
+// graphiteHandler accepts Graphite plaintext lines for the file given by
+// ?name=. Each series keeps its newest value, and series not in the push
+// are kept.
+func graphiteHandler(req events.Request) (events.Response, error) {
+	name := req.QueryStringParameters["name"]
+	if name == "" {
+		return events.Respond(400, "graphite pushes require a ?name= file name")
+	}
+
+	body, err := req.DecodedBody()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+	}
+	if max := effectiveJSONLimits().MaxBodyBytes; len(body) > max {
+		return events.Respond(400, fmt.Sprintf("rejected body: body exceeds %d bytes", max))
+	}
+
+	mf, err := parseGraphite(name, body)
+	if err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to parse: %s", err))
+	}
+	mf.mergeSeries = true
+	return pushMetricFile(req, mf)
+}
+
+// parseGraphite parses `path[;tag=value...] value [timestamp]` lines into
+// gauges. Timestamps are in seconds; a timestamp of -1 means now.
+func parseGraphite(name, body string) (metricFile, error) {
+	series := map[string]metric{}
+	for i, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return metricFile{}, fmt.Errorf("line %d: expected path, value, and optional timestamp", i+1)
+		}
+
+		parts := strings.Split(fields[0], ";")
+		m := metric{
+			Name: graphiteName(parts[0]),
+			Type: "gauge",
+			Tags: map[string]string{},
+		}
+		for _, tag := range parts[1:] {
+			kv := strings.SplitN(tag, "=", 2)
+			if len(kv) != 2 {
+				return metricFile{}, fmt.Errorf("line %d: invalid tag %s", i+1, tag)
+			}
+			m.Tags[kv[0]] = kv[1]
+		}
+
+		v, err := parseValue(fields[1])
+		if err != nil {
+			return metricFile{}, fmt.Errorf("line %d: invalid value %s", i+1, fields[1])
+		}
+		m.Value = formatValue(v)
+
+		if len(fields) == 3 && fields[2] != "-1" {
+			ts, err := strconv.ParseFloat(fields[2], 64)
+			if err != nil {
+				return metricFile{}, fmt.Errorf("line %d: invalid timestamp %s", i+1, fields[2])
+			}
+			m.Timestamp = int64(ts * 1000)
+		}
+
+		key := seriesKey(m)
+		if existing, ok := series[key]; ok && existing.Timestamp > m.Timestamp {
+			continue
+		}
+		series[key] = m
+	}
+
+	keys := make([]string, 0, len(series))
+	for k := range series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	mf := metricFile{FileName: name}
+	for _, k := range keys {
+		mf.Metrics = append(mf.Metrics, series[k])
+	}
+	return mf, nil
+}
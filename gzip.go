@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/akerl/go-lambda/mux"
+)
+
+// gzipRoute wraps a push handler so that bodies sent with
+// Content-Encoding: gzip are decompressed before the handler sees them
+func gzipRoute(handler mux.HandleFunc) mux.HandleFunc {
+	return func(req events.Request) (events.Response, error) {
+		if !strings.EqualFold(strings.TrimSpace(requestHeader(req, "Content-Encoding")), "gzip") {
+			return handler(req)
+		}
+		body, err := req.DecodedBody()
+		if err != nil {
+			return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+		}
+		decoded, err := gunzipBody([]byte(body))
+		if err != nil {
+			return events.Respond(400, fmt.Sprintf("failed to decompress: %s", err))
+		}
+
+		headers := map[string]string{}
+		for k, v := range req.Headers {
+			if !strings.EqualFold(k, "Content-Encoding") {
+				headers[k] = v
+			}
+		}
+		req.Headers = headers
+		req.Body = string(decoded)
+		req.IsBase64Encoded = false
+		return handler(req)
+	}
+}
+
+// gunzipBody decompresses body, stopping once the output passes the body
+// size limit so a small payload can't expand without bound
+func gunzipBody(body []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return readDecompressed(zr)
+}
+
+// readDecompressed reads a decompressing reader up to the body size limit
+func readDecompressed(r io.Reader) ([]byte, error) {
+	max := effectiveJSONLimits().MaxBodyBytes
+	decoded, err := io.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) > max {
+		return nil, fmt.Errorf("decompressed body exceeds %d bytes", max)
+	}
+	return decoded, nil
+}
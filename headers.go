@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/akerl/go-lambda/mux"
+)
+
+const allRoutes = "*"
+
+// headerReceiver adds the static response headers configured for the
+// request's route family. Headers set by the handler itself take precedence.
+type headerReceiver struct {
+	mux.Receiver
+}
+
+func (hr *headerReceiver) Handle(req events.Request) (events.Response, error) {
+	resp, err := hr.Receiver.Handle(req)
+	if err != nil || len(c.ResponseHeaders) == 0 {
+		return resp, err
+	}
+
+	if resp.Headers == nil {
+		resp.Headers = map[string]string{}
+	}
+	for _, family := range []string{routeFamily(req.Path), allRoutes} {
+		for k, v := range c.ResponseHeaders[family] {
+			if _, ok := resp.Headers[k]; !ok {
+				resp.Headers[k] = v
+			}
+		}
+	}
+	return resp, nil
+}
+
+// requestHeader looks up a header case-insensitively, since API Gateway
+// passes header names as the client sent them
+func requestHeader(req events.Request, name string) string {
+	if v, ok := req.Headers[name]; ok {
+		return v
+	}
+	for k, v := range req.Headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+const heartbeatPrefix = "heartbeat/"
+
+// heartbeatHandler records heartbeat_last_seen_timestamp_seconds for the
+// name in the path, as a dead man's switch for cron jobs. GET is accepted so
+// a bare curl works. Each heartbeat is its own file, so freshness SLOs can
+// be set per heartbeat with a heartbeat/ prefix.
+func heartbeatHandler(req events.Request) (events.Response, error) {
+	if c.ReadOnly {
+		return events.Respond(503, "this deployment is read-only")
+	}
+	name := req.PathParameters["name"]
+	mf := metricFile{
+		FileName: heartbeatPrefix + name,
+		Metrics: []metric{{
+			Name:  "heartbeat_last_seen_timestamp_seconds",
+			Type:  "gauge",
+			Tags:  map[string]string{"name": name},
+			Value: fmt.Sprintf("%d", time.Now().Unix()),
+		}},
+	}
+	return pushMetricFile(req, mf)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// histogram is a histogram sample: the cumulative count of observations at
+// or below each upper bound, ending with +Inf, and their sum and count.
+// Bounds and the sum are strings like metric values, so +Inf and NaN can be
+// written in JSON.
+type histogram struct {
+	Buckets []histogramBucket `json:"buckets"`
+	Sum     string            `json:"sum"`
+	Count   uint64            `json:"count"`
+}
+
+type histogramBucket struct {
+	LE    string `json:"le"`
+	Count uint64 `json:"count"`
+}
+
+// samples expands a histogram or summary metric into the series it is
+// rendered as. Other metrics are their own only sample.
+func (m metric) samples() []metric {
+	if m.Summary != nil {
+		return m.summarySamples()
+	}
+	if m.Histogram == nil {
+		return []metric{m}
+	}
+	sample := func(suffix string, tags map[string]string, value string) metric {
+		return metric{Name: m.Name + suffix, Type: m.Type, Tags: tags, Value: value, Timestamp: m.Timestamp}
+	}
+	samples := []metric{}
+	for _, b := range m.Histogram.Buckets {
+		tags := make(map[string]string, len(m.Tags)+1)
+		for k, v := range m.Tags {
+			tags[k] = v
+		}
+		tags["le"] = b.LE
+		samples = append(samples, sample("_bucket", tags, strconv.FormatUint(b.Count, 10)))
+	}
+	return append(samples,
+		sample("_sum", m.Tags, m.Histogram.Sum),
+		sample("_count", m.Tags, strconv.FormatUint(m.Histogram.Count, 10)),
+	)
+}
+
+// checkHistogram requires buckets to have increasing bounds ending in +Inf
+// and counts that never decrease and match the total, and only allows
+// histograms to carry them
+func checkHistogram(m metric) []validationFinding {
+	finding := func(format string, args ...interface{}) []validationFinding {
+		return []validationFinding{{Metric: m.Name, Message: fmt.Sprintf(format, args...)}}
+	}
+	h := m.Histogram
+	switch {
+	case m.Type != "histogram":
+		return finding("buckets are only allowed on histograms, not %s", m.Type)
+	case m.Summary != nil:
+		return finding("histograms cannot have quantiles")
+	case len(h.Buckets) == 0:
+		return finding("histogram has no buckets")
+	}
+	if _, ok := m.Tags["le"]; ok {
+		return finding("histogram tags cannot include le")
+	}
+	if !validValue(h.Sum) {
+		return finding("invalid histogram sum %q", h.Sum)
+	}
+
+	previous := math.Inf(-1)
+	var count uint64
+	for i, b := range h.Buckets {
+		le, err := parseValue(b.LE)
+		if err != nil || math.IsNaN(le) {
+			return finding("invalid bucket bound %q", b.LE)
+		}
+		if i > 0 && le <= previous {
+			return finding("bucket bound %s does not follow %s", b.LE, h.Buckets[i-1].LE)
+		}
+		if b.Count < count {
+			return finding("bucket %s count %d is below the previous bucket's %d", b.LE, b.Count, count)
+		}
+		previous, count = le, b.Count
+	}
+	if !math.IsInf(previous, 1) {
+		return finding("histogram has no +Inf bucket")
+	}
+	if count != h.Count {
+		return finding("+Inf bucket count %d does not match count %d", count, h.Count)
+	}
+	return nil
+}
+
+// appendProtoHistogram encodes an io.prometheus.client.Histogram. The +Inf
+// bucket is left out, as the client libraries do, since it is the count.
+func appendProtoHistogram(buf []byte, field int, h *histogram) ([]byte, error) {
+	sum, err := parseValue(h.Sum)
+	if err != nil {
+		return nil, fmt.Errorf("invalid histogram sum: %s", h.Sum)
+	}
+	var msg []byte
+	msg = appendProtoVarint(msg, 1, h.Count)
+	msg = appendProtoDouble(msg, 2, sum)
+	for _, b := range h.Buckets {
+		le, err := parseValue(b.LE)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket bound: %s", b.LE)
+		}
+		if math.IsInf(le, 1) {
+			continue
+		}
+		var bucket []byte
+		bucket = appendProtoVarint(bucket, 1, b.Count)
+		bucket = appendProtoDouble(bucket, 2, le)
+		msg = appendProtoBytes(msg, 3, bucket)
+	}
+	return appendProtoBytes(buf, field, msg), nil
+}
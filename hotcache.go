@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// defaultHotMaxItemBytes keeps items under DynamoDB's 400KB item limit
+const defaultHotMaxItemBytes = 350 * 1024
+
+// The hot cache mirrors each stored file into hot_table so scrapes can read
+// one table scan instead of an object per file. S3 stays the source of
+// truth: files too large for an item are marked large and read from S3.
+
+func hotMaxItemBytes() int {
+	if c.HotMaxItemBytes > 0 {
+		return c.HotMaxItemBytes
+	}
+	return defaultHotMaxItemBytes
+}
+
+func hotKey(file string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"file": &types.AttributeValueMemberS{Value: file},
+	}
+}
+
+// mirrorMetricFile copies a stored file into the hot cache
+func mirrorMetricFile(mf metricFile) error {
+	if c.HotTable == "" {
+		return nil
+	}
+	client, err := getDynamoClient()
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(mf)
+	if err != nil {
+		return err
+	}
+
+	item := hotKey(mf.FileName)
+	item["pushed_at"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(mf.PushedAt, 10)}
+	if len(content) > hotMaxItemBytes() {
+		item["large"] = &types.AttributeValueMemberBOOL{Value: true}
+	} else {
+		item["body"] = &types.AttributeValueMemberS{Value: string(content)}
+	}
+	_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: &c.HotTable,
+		Item:      item,
+	})
+	return err
+}
+
+func removeHotFile(file string) error {
+	if c.HotTable == "" {
+		return nil
+	}
+	client, err := getDynamoClient()
+	if err != nil {
+		return err
+	}
+	_, err = client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: &c.HotTable,
+		Key:       hotKey(file),
+	})
+	return err
+}
+
+// readHotFiles loads every file from the hot cache, falling back to S3 for
+// files marked large
+func readHotFiles(client *s3.Client, mg *memoryGuard) ([]metricFile, error) {
+	db, err := getDynamoClient()
+	if err != nil {
+		return []metricFile{}, err
+	}
+
+	paginator := dynamodb.NewScanPaginator(db, &dynamodb.ScanInput{TableName: &c.HotTable})
+	metricFiles := []metricFile{}
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return []metricFile{}, err
+		}
+		for _, item := range page.Items {
+			if mg.Exceeded() {
+				return metricFiles, nil
+			}
+			file, ok := item["file"].(*types.AttributeValueMemberS)
+			if !ok {
+				continue
+			}
+
+			if body, ok := item["body"].(*types.AttributeValueMemberS); ok {
+				traceCache("hot_hit")
+				mf, err := parseMetricFile([]byte(body.Value))
+				if err != nil {
+					return []metricFile{}, err
+				}
+				metricFiles = append(metricFiles, mf)
+				continue
+			}
+
+			traceCache("hot_large")
+			mf, err := readMetricFile(client, file.Value)
+			if errors.Is(err, errMetricFileMissing) {
+				continue
+			} else if err != nil {
+				return []metricFile{}, err
+			}
+			metricFiles = append(metricFiles, mf)
+		}
+	}
+	return metricFiles, nil
+}
+
+// runHotCacheJob re-mirrors every stored file, to backfill a new table or
+// repair items missed by failed writes
+func runHotCacheJob() error {
+	if c.HotTable == "" {
+		return nil
+	}
+	client, err := getClient()
+	if err != nil {
+		return err
+	}
+	files, err := readMetricFiles(client)
+	if err != nil {
+		return err
+	}
+	for _, mf := range files {
+		if err := mirrorMetricFile(mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+// lookupCertIdentity maps a client certificate subject to a token identity.
+// The subject is read from the configured header, which must only be set by
+// a trusted mTLS-terminating proxy or by the standalone server itself.
+func lookupCertIdentity(req events.Request) (tokenConfig, bool) {
+	if c.ClientCertHeader == "" {
+		return tokenConfig{}, false
+	}
+	subject := req.Headers[c.ClientCertHeader]
+	if subject == "" {
+		return tokenConfig{}, false
+	}
+	for _, t := range c.Tokens {
+		for _, s := range t.CertSubjects {
+			if s == subject {
+				return t, true
+			}
+		}
+	}
+	return tokenConfig{}, false
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// internalPrefix holds the exporter's own state objects in the metric bucket.
+// Keys under it are never listed as metric files and cannot be pushed to.
+const internalPrefix = "_hook_exporter/"
+
+// readInternalObject loads a JSON state object into v. It returns false if
+// the object does not exist yet.
+func readInternalObject(client *s3.Client, name string, v interface{}) (bool, error) {
+	body, err := readObject(client, internalPrefix+name)
+	if err != nil {
+		var nsk *types.NoSuchKey
+		if errors.As(err, &nsk) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, json.Unmarshal(body, v)
+}
+
+func writeInternalObject(client *s3.Client, name string, v interface{}) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	key := internalPrefix + name
+	out, err := client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket: &c.MetricBucket,
+		Key:    &key,
+		Body:   bytes.NewReader(content),
+	})
+	if err != nil {
+		return err
+	}
+	storeDiskEntry(key, out.ETag, content, nil)
+	return nil
+}
+
+// listInternalObjects returns the names of the state objects under prefix,
+// in key order
+func listInternalObjects(client *s3.Client, prefix string) ([]string, error) {
+	full := internalPrefix + prefix
+	paginator := s3.NewListObjectsV2Paginator(
+		client,
+		&s3.ListObjectsV2Input{Bucket: &c.MetricBucket, Prefix: &full},
+	)
+	names := []string{}
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return []string{}, err
+		}
+		for _, obj := range page.Contents {
+			names = append(names, (*obj.Key)[len(internalPrefix):])
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	jobStatusSuccess = "success"
+	jobStatusFailure = "failure"
+)
+
+// expandJobStatus converts the {"name":...,"status":...} shorthand into the
+// conventional job_last_* metrics, carrying forward the last success time
+// from the stored file when the current run failed.
+func expandJobStatus(client *s3.Client, mf *metricFile) error {
+	if mf.Status != jobStatusSuccess && mf.Status != jobStatusFailure {
+		return fmt.Errorf("status must be %s or %s", jobStatusSuccess, jobStatusFailure)
+	}
+
+	tags := mf.jobTags
+	if tags == nil {
+		tags = map[string]string{"job": mf.FileName}
+	}
+
+	now := fmt.Sprintf("%d", time.Now().Unix())
+
+	lastSuccess := ""
+	if mf.Status == jobStatusSuccess {
+		lastSuccess = now
+	} else if old, err := readMetricFile(client, mf.FileName); err == nil {
+		for _, m := range old.Metrics {
+			if m.Name == "job_last_success_timestamp_seconds" {
+				lastSuccess = m.Value
+			}
+		}
+	}
+
+	status := "0"
+	if mf.Status == jobStatusSuccess {
+		status = "1"
+	}
+
+	mf.Metrics = append(mf.Metrics,
+		metric{Name: "job_last_run_timestamp_seconds", Type: "gauge", Tags: tags, Value: now},
+		metric{Name: "job_last_run_status", Type: "gauge", Tags: tags, Value: status},
+	)
+	if lastSuccess != "" {
+		mf.Metrics = append(mf.Metrics, metric{
+			Name:  "job_last_success_timestamp_seconds",
+			Type:  "gauge",
+			Tags:  tags,
+			Value: lastSuccess,
+		})
+	}
+	mf.Status = ""
+	return nil
+}
+
+type jobResult struct {
+	ExitCode        *int    `json:"exit_code"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Hostname        string  `json:"hostname"`
+}
+
+func jobResultHandler(req events.Request) (events.Response, error) {
+	name := req.PathParameters["name"]
+
+	body, err := req.DecodedBody()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+	}
+
+	var jr jobResult
+	err = json.Unmarshal([]byte(body), &jr)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to unmarshal: %s", err))
+	}
+	if jr.ExitCode == nil {
+		return events.Respond(400, "exit_code is required")
+	}
+	if *jr.ExitCode < 0 || jr.DurationSeconds < 0 {
+		return events.Respond(400, "exit_code and duration_seconds must not be negative")
+	}
+
+	tags := map[string]string{"job": name}
+	if jr.Hostname != "" {
+		tags["hostname"] = jr.Hostname
+	}
+
+	mf := metricFile{
+		FileName: name,
+		Status:   jobStatusSuccess,
+		jobTags:  tags,
+		Metrics: []metric{{
+			Name:  "job_exit_code",
+			Type:  "gauge",
+			Tags:  tags,
+			Value: strconv.Itoa(*jr.ExitCode),
+		}, {
+			Name:  "job_duration_seconds",
+			Type:  "gauge",
+			Tags:  tags,
+			Value: formatValue(jr.DurationSeconds),
+			Unit:  "seconds",
+		}},
+	}
+	if *jr.ExitCode != 0 {
+		mf.Status = jobStatusFailure
+	}
+	return pushMetricFile(req, mf)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	latencyPrefix = "latency_"
+	requestPrefix = "requests_"
+)
+
+// defaultLatencyBuckets match the Prometheus client default buckets
+var defaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var latencyClasses = []string{"push", "scrape", "admin", "hooks"}
+
+// hookPaths are the routes authenticated by their sender rather than a
+// bearer token, plus the integrations built for them
+var hookPaths = []string{"/hook/", "/hooks/", "/sns", "/checks", "/heartbeat/"}
+
+// routeClass groups a request into one of latencyClasses, keeping the
+// histogram's route label bounded
+func routeClass(method, path string) string {
+	if strings.HasPrefix(path, "/admin/") {
+		return "admin"
+	}
+	for _, p := range hookPaths {
+		if strings.HasPrefix(path, p) {
+			return "hooks"
+		}
+	}
+	if method == "GET" && path != "/push" {
+		return "scrape"
+	}
+	return "push"
+}
+
+// normalizeLatencyBuckets sorts and dedupes configured buckets when the
+// config loads. +Inf and NaN are rejected, since the histogram always ends
+// with +Inf and NaN can't bound anything.
+func normalizeLatencyBuckets(buckets []float64) ([]float64, error) {
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	normalized := []float64{}
+	for _, le := range sorted {
+		if math.IsNaN(le) || math.IsInf(le, 0) {
+			return nil, fmt.Errorf("invalid latency bucket: %s", formatValue(le))
+		}
+		if n := len(normalized); n > 0 && normalized[n-1] == le {
+			continue
+		}
+		normalized = append(normalized, le)
+	}
+	return normalized, nil
+}
+
+func latencyBuckets() []float64 {
+	if len(c.LatencyBuckets) > 0 {
+		return c.LatencyBuckets
+	}
+	return defaultLatencyBuckets
+}
+
+func formatBucket(le float64) string {
+	return formatValue(le)
+}
+
+// observeLatency records a request duration as counter deltas, so the
+// histogram is summed across execution environments like the push counters
+func observeLatency(class string, d time.Duration) {
+	seconds := d.Seconds()
+	counterLock.Lock()
+	for _, le := range latencyBuckets() {
+		if seconds <= le {
+			counterDeltas[latencyPrefix+class+"_bucket_"+formatBucket(le)]++
+		}
+	}
+	counterDeltas[latencyPrefix+class+"_count"]++
+	counterDeltas[latencyPrefix+class+"_sum_us"] += d.Microseconds()
+	counterLock.Unlock()
+	maybeFlushCounters()
+}
+
+// requestOutcome buckets a response for the error budget counters.
+// Handler errors and 5xx responses spend the budget; 4xx responses are the
+// caller's problem and are counted separately.
+func requestOutcome(status int, err error) string {
+	switch {
+	case err != nil || status >= 500:
+		return "server_error"
+	case status >= 400:
+		return "client_error"
+	default:
+		return "success"
+	}
+}
+
+func countRequest(class string, status int, err error) {
+	incCounter(requestPrefix + class + "_" + requestOutcome(status, err))
+}
+
+// requestMetrics renders hook_exporter_requests_total by route and outcome,
+// for availability SLOs on each path
+func requestMetrics(totals map[string]int64) []metric {
+	metrics := []metric{}
+	for _, class := range latencyClasses {
+		for _, outcome := range []string{"success", "client_error", "server_error"} {
+			v, ok := totals[requestPrefix+class+"_"+outcome]
+			if !ok {
+				continue
+			}
+			metrics = append(metrics, metric{
+				Name:  selfMetricPrefix + "requests_total",
+				Type:  "counter",
+				Tags:  map[string]string{"route": class, "result": outcome},
+				Value: strconv.FormatInt(v, 10),
+			})
+		}
+	}
+	return metrics
+}
+
+// latencyMetrics renders hook_exporter_request_duration_seconds from counter
+// totals
+func latencyMetrics(totals map[string]int64) []metric {
+	metrics := []metric{}
+	for _, class := range latencyClasses {
+		key := latencyPrefix + class
+		count, ok := totals[key+"_count"]
+		if !ok {
+			continue
+		}
+		h := &histogram{
+			Sum:   formatValue(float64(totals[key+"_sum_us"]) / 1e6),
+			Count: uint64(count),
+		}
+		for _, le := range latencyBuckets() {
+			h.Buckets = append(h.Buckets, histogramBucket{
+				LE:    formatBucket(le),
+				Count: uint64(totals[key+"_bucket_"+formatBucket(le)]),
+			})
+		}
+		h.Buckets = append(h.Buckets, histogramBucket{LE: "+Inf", Count: uint64(count)})
+		metrics = append(metrics, metric{
+			Name:      selfMetricPrefix + "request_duration_seconds",
+			Type:      "histogram",
+			Tags:      map[string]string{"route": class},
+			Histogram: h,
+		})
+	}
+	return metrics
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+type jsonLimits struct {
+	MaxBodyBytes    int  `json:"max_body_bytes"`
+	MaxDepth        int  `json:"max_depth"`
+	MaxStringLength int  `json:"max_string_length"`
+	MaxArrayLength  int  `json:"max_array_length"`
+	Strict          bool `json:"strict"`
+}
+
+var defaultJSONLimits = jsonLimits{
+	MaxBodyBytes:    1024 * 1024,
+	MaxDepth:        8,
+	MaxStringLength: 4096,
+	MaxArrayLength:  10000,
+}
+
+func effectiveJSONLimits() jsonLimits {
+	l := c.JSONLimits
+	if l.MaxBodyBytes == 0 {
+		l.MaxBodyBytes = defaultJSONLimits.MaxBodyBytes
+	}
+	if l.MaxDepth == 0 {
+		l.MaxDepth = defaultJSONLimits.MaxDepth
+	}
+	if l.MaxStringLength == 0 {
+		l.MaxStringLength = defaultJSONLimits.MaxStringLength
+	}
+	if l.MaxArrayLength == 0 {
+		l.MaxArrayLength = defaultJSONLimits.MaxArrayLength
+	}
+	return l
+}
+
+// checkJSONLimits walks the body token by token, without building the
+// decoded value, and fails as soon as any configured limit is exceeded.
+func checkJSONLimits(body []byte) error {
+	l := effectiveJSONLimits()
+	if len(body) > l.MaxBodyBytes {
+		return fmt.Errorf("body exceeds %d bytes", l.MaxBodyBytes)
+	}
+
+	type frame struct {
+		array bool
+		count int
+	}
+	stack := []frame{}
+	countValue := func() error {
+		if len(stack) == 0 || !stack[len(stack)-1].array {
+			return nil
+		}
+		stack[len(stack)-1].count++
+		if stack[len(stack)-1].count > l.MaxArrayLength {
+			return fmt.Errorf("array exceeds %d elements", l.MaxArrayLength)
+		}
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch t := tok.(type) {
+		case json.Delim:
+			if t == ']' || t == '}' {
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			if err := countValue(); err != nil {
+				return err
+			}
+			stack = append(stack, frame{array: t == '['})
+			if len(stack) > l.MaxDepth {
+				return fmt.Errorf("nesting exceeds depth %d", l.MaxDepth)
+			}
+		case string:
+			if len(t) > l.MaxStringLength {
+				return fmt.Errorf("string exceeds %d bytes", l.MaxStringLength)
+			}
+			if err := countValue(); err != nil {
+				return err
+			}
+		default:
+			if err := countValue(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// checkWebhookLimits only enforces the body size on third-party webhook
+// deliveries. Their shape isn't ours to choose, and ordinary Stripe and
+// GitHub payloads exceed the depth and string limits tuned for pushes.
+func checkWebhookLimits(body []byte) error {
+	if max := effectiveJSONLimits().MaxBodyBytes; len(body) > max {
+		return fmt.Errorf("body exceeds %d bytes", max)
+	}
+	return nil
+}
+
+// decodeJSON unmarshals body into v, rejecting unknown fields in strict mode
+func decodeJSON(body []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if c.JSONLimits.Strict {
+		dec.DisallowUnknownFields()
+	}
+	return dec.Decode(v)
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	lockIDPrefix = "lock:"
+
+	defaultLockTTL  = 30
+	defaultLockWait = 10
+	lockRetryDelay  = 100 * time.Millisecond
+)
+
+var errLockTimeout = errors.New("timed out waiting for file lock")
+
+type fileLock struct {
+	File     string `json:"file"`
+	Holder   string `json:"holder"`
+	Acquired int64  `json:"acquired"`
+	Expires  int64  `json:"expires"`
+}
+
+type lockStats struct {
+	inflight     int
+	acquisitions int64
+	waitTime     time.Duration
+	timeouts     int64
+}
+
+// localLock is a file's lock within this environment, with the number of
+// callers holding or waiting for it
+type localLock struct {
+	sync.Mutex
+	refs int
+}
+
+// fileLocks serializes pushes to the same file within this environment, and
+// fileStats tracks contention on metric files for the self-metrics. Locks
+// are dropped once nobody holds or waits for them, and internal objects,
+// such as shared scrapes and the manifest, have no stats. Across
+// environments the lock is held in lock_table, when configured.
+var (
+	statsLock  sync.Mutex
+	fileLocks  = map[string]*localLock{}
+	fileStats  = map[string]*lockStats{}
+	lockHolder = fmt.Sprintf("%d", time.Now().UnixNano())
+)
+
+func statsFor(file string) *lockStats {
+	if strings.HasPrefix(file, internalPrefix) {
+		return &lockStats{}
+	}
+	s, ok := fileStats[file]
+	if !ok {
+		s = &lockStats{}
+		fileStats[file] = s
+	}
+	return s
+}
+
+// lockInFlight reports whether this environment holds or is waiting for the
+// lock on file
+func lockInFlight(file string) bool {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	s, ok := fileStats[file]
+	return ok && s.inflight > 0
+}
+
+// lockFile blocks until the caller holds the lock for file, or the lock wait
+// expires. The returned function releases the lock.
+func lockFile(file string) (func(), error) {
+	statsLock.Lock()
+	local, ok := fileLocks[file]
+	if !ok {
+		local = &localLock{}
+		fileLocks[file] = local
+	}
+	local.refs++
+	statsFor(file).inflight++
+	statsLock.Unlock()
+
+	start := time.Now()
+	local.Lock()
+	err := acquireRemoteLock(file, start)
+
+	waited := time.Since(start)
+
+	statsLock.Lock()
+	s := statsFor(file)
+	s.waitTime += waited
+	if err == nil {
+		s.acquisitions++
+	} else {
+		s.inflight--
+		if errors.Is(err, errLockTimeout) {
+			s.timeouts++
+		}
+		unlockLocal(file, local)
+	}
+	statsLock.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	tracef("lock: %s acquired after %s", file, waited)
+	return func() {
+		if err := releaseRemoteLock(file); err != nil {
+			fmt.Printf("failed to release lock for %s: %s\n", file, err)
+		}
+		statsLock.Lock()
+		statsFor(file).inflight--
+		unlockLocal(file, local)
+		statsLock.Unlock()
+	}, nil
+}
+
+// unlockLocal releases a local lock, dropping it once nobody else holds or
+// waits for it. statsLock must be held.
+func unlockLocal(file string, local *localLock) {
+	local.refs--
+	if local.refs == 0 {
+		delete(fileLocks, file)
+	}
+	local.Unlock()
+}
+
+// dropLockStats forgets the contention stats of a deleted file, unless a
+// push to it is in flight
+func dropLockStats(file string) {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+	if s, ok := fileStats[file]; ok && s.inflight == 0 {
+		delete(fileStats, file)
+	}
+}
+
+// lockFiles acquires locks for several files in a consistent order
+func lockFiles(files []string) (func(), error) {
+	names := append([]string{}, files...)
+	sort.Strings(names)
+
+	releases := []func(){}
+	releaseAll := func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			releases[i]()
+		}
+	}
+	seen := map[string]bool{}
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		release, err := lockFile(name)
+		if err != nil {
+			releaseAll()
+			return nil, err
+		}
+		releases = append(releases, release)
+	}
+	return releaseAll, nil
+}
+
+func lockKey(file string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"id": &types.AttributeValueMemberS{Value: lockIDPrefix + c.MetricBucket + "/" + file},
+	}
+}
+
+func acquireRemoteLock(file string, start time.Time) error {
+	if c.LockTable == "" {
+		return nil
+	}
+	client, err := getDynamoClient()
+	if err != nil {
+		return err
+	}
+
+	ttl := c.LockTTL
+	if ttl == 0 {
+		ttl = defaultLockTTL
+	}
+	wait := c.LockWait
+	if wait == 0 {
+		wait = defaultLockWait
+	}
+
+	cond := "attribute_not_exists(id) OR expires < :now"
+	for {
+		now := time.Now().Unix()
+		item := lockKey(file)
+		item["file"] = &types.AttributeValueMemberS{Value: file}
+		item["holder"] = &types.AttributeValueMemberS{Value: lockHolder}
+		item["acquired"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(now, 10)}
+		item["expires"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(now+ttl, 10)}
+
+		_, err = client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+			TableName:           &c.LockTable,
+			Item:                item,
+			ConditionExpression: &cond,
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(now, 10)},
+			},
+		})
+		var ccf *types.ConditionalCheckFailedException
+		if !errors.As(err, &ccf) {
+			return err
+		}
+		if time.Since(start) > time.Duration(wait)*time.Second {
+			return errLockTimeout
+		}
+		time.Sleep(lockRetryDelay)
+	}
+}
+
+func releaseRemoteLock(file string) error {
+	if c.LockTable == "" {
+		return nil
+	}
+	client, err := getDynamoClient()
+	if err != nil {
+		return err
+	}
+
+	cond := "holder = :holder"
+	_, err = client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName:           &c.LockTable,
+		Key:                 lockKey(file),
+		ConditionExpression: &cond,
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":holder": &types.AttributeValueMemberS{Value: lockHolder},
+		},
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return nil
+	}
+	return err
+}
+
+func listLocks() ([]fileLock, error) {
+	locks := []fileLock{}
+	if c.LockTable == "" {
+		return locks, nil
+	}
+	client, err := getDynamoClient()
+	if err != nil {
+		return nil, err
+	}
+
+	filter := "begins_with(id, :prefix)"
+	paginator := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{
+		TableName:        &c.LockTable,
+		FilterExpression: &filter,
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":prefix": &types.AttributeValueMemberS{Value: lockIDPrefix + c.MetricBucket + "/"},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			l := fileLock{}
+			if v, ok := item["file"].(*types.AttributeValueMemberS); ok {
+				l.File = v.Value
+			}
+			if v, ok := item["holder"].(*types.AttributeValueMemberS); ok {
+				l.Holder = v.Value
+			}
+			if v, ok := item["acquired"].(*types.AttributeValueMemberN); ok {
+				l.Acquired, _ = strconv.ParseInt(v.Value, 10, 64)
+			}
+			if v, ok := item["expires"].(*types.AttributeValueMemberN); ok {
+				l.Expires, _ = strconv.ParseInt(v.Value, 10, 64)
+			}
+			locks = append(locks, l)
+		}
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].File < locks[j].File })
+	return locks, nil
+}
+
+// locksHandler lists held file locks on GET, and force-releases the lock for
+// ?file= on DELETE.
+func locksHandler(req events.Request) (events.Response, error) {
+	switch req.HTTPMethod {
+	case "GET":
+		locks, err := listLocks()
+		if err != nil {
+			return events.Fail(fmt.Sprintf("failed to list locks: %s", err))
+		}
+		return respondJSON(200, locks)
+	case "DELETE":
+	default:
+		return events.Respond(405, "locks requires GET or DELETE")
+	}
+
+	file := req.QueryStringParameters["file"]
+	if file == "" {
+		return events.Respond(400, "file is required")
+	}
+	if c.LockTable == "" {
+		return events.Respond(400, "no lock_table is configured")
+	}
+	client, err := getDynamoClient()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+	}
+	_, err = client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: &c.LockTable,
+		Key:       lockKey(file),
+	})
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to release lock: %s", err))
+	}
+	return events.Succeed("")
+}
+
+// lockMetrics reports push concurrency and lock contention seen by this
+// environment since it started
+func lockMetrics() []metric {
+	statsLock.Lock()
+	defer statsLock.Unlock()
+
+	metrics := []metric{}
+	for file, s := range fileStats {
+		tags := map[string]string{"file": file}
+		metrics = append(metrics,
+			metric{
+				Name:  "hook_exporter_push_inflight",
+				Type:  "gauge",
+				Tags:  tags,
+				Value: strconv.Itoa(s.inflight),
+			},
+			metric{
+				Name:  "hook_exporter_lock_wait_seconds_total",
+				Type:  "counter",
+				Tags:  tags,
+				Value: formatValue(s.waitTime.Seconds()),
+			},
+			metric{
+				Name:  "hook_exporter_lock_acquisitions_total",
+				Type:  "counter",
+				Tags:  tags,
+				Value: strconv.FormatInt(s.acquisitions, 10),
+			},
+			metric{
+				Name:  "hook_exporter_lock_timeouts_total",
+				Type:  "counter",
+				Tags:  tags,
+				Value: strconv.FormatInt(s.timeouts, 10),
+			},
+		)
+	}
+	sort.SliceStable(metrics, func(i, j int) bool {
+		return metrics[i].Tags["file"] < metrics[j].Tags["file"]
+	})
+	return metrics
+}
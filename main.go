@@ -1,14 +1,64 @@
 package main
 
 import (
+	"os"
 	"regexp"
 
 	"github.com/akerl/go-lambda/mux"
+	"github.com/aws/aws-lambda-go/lambda"
 )
 
 var (
 	metricRegex = regexp.MustCompile(`^/metric$`)
 	indexRegex  = regexp.MustCompile(`^/(metrics)?$`)
+
+	selftestRegex = regexp.MustCompile(`^/admin/selftest$`)
+	valuesRegex   = regexp.MustCompile(`^/api/values$`)
+	exportRegex   = regexp.MustCompile(`^/export\.csv$`)
+	freshRegex    = regexp.MustCompile(`^/freshness$`)
+	jobRegex      = regexp.MustCompile(`^/job/(?P<name>[\w\-/]+)/result$`)
+	deadRegex     = regexp.MustCompile(`^/admin/deadletters$`)
+	batchRegex    = regexp.MustCompile(`^/metrics/batch$`)
+	retainRegex   = regexp.MustCompile(`^/admin/retention$`)
+	familyRegex   = regexp.MustCompile(`^/api/families$`)
+	registryRegex = regexp.MustCompile(`^/admin/registry$`)
+	rulesRegex    = regexp.MustCompile(`^/admin/suggested-rules$`)
+	rotateRegex   = regexp.MustCompile(`^/admin/tokens/(?P<name>[\w\-]+)/(?P<action>stage|promote)$`)
+	templateRegex = regexp.MustCompile(`^/template$`)
+	maintRegex    = regexp.MustCompile(`^/admin/maintenance$`)
+	locksRegex    = regexp.MustCompile(`^/admin/locks$`)
+	pushgwRegex   = regexp.MustCompile(`^/metrics/job/(?P<key>.+)$`)
+	v1PushRegex   = regexp.MustCompile(`^/v1/push$`)
+	v1FileRegex   = regexp.MustCompile(`^/v1/files/(?P<name>[\w\-/]+)$`)
+	statsdRegex   = regexp.MustCompile(`^/statsd$`)
+	driftRegex    = regexp.MustCompile(`^/admin/reconcile$`)
+	writeRegex    = regexp.MustCompile(`^/api/v1/write$`)
+	otlpRegex     = regexp.MustCompile(`^/v1/metrics$`)
+	docsRegex     = regexp.MustCompile(`^/docs/metrics$`)
+	graphiteRegex = regexp.MustCompile(`^/graphite$`)
+	snsRegex      = regexp.MustCompile(`^/sns$`)
+	labelRegex    = regexp.MustCompile(`^/api/v1/label/(?P<name>[^/]+)/values$`)
+	seriesRegex   = regexp.MustCompile(`^/api/v1/series$`)
+	metaRegex     = regexp.MustCompile(`^/api/v1/metadata$`)
+	bucketRegex   = regexp.MustCompile(`^/admin/bucket-quota$`)
+	pinRegex      = regexp.MustCompile(`^/admin/config/pin$`)
+	migrateRegex  = regexp.MustCompile(`^/admin/migrate$`)
+	quickRegex    = regexp.MustCompile(`^/push$`)
+	costRegex     = regexp.MustCompile(`^/admin/cost$`)
+	accessRegex   = regexp.MustCompile(`^/admin/access-review$`)
+	githubRegex   = regexp.MustCompile(`^/hooks/github$`)
+	alertRegex    = regexp.MustCompile(`^/hooks/alertmanager$`)
+	datadogRegex  = regexp.MustCompile(`^/hooks?/datadog$`)
+	pagerRegex    = regexp.MustCompile(`^/hooks?/pagerduty$`)
+	hookRegex     = regexp.MustCompile(`^/hook/(?P<ruleset>[\w\-]+)$`)
+	hookTestRegex = regexp.MustCompile(`^/hook/(?P<ruleset>[\w\-]+)/test$`)
+	importRegex   = regexp.MustCompile(`^/admin/pushgateway/import$`)
+	pgExportRegex = regexp.MustCompile(`^/admin/pushgateway/export$`)
+	ddValidRegex  = regexp.MustCompile(`^/api/v1/validate$`)
+	collectdRegex = regexp.MustCompile(`^/collectd$`)
+	checksRegex   = regexp.MustCompile(`^/checks$`)
+	beatRegex     = regexp.MustCompile(`^/heartbeat/(?P<name>[\w\-]+)$`)
+	rulesetRegex  = regexp.MustCompile(`^/admin/transforms/(?P<name>[\w\-]+)$`)
 )
 
 func main() {
@@ -18,8 +68,63 @@ func main() {
 	}
 
 	d := mux.NewDispatcher(
-		mux.NewRouteWithAuth(metricRegex, metricHandler, metricAuth),
-		mux.NewRoute(indexRegex, indexHandler),
+		mux.NewRouteWithAuth(metricRegex, versionedRoute("metric", pushRoute(metricHandler)), metricAuth),
+		mux.NewRouteWithAuth(v1PushRegex, versionedRoute("v1_push", pushRoute(metricHandler)), metricAuth),
+		mux.NewRouteWithAuth(v1FileRegex, versionedRoute("v1_files", fileHandler), metricAuth),
+		mux.NewRouteWithAuth(batchRegex, pushRoute(batchHandler), metricAuth),
+		mux.NewRouteWithAuth(jobRegex, pushRoute(jobResultHandler), metricAuth),
+		mux.NewRouteWithAuth(statsdRegex, pushRoute(statsdHandler), metricAuth),
+		mux.NewRouteWithAuth(writeRegex, pushRoute(remoteWriteHandler), metricAuth),
+		mux.NewRouteWithAuth(otlpRegex, pushRoute(otlpHandler), metricAuth),
+		mux.NewRouteWithAuth(graphiteRegex, pushRoute(graphiteHandler), metricAuth),
+		mux.NewRouteWithAuth(quickRegex, pushRoute(quickPushHandler), metricAuth),
+		mux.NewRouteWithAuth(beatRegex, pushRoute(heartbeatHandler), metricAuth),
+		mux.NewRouteWithAuth(checksRegex, pushRoute(checksHandler), metricAuth),
+		mux.NewRouteWithAuth(collectdRegex, pushRoute(collectdHandler), metricAuth),
+		mux.NewRouteWithAuth(alertRegex, pushRoute(alertmanagerHandler), metricAuth),
+		mux.NewRouteWithAuth(datadogRegex, pushRoute(datadogHandler), metricAuth),
+		mux.NewRouteWithAuth(pushgwRegex, pushRoute(pushgatewayHandler), metricAuth),
+		mux.NewRouteWithAuth(templateRegex, templateHandler, metricAuth),
+		mux.NewRouteWithAuth(selftestRegex, writeRoute(selftestHandler), adminAuth),
+		mux.NewRouteWithAuth(deadRegex, writeRoute(deadLetterHandler), adminAuth),
+		mux.NewRouteWithAuth(retainRegex, writeRoute(retentionHandler), adminAuth),
+		mux.NewRouteWithAuth(registryRegex, writeRoute(registryHandler), adminAuth),
+		mux.NewRouteWithAuth(maintRegex, writeRoute(maintenanceHandler), adminAuth),
+		mux.NewRouteWithAuth(locksRegex, writeRoute(locksHandler), adminAuth),
+		mux.NewRouteWithAuth(driftRegex, writeRoute(reconcileHandler), adminAuth),
+		mux.NewRouteWithAuth(bucketRegex, writeRoute(bucketQuotaHandler), adminAuth),
+		mux.NewRouteWithAuth(rulesRegex, suggestedRulesHandler, adminAuth),
+		mux.NewRouteWithAuth(costRegex, costHandler, adminAuth),
+		mux.NewRouteWithAuth(accessRegex, accessHandler, adminAuth),
+		mux.NewRouteWithAuth(rotateRegex, writeRoute(rotationHandler), adminAuth),
+		mux.NewRouteWithAuth(pinRegex, writeRoute(configPinHandler), adminAuth),
+		mux.NewRouteWithAuth(migrateRegex, writeRoute(migrateHandler), adminAuth),
+		mux.NewRouteWithAuth(importRegex, writeRoute(pushgatewayImportHandler), adminAuth),
+		mux.NewRouteWithAuth(pgExportRegex, pushgatewayExportHandler, adminAuth),
+		mux.NewRouteWithAuth(rulesetRegex, writeRoute(rulesetHandler), adminAuth),
+		mux.NewRoute(snsRegex, pushRoute(snsHandler)),
+		mux.NewRoute(githubRegex, pushRoute(githubHandler)),
+		mux.NewRoute(pagerRegex, pushRoute(pagerDutyHandler)),
+		mux.NewRoute(hookRegex, pushRoute(transformHandler)),
+		mux.NewRouteWithAuth(hookTestRegex, transformTestHandler, metricAuth),
+		mux.NewRoute(valuesRegex, valuesHandler),
+		mux.NewRoute(familyRegex, familiesHandler),
+		mux.NewRoute(labelRegex, labelValuesHandler),
+		mux.NewRoute(seriesRegex, seriesRoute),
+		mux.NewRoute(ddValidRegex, datadogValidateHandler),
+		mux.NewRoute(metaRegex, metadataHandler),
+		mux.NewRoute(docsRegex, docsHandler),
+		mux.NewRoute(exportRegex, exportCSVHandler),
+		mux.NewRoute(freshRegex, freshnessHandler),
+		mux.NewRoute(indexRegex, coalesceRoute(indexHandler)),
 	)
-	mux.Start(d)
+	r := &instrumentedReceiver{&headerReceiver{&debugReceiver{d}}}
+
+	if addr := os.Getenv("LISTEN_ADDR"); addr != "" {
+		standalone = true
+		startScheduler()
+		panic(serveStandalone(addr, r))
+	}
+	sr := &stageReceiver{r}
+	lambda.Start(sr.HandleInvocation)
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/akerl/go-lambda/mux"
+)
+
+const (
+	maintenanceObject         = "maintenance.json"
+	defaultMaintenanceMessage = "pushes are paused for maintenance"
+
+	// maintenanceCacheTTL bounds how long other Lambda environments keep
+	// accepting pushes after maintenance mode is enabled
+	maintenanceCacheTTL = 10 * time.Second
+)
+
+type maintenanceState struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message,omitempty"`
+	Since   int64  `json:"since,omitempty"`
+}
+
+var (
+	maintenanceLock    sync.Mutex
+	maintenanceCache   maintenanceState
+	maintenanceChecked time.Time
+	maintenanceBucket  string
+)
+
+func loadMaintenance() (maintenanceState, error) {
+	maintenanceLock.Lock()
+	defer maintenanceLock.Unlock()
+
+	if maintenanceBucket == c.MetricBucket && time.Since(maintenanceChecked) < maintenanceCacheTTL {
+		traceCache("maintenance_hit")
+		return maintenanceCache, nil
+	}
+	traceCache("maintenance_miss")
+
+	client, err := getClient()
+	if err != nil {
+		return maintenanceState{}, err
+	}
+	var state maintenanceState
+	_, err = readInternalObject(client, maintenanceObject, &state)
+	if err != nil {
+		return maintenanceState{}, err
+	}
+	maintenanceCache = state
+	maintenanceChecked = time.Now()
+	maintenanceBucket = c.MetricBucket
+	return state, nil
+}
+
+func (m maintenanceState) message() string {
+	if m.Message != "" {
+		return m.Message
+	}
+	if c.MaintenanceMessage != "" {
+		return c.MaintenanceMessage
+	}
+	return defaultMaintenanceMessage
+}
+
+// pushRoute wraps a push handler so that it is refused while maintenance
+// mode is enabled. Scrapes are unaffected and keep serving stored data.
+// Gzipped bodies are decompressed before reaching the handler.
+func pushRoute(handler mux.HandleFunc) mux.HandleFunc {
+	handler = gzipRoute(handler)
+	return writeRoute(func(req events.Request) (events.Response, error) {
+		state, err := loadMaintenance()
+		if err != nil {
+			return events.Fail(fmt.Sprintf("failed to load maintenance state: %s", err))
+		}
+		if state.Enabled {
+			resp, err := events.Respond(503, state.message())
+			resp.Headers = map[string]string{"Retry-After": "60"}
+			return resp, err
+		}
+		return handler(req)
+	})
+}
+
+// maintenanceHandler reports maintenance mode on GET and toggles it on POST
+// with a body of {"enabled": true, "message": "..."}.
+func maintenanceHandler(req events.Request) (events.Response, error) {
+	switch req.HTTPMethod {
+	case "GET":
+		state, err := loadMaintenance()
+		if err != nil {
+			return events.Fail(fmt.Sprintf("failed to load maintenance state: %s", err))
+		}
+		if state.Enabled {
+			state.Message = state.message()
+		}
+		return respondJSON(200, state)
+	case "POST":
+	default:
+		return events.Respond(405, "maintenance requires GET or POST")
+	}
+
+	body, err := req.DecodedBody()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+	}
+	var state maintenanceState
+	err = json.Unmarshal([]byte(body), &state)
+	if err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to unmarshal: %s", err))
+	}
+	if state.Enabled {
+		state.Since = time.Now().Unix()
+	} else {
+		state = maintenanceState{}
+	}
+
+	client, err := getClient()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+	}
+	err = writeInternalObject(client, maintenanceObject, state)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to save maintenance state: %s", err))
+	}
+
+	maintenanceLock.Lock()
+	maintenanceCache = state
+	maintenanceChecked = time.Now()
+	maintenanceBucket = c.MetricBucket
+	maintenanceLock.Unlock()
+
+	if err := publishEvent("Maintenance Mode Changed", state); err != nil {
+		fmt.Printf("failed to publish maintenance event: %s\n", err)
+	}
+	return respondJSON(200, state)
+}
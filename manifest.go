@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const manifestObject = "manifest.json"
+
+// metricManifest is an inverted index from family name to the files that
+// contain it, so family-filtered reads only touch the relevant objects.
+// It is created by a full rebuild and then kept current on each push.
+type metricManifest struct {
+	Families map[string][]string `json:"families"`
+	Sizes    map[string]int64    `json:"sizes"`
+}
+
+func newManifest() metricManifest {
+	return metricManifest{
+		Families: map[string][]string{},
+		Sizes:    map[string]int64{},
+	}
+}
+
+func (m *metricManifest) remove(file string) {
+	for name, files := range m.Families {
+		i := sort.SearchStrings(files, file)
+		if i == len(files) || files[i] != file {
+			continue
+		}
+		files = append(files[:i], files[i+1:]...)
+		if len(files) == 0 {
+			delete(m.Families, name)
+		} else {
+			m.Families[name] = files
+		}
+	}
+	delete(m.Sizes, file)
+}
+
+func (m *metricManifest) add(mf metricFile) {
+	for _, metric := range mf.Metrics {
+		files := m.Families[metric.Name]
+		i := sort.SearchStrings(files, mf.FileName)
+		if i < len(files) && files[i] == mf.FileName {
+			continue
+		}
+		files = append(files, "")
+		copy(files[i+1:], files[i:])
+		files[i] = mf.FileName
+		m.Families[metric.Name] = files
+	}
+	if content, err := json.Marshal(mf); err == nil {
+		m.Sizes[mf.FileName] = int64(len(content))
+	}
+}
+
+// objects returns the files containing any of the named families
+func (m *metricManifest) objects(names []string) []types.Object {
+	seen := map[string]bool{}
+	keys := []string{}
+	for _, name := range names {
+		for _, f := range m.Families[name] {
+			if !seen[f] {
+				seen[f] = true
+				keys = append(keys, f)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	objects := make([]types.Object, len(keys))
+	for i, k := range keys {
+		key := k
+		objects[i] = types.Object{Key: &key, Size: m.Sizes[k]}
+	}
+	return objects
+}
+
+// updateManifest records a stored file's families. Until the manifest has
+// been built, there is nothing to update.
+func updateManifest(client *s3.Client, mf metricFile) error {
+	return editManifest(client, func(m *metricManifest) {
+		m.remove(mf.FileName)
+		m.add(mf)
+	})
+}
+
+func removeFromManifest(client *s3.Client, file string) error {
+	return editManifest(client, func(m *metricManifest) {
+		m.remove(file)
+	})
+}
+
+func editManifest(client *s3.Client, edit func(*metricManifest)) error {
+	release, err := lockFile(internalPrefix + manifestObject)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	m := newManifest()
+	found, err := readInternalObject(client, manifestObject, &m)
+	if err != nil || !found {
+		return err
+	}
+	edit(&m)
+	return writeInternalObject(client, manifestObject, m)
+}
+
+// rebuildManifest indexes every stored file from scratch
+func rebuildManifest(client *s3.Client) (metricManifest, error) {
+	files, err := readMetricFiles(client)
+	if err != nil {
+		return metricManifest{}, err
+	}
+
+	release, err := lockFile(internalPrefix + manifestObject)
+	if err != nil {
+		return metricManifest{}, err
+	}
+	defer release()
+
+	m := newManifest()
+	for _, mf := range files {
+		m.add(mf)
+	}
+	return m, writeInternalObject(client, manifestObject, m)
+}
+
+func runManifestJob() error {
+	client, err := getClient()
+	if err != nil {
+		return err
+	}
+	_, err = rebuildManifest(client)
+	return err
+}
+
+// manifestObjects looks up the files holding the named families, building
+// the manifest first if it doesn't exist yet
+func manifestObjects(client *s3.Client, names []string) ([]types.Object, error) {
+	m := newManifest()
+	found, err := readInternalObject(client, manifestObject, &m)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		traceCache("manifest_hit")
+	} else {
+		traceCache("manifest_miss")
+		m, err = rebuildManifest(client)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m.objects(names), nil
+}
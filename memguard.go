@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	defaultMemoryGuardRatio = 0.8
+	memoryCheckInterval     = 500
+)
+
+// memoryGuard tracks heap usage against the Lambda memory limit so a large
+// scrape can stop early with a partial result instead of being OOM-killed.
+type memoryGuard struct {
+	limit     uint64
+	calls     int
+	truncated bool
+}
+
+func newMemoryGuard() *memoryGuard {
+	mb, err := strconv.ParseUint(os.Getenv("AWS_LAMBDA_FUNCTION_MEMORY_SIZE"), 10, 64)
+	if err != nil || mb == 0 {
+		return &memoryGuard{}
+	}
+	ratio := c.MemoryGuardRatio
+	if ratio <= 0 || ratio > 1 {
+		ratio = defaultMemoryGuardRatio
+	}
+	return &memoryGuard{limit: uint64(float64(mb*1024*1024) * ratio)}
+}
+
+// Exceeded reports whether heap usage has passed the guard limit. Reading
+// memory stats is not free, so it is only sampled every few calls.
+func (mg *memoryGuard) Exceeded() bool {
+	if mg.limit == 0 || mg.truncated {
+		return mg.truncated
+	}
+	mg.calls++
+	if mg.calls%memoryCheckInterval != 1 {
+		return false
+	}
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	mg.truncated = stats.HeapAlloc > mg.limit
+	return mg.truncated
+}
+
+func (mg *memoryGuard) Marker() metric {
+	value := "0"
+	if mg.truncated {
+		value = "1"
+	}
+	return metric{
+		Name:  "hook_exporter_scrape_truncated",
+		Type:  "gauge",
+		Value: value,
+	}
+}
+
+func readMetricFilesGuarded(client *s3.Client, mg *memoryGuard) ([]metricFile, error) {
+	files, err := listMetricFiles(client)
+	if err != nil {
+		return []metricFile{}, err
+	}
+
+	metricFiles := []metricFile{}
+	for _, f := range files {
+		if mg.Exceeded() {
+			break
+		}
+		mf, err := readMetricFile(client, f)
+		if errors.Is(err, errMetricFileMissing) {
+			continue
+		} else if err != nil {
+			return []metricFile{}, err
+		}
+		metricFiles = append(metricFiles, mf)
+	}
+	return metricFiles, nil
+}
+
+// guardMetrics returns the metrics rendered before the memory guard tripped,
+// followed by the truncation marker
+func guardMetrics(metrics []metric, mg *memoryGuard) []metric {
+	guarded := make([]metric, 0, len(metrics)+1)
+	for _, m := range metrics {
+		if mg.Exceeded() {
+			break
+		}
+		guarded = append(guarded, m)
+	}
+	return append(guarded, mg.Marker())
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	migrationObject = "migration.json"
+	legacyPrefix    = internalPrefix + "legacy/"
+)
+
+// migrationStep is the planned or applied change for one stored object.
+// Objects in an older schema or with a name that doesn't match their key are
+// rewritten in place, and objects that can't be read at all are moved under
+// legacyPrefix so they stop failing scrapes.
+type migrationStep struct {
+	Key    string `json:"key"`
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+	Done   bool   `json:"done"`
+	Error  string `json:"error,omitempty"`
+}
+
+type migrationReport struct {
+	StartedAt       int64           `json:"started_at,omitempty"`
+	FinishedAt      int64           `json:"finished_at,omitempty"`
+	Applied         bool            `json:"applied"`
+	ManifestMissing bool            `json:"manifest_missing"`
+	ManifestBuilt   bool            `json:"manifest_built"`
+	Steps           []migrationStep `json:"steps"`
+}
+
+// planMigration inspects every stored object and returns the steps needed to
+// bring the bucket to the current layout
+func planMigration(client *s3.Client) (migrationReport, error) {
+	report := migrationReport{Steps: []migrationStep{}}
+
+	var m metricManifest
+	found, err := readInternalObject(client, manifestObject, &m)
+	if err != nil {
+		return report, err
+	}
+	report.ManifestMissing = !found
+
+	objects, err := listMetricObjects(client)
+	if err != nil {
+		return report, err
+	}
+	for _, obj := range objects {
+		body, err := readRawObject(client, *obj.Key)
+		if err != nil {
+			return report, err
+		}
+		if step, ok := migrationFor(*obj.Key, body); ok {
+			report.Steps = append(report.Steps, step)
+		}
+	}
+	return report, nil
+}
+
+// migrationFor reports the step needed for an object, if any
+func migrationFor(key string, body []byte) (migrationStep, bool) {
+	var mf metricFile
+	if err := json.Unmarshal(body, &mf); err == nil && mf.checkStored() == nil {
+		if mf.FileName == key {
+			return migrationStep{}, false
+		}
+		return migrationStep{
+			Key:    key,
+			Action: "rewrite",
+			Reason: fmt.Sprintf("stored name %q does not match key", mf.FileName),
+		}, true
+	}
+
+	mf, err := parseMetricFile(body)
+	if err != nil {
+		return migrationStep{Key: key, Action: "quarantine", Reason: err.Error()}, true
+	}
+	mf.FileName = key
+	if err := mf.checkStored(); err != nil {
+		return migrationStep{Key: key, Action: "quarantine", Reason: err.Error()}, true
+	}
+	return migrationStep{Key: key, Action: "rewrite", Reason: "stored in a legacy schema"}, true
+}
+
+// applyMigration runs the planned steps, saving the report after each one so
+// progress can be followed from another request
+func applyMigration(client *s3.Client, report migrationReport) (migrationReport, error) {
+	report.Applied = true
+	report.StartedAt = time.Now().Unix()
+	for i := range report.Steps {
+		if err := applyMigrationStep(client, report.Steps[i]); err != nil {
+			report.Steps[i].Error = err.Error()
+		} else {
+			report.Steps[i].Done = true
+		}
+		if err := writeInternalObject(client, migrationObject, report); err != nil {
+			fmt.Printf("failed to save migration progress: %s\n", err)
+		}
+	}
+
+	if _, err := rebuildManifest(client); err != nil {
+		return report, err
+	}
+	report.ManifestBuilt = true
+	report.FinishedAt = time.Now().Unix()
+	return report, writeInternalObject(client, migrationObject, report)
+}
+
+func applyMigrationStep(client *s3.Client, step migrationStep) error {
+	release, err := lockFile(step.Key)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	body, err := readRawObject(client, step.Key)
+	if err != nil {
+		return err
+	}
+
+	if step.Action == "quarantine" {
+		dest := legacyPrefix + step.Key
+		if _, err := client.PutObject(context.TODO(), &s3.PutObjectInput{
+			Bucket: &c.MetricBucket,
+			Key:    &dest,
+			Body:   bytes.NewReader(body),
+		}); err != nil {
+			return err
+		}
+		return deleteMetricFile(client, step.Key)
+	}
+
+	mf, err := parseMetricFile(body)
+	if err != nil {
+		return err
+	}
+	mf.FileName = step.Key
+	return writeMetricFile(client, mf)
+}
+
+func readRawObject(client *s3.Client, key string) ([]byte, error) {
+	result, err := client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: &c.MetricBucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer result.Body.Close()
+	return io.ReadAll(result.Body)
+}
+
+// runMigrationJob applies the migration when there is anything to do, so a
+// deployment can run it once on rollout from a schedule or EventBridge rule
+func runMigrationJob() error {
+	client, err := getClient()
+	if err != nil {
+		return err
+	}
+	report, err := planMigration(client)
+	if err != nil {
+		return err
+	}
+	if len(report.Steps) == 0 && !report.ManifestMissing {
+		return nil
+	}
+	report, err = applyMigration(client, report)
+	if err != nil {
+		return err
+	}
+	for _, step := range report.Steps {
+		if step.Error != "" {
+			return fmt.Errorf("failed to migrate %s: %s", step.Key, step.Error)
+		}
+	}
+	return nil
+}
+
+// migrateHandler reports the planned migration on GET, along with the last
+// applied run. POST applies it, and is refused unless maintenance mode is
+// enabled so that pushes can't race the rewrites.
+func migrateHandler(req events.Request) (events.Response, error) {
+	client, err := getClient()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+	}
+
+	switch req.HTTPMethod {
+	case "GET":
+		plan, err := planMigration(client)
+		if err != nil {
+			return events.Fail(fmt.Sprintf("failed to plan migration: %s", err))
+		}
+		var last migrationReport
+		if _, err := readInternalObject(client, migrationObject, &last); err != nil {
+			return events.Fail(fmt.Sprintf("failed to load last migration: %s", err))
+		}
+		return respondJSON(200, map[string]migrationReport{"plan": plan, "last": last})
+	case "POST":
+	default:
+		return events.Respond(405, "migration requires GET or POST")
+	}
+
+	state, err := loadMaintenance()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load maintenance state: %s", err))
+	}
+	if !state.Enabled {
+		return events.Respond(409, "enable maintenance mode before applying the migration")
+	}
+
+	plan, err := planMigration(client)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to plan migration: %s", err))
+	}
+	report, err := applyMigration(client, plan)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to apply migration: %s", err))
+	}
+	return respondJSON(200, report)
+}
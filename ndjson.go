@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const ndjsonFileHeader = "X-Metric-File"
+
+func isNDJSON(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/x-ndjson") ||
+		strings.HasPrefix(contentType, "application/jsonl")
+}
+
+// parseNDJSON converts newline-delimited metric objects into a metricFile.
+// A final line without a trailing newline that fails to parse is treated as
+// truncated and dropped, so a cut-off upload still stores the complete lines.
+func parseNDJSON(name, body string) (metricFile, error) {
+	if name == "" {
+		return metricFile{}, fmt.Errorf(
+			"ndjson pushes require a ?name= file name or %s header", ndjsonFileHeader,
+		)
+	}
+
+	mf := metricFile{FileName: name}
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var m metric
+		err := checkJSONLimits([]byte(line))
+		if err == nil {
+			err = decodeJSON([]byte(line), &m)
+		}
+		if err != nil && i == len(lines)-1 {
+			tracef("ndjson: dropped truncated line %d", i+1)
+			break
+		} else if err != nil {
+			return metricFile{}, fmt.Errorf("line %d: %s", i+1, err)
+		}
+		mf.Metrics = append(mf.Metrics, m)
+	}
+	if len(mf.Metrics) == 0 {
+		return metricFile{}, fmt.Errorf("no metrics in body")
+	}
+	return mf, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const defaultNegativeCacheTTL = 60
+
+var errMetricFileMissing = errors.New("metric file not found")
+
+// missingFiles remembers keys that were recently deleted or not found, so
+// repeated reads don't go back to S3 until the entry expires or a push
+// recreates the key.
+var (
+	missingLock  sync.Mutex
+	missingFiles = map[string]time.Time{}
+)
+
+func negativeCacheTTL() time.Duration {
+	ttl := c.NegativeCacheTTL
+	if ttl == 0 {
+		ttl = defaultNegativeCacheTTL
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+func isKnownMissing(f string) bool {
+	if c.NegativeCacheTTL < 0 {
+		return false
+	}
+	missingLock.Lock()
+	defer missingLock.Unlock()
+
+	seen, ok := missingFiles[missingKey(f)]
+	if !ok {
+		traceCache("negative_miss")
+		return false
+	}
+	if time.Since(seen) >= negativeCacheTTL() {
+		delete(missingFiles, missingKey(f))
+		traceCache("negative_expired")
+		return false
+	}
+	traceCache("negative_hit")
+	return true
+}
+
+func markMissing(f string) {
+	if c.NegativeCacheTTL < 0 {
+		return
+	}
+	missingLock.Lock()
+	defer missingLock.Unlock()
+	missingFiles[missingKey(f)] = time.Now()
+}
+
+func clearMissing(f string) {
+	missingLock.Lock()
+	defer missingLock.Unlock()
+	delete(missingFiles, missingKey(f))
+}
+
+// missingKey includes the bucket, since stages may use different buckets
+func missingKey(f string) string {
+	return c.MetricBucket + "/" + f
+}
+
+func isNotFound(err error) bool {
+	var nsk *types.NoSuchKey
+	var nf *types.NotFound
+	return errors.As(err, &nsk) || errors.As(err, &nf)
+}
+
+// missingError records a not found result in the negative cache and converts
+// it to errMetricFileMissing. Other errors are returned unchanged.
+func missingError(f string, err error) error {
+	if isNotFound(err) {
+		markMissing(f)
+		return fmt.Errorf("%w: %s", errMetricFileMissing, f)
+	}
+	return err
+}
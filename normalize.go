@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// invalidLabelChars are replaced when converting names and values from
+// sources that allow dots and other characters our labels don't
+var invalidLabelChars = regexp.MustCompile(`[^\w\-/]`)
+
+func sanitizeLabel(s string) string {
+	return invalidLabelChars.ReplaceAllString(s, "_")
+}
+
+// normalizeLabels trims label keys and values, handles empty values per
+// config, and collapses keys that become identical after trimming. Keys that
+// collapse to the same name with different values are rejected.
+func normalizeLabels(mf *metricFile) error {
+	for i, m := range mf.Metrics {
+		if len(m.Tags) == 0 {
+			continue
+		}
+		tags := make(map[string]string, len(m.Tags))
+		for k, v := range m.Tags {
+			k = strings.TrimSpace(k)
+			v = strings.TrimSpace(v)
+			if v == "" {
+				if c.DropEmptyLabels {
+					continue
+				}
+				return fmt.Errorf("metric %s label %s has an empty value", m.Name, k)
+			}
+			if existing, ok := tags[k]; ok && existing != v {
+				return fmt.Errorf("metric %s has conflicting values for label %s", m.Name, k)
+			}
+			tags[k] = v
+		}
+		mf.Metrics[i].Tags = tags
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+// orderMetrics applies the scrape ordering config: families listed in
+// pinned_families are moved to the top in the configured order, and families
+// matching excluded_families are dropped from the default scrape. Passing
+// ?family=a,b selects those families explicitly, bypassing exclusions.
+func orderMetrics(req events.Request, metrics []metric) []metric {
+	if names := requestedFamilies(req); names != nil {
+		wanted := map[string]bool{}
+		for _, name := range names {
+			wanted[name] = true
+		}
+		result := []metric{}
+		for _, m := range metrics {
+			if wanted[m.Name] {
+				result = append(result, m)
+			}
+		}
+		return pinMetrics(result)
+	}
+
+	if len(c.ExcludedFamilies) == 0 {
+		return pinMetrics(metrics)
+	}
+
+	patterns := []*regexp.Regexp{}
+	for _, p := range c.ExcludedFamilies {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			fmt.Printf("skipping excluded family pattern %s: %s\n", p, err)
+			continue
+		}
+		patterns = append(patterns, re)
+	}
+
+	result := []metric{}
+	for _, m := range metrics {
+		excluded := false
+		for _, re := range patterns {
+			if re.MatchString(m.Name) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			result = append(result, m)
+		}
+	}
+	return pinMetrics(result)
+}
+
+func pinMetrics(metrics []metric) []metric {
+	if len(c.PinnedFamilies) == 0 {
+		return metrics
+	}
+
+	rank := map[string]int{}
+	for i, name := range c.PinnedFamilies {
+		rank[name] = i
+	}
+	position := func(m metric) int {
+		if r, ok := rank[m.Name]; ok {
+			return r
+		}
+		return len(c.PinnedFamilies)
+	}
+	sort.SliceStable(metrics, func(i, j int) bool {
+		return position(metrics[i]) < position(metrics[j])
+	})
+	return metrics
+}
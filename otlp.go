@@ -0,0 +1,491 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+const (
+	otlpPrefix = "otlp"
+
+	otlpDelta          = 1
+	otlpNoRecordedFlag = 1
+)
+
+// otlpUnits maps the UCUM units OTel SDKs use to our base units
+var otlpUnits = map[string]string{
+	"s":  "seconds",
+	"By": "bytes",
+}
+
+// The otlp types mirror the OTLP/JSON encoding of ExportMetricsServiceRequest.
+// Protobuf requests are decoded into the same shape.
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpScopeMetrics struct {
+	Scope struct {
+		Name       string         `json:"name"`
+		Version    string         `json:"version"`
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpMetric struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Unit        string    `json:"unit"`
+	Gauge       *otlpData `json:"gauge"`
+	Sum         *otlpData `json:"sum"`
+
+	Histogram            *otlpData `json:"histogram"`
+	ExponentialHistogram *otlpData `json:"exponentialHistogram"`
+	Summary              *otlpData `json:"summary"`
+}
+
+type otlpData struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+type otlpDataPoint struct {
+	Attributes   []otlpKeyValue `json:"attributes"`
+	TimeUnixNano json.Number    `json:"timeUnixNano"`
+	AsDouble     json.Number    `json:"asDouble"`
+	AsInt        json.Number    `json:"asInt"`
+	Flags        int            `json:"flags"`
+}
+
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue *string     `json:"stringValue"`
+		BoolValue   *bool       `json:"boolValue"`
+		IntValue    json.Number `json:"intValue"`
+		DoubleValue json.Number `json:"doubleValue"`
+	} `json:"value"`
+}
+
+func (kv otlpKeyValue) String() string {
+	v := kv.Value
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.IntValue != "":
+		return v.IntValue.String()
+	default:
+		return v.DoubleValue.String()
+	}
+}
+
+type otlpPartialSuccess struct {
+	RejectedDataPoints int64  `json:"rejectedDataPoints,omitempty"`
+	ErrorMessage       string `json:"errorMessage,omitempty"`
+}
+
+// otlpHandler accepts OTLP/HTTP metric exports in protobuf or JSON. Gauges
+// and cumulative sums are stored in the file given by ?name=, or
+// otlp/<service.name>; other points are reported back as rejected.
+func otlpHandler(req events.Request) (events.Response, error) {
+	body, err := req.DecodedBody()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+	}
+	if max := effectiveJSONLimits().MaxBodyBytes; len(body) > max {
+		return events.Respond(400, fmt.Sprintf("rejected body: body exceeds %d bytes", max))
+	}
+
+	var export otlpRequest
+	proto := strings.HasPrefix(req.Headers["Content-Type"], "application/x-protobuf")
+	if proto {
+		export, err = parseOTLPProto([]byte(body))
+	} else {
+		err = json.Unmarshal([]byte(body), &export)
+	}
+	if err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to parse: %s", err))
+	}
+
+	mf, partial := flattenOTLP(export)
+	if name := req.QueryStringParameters["name"]; name != "" {
+		mf.FileName = name
+	}
+	mf.mergeSeries = true
+
+	resp, err := pushMetricFile(req, mf)
+	if err != nil || resp.StatusCode != 200 {
+		return resp, err
+	}
+	return otlpResponse(resp, partial, proto), nil
+}
+
+// otlpResponse replaces a successful push response with an
+// ExportMetricsServiceResponse, keeping its headers
+func otlpResponse(resp events.Response, partial otlpPartialSuccess, proto bool) events.Response {
+	if !proto {
+		body := []byte("{}")
+		if partial.RejectedDataPoints > 0 {
+			body, _ = json.Marshal(map[string]otlpPartialSuccess{"partialSuccess": partial})
+		}
+		resp.Body = string(body)
+		resp.Headers["Content-Type"] = "application/json"
+		return resp
+	}
+
+	body := []byte{}
+	if partial.RejectedDataPoints > 0 {
+		ps := appendProtoVarint(nil, 1, uint64(partial.RejectedDataPoints))
+		ps = appendProtoString(ps, 2, partial.ErrorMessage)
+		body = appendProtoBytes(body, 1, ps)
+	}
+	resp.Body = base64.StdEncoding.EncodeToString(body)
+	resp.IsBase64Encoded = true
+	resp.Headers["Content-Type"] = "application/x-protobuf"
+	return resp
+}
+
+// flattenOTLP converts an export into a metricFile, merging resource and
+// scope attributes into each point's tags
+func flattenOTLP(export otlpRequest) (metricFile, otlpPartialSuccess) {
+	mf := metricFile{FileName: otlpPrefix}
+	partial := otlpPartialSuccess{}
+	reasons := []string{}
+	reject := func(count int, reason string) {
+		partial.RejectedDataPoints += int64(count)
+		reasons = append(reasons, reason)
+	}
+
+	for _, rm := range export.ResourceMetrics {
+		resource := map[string]string{}
+		for _, kv := range rm.Resource.Attributes {
+			resource[sanitizeLabel(kv.Key)] = sanitizeLabel(kv.String())
+			if kv.Key == "service.name" && mf.FileName == otlpPrefix {
+				mf.FileName = otlpPrefix + "/" + sanitizeLabel(kv.String())
+			}
+		}
+
+		for _, sm := range rm.ScopeMetrics {
+			scope := map[string]string{}
+			for k, v := range resource {
+				scope[k] = v
+			}
+			for _, kv := range sm.Scope.Attributes {
+				scope[sanitizeLabel(kv.Key)] = sanitizeLabel(kv.String())
+			}
+			if sm.Scope.Name != "" {
+				scope["otel_scope_name"] = sanitizeLabel(sm.Scope.Name)
+			}
+			if sm.Scope.Version != "" {
+				scope["otel_scope_version"] = sanitizeLabel(sm.Scope.Version)
+			}
+
+			for _, om := range sm.Metrics {
+				var data *otlpData
+				kind := "gauge"
+				switch {
+				case om.Gauge != nil:
+					data = om.Gauge
+				case om.Sum != nil:
+					data = om.Sum
+					if data.AggregationTemporality == otlpDelta {
+						reject(len(data.DataPoints), fmt.Sprintf("%s: delta sums are not supported", om.Name))
+						continue
+					}
+					if data.IsMonotonic {
+						kind = "counter"
+					}
+				default:
+					for _, d := range []*otlpData{om.Histogram, om.ExponentialHistogram, om.Summary} {
+						if d != nil {
+							reject(len(d.DataPoints), fmt.Sprintf("%s: only gauges and sums are supported", om.Name))
+						}
+					}
+					continue
+				}
+
+				for _, dp := range data.DataPoints {
+					if dp.Flags&otlpNoRecordedFlag != 0 {
+						continue
+					}
+					m, err := otlpPoint(om, kind, scope, dp)
+					if err != nil {
+						reject(1, fmt.Sprintf("%s: %s", om.Name, err))
+						continue
+					}
+					mf.Metrics = append(mf.Metrics, m)
+				}
+			}
+		}
+	}
+
+	partial.ErrorMessage = strings.Join(reasons, "; ")
+	return mf, partial
+}
+
+func otlpPoint(om otlpMetric, kind string, scope map[string]string, dp otlpDataPoint) (metric, error) {
+	m := metric{
+		Name: sanitizeLabel(om.Name),
+		Type: kind,
+		Help: om.Description,
+		Unit: otlpUnits[om.Unit],
+		Tags: map[string]string{},
+	}
+	for k, v := range scope {
+		m.Tags[k] = v
+	}
+	for _, kv := range dp.Attributes {
+		m.Tags[sanitizeLabel(kv.Key)] = sanitizeLabel(kv.String())
+	}
+
+	if dp.AsInt != "" {
+		m.Value = dp.AsInt.String()
+	} else {
+		v, err := parseValue(dp.AsDouble.String())
+		if err != nil {
+			return metric{}, fmt.Errorf("invalid value %s", dp.AsDouble)
+		}
+		m.Value = formatValue(v)
+	}
+
+	if dp.TimeUnixNano != "" {
+		ns, err := strconv.ParseInt(dp.TimeUnixNano.String(), 10, 64)
+		if err != nil {
+			return metric{}, fmt.Errorf("invalid timestamp %s", dp.TimeUnixNano)
+		}
+		m.Timestamp = ns / 1e6
+	}
+	return m, nil
+}
+
+// parseOTLPProto decodes a protobuf ExportMetricsServiceRequest
+func parseOTLPProto(b []byte) (otlpRequest, error) {
+	export := otlpRequest{}
+	fields, err := parseProtoMessage(b)
+	if err != nil {
+		return export, err
+	}
+	for _, f := range fields {
+		if f.number != 1 {
+			continue
+		}
+		rm, err := parseOTLPResourceMetrics(f.data)
+		if err != nil {
+			return export, err
+		}
+		export.ResourceMetrics = append(export.ResourceMetrics, rm)
+	}
+	return export, nil
+}
+
+func parseOTLPResourceMetrics(b []byte) (otlpResourceMetrics, error) {
+	rm := otlpResourceMetrics{}
+	fields, err := parseProtoMessage(b)
+	if err != nil {
+		return rm, err
+	}
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			resource, err := parseProtoMessage(f.data)
+			if err != nil {
+				return rm, err
+			}
+			for _, rf := range resource {
+				if rf.number != 1 {
+					continue
+				}
+				kv, err := parseOTLPKeyValue(rf.data)
+				if err != nil {
+					return rm, err
+				}
+				rm.Resource.Attributes = append(rm.Resource.Attributes, kv)
+			}
+		case 2:
+			sm, err := parseOTLPScopeMetrics(f.data)
+			if err != nil {
+				return rm, err
+			}
+			rm.ScopeMetrics = append(rm.ScopeMetrics, sm)
+		}
+	}
+	return rm, nil
+}
+
+func parseOTLPScopeMetrics(b []byte) (otlpScopeMetrics, error) {
+	sm := otlpScopeMetrics{}
+	fields, err := parseProtoMessage(b)
+	if err != nil {
+		return sm, err
+	}
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			scope, err := parseProtoMessage(f.data)
+			if err != nil {
+				return sm, err
+			}
+			for _, sf := range scope {
+				switch sf.number {
+				case 1:
+					sm.Scope.Name = string(sf.data)
+				case 2:
+					sm.Scope.Version = string(sf.data)
+				case 3:
+					kv, err := parseOTLPKeyValue(sf.data)
+					if err != nil {
+						return sm, err
+					}
+					sm.Scope.Attributes = append(sm.Scope.Attributes, kv)
+				}
+			}
+		case 2:
+			m, err := parseOTLPMetric(f.data)
+			if err != nil {
+				return sm, err
+			}
+			sm.Metrics = append(sm.Metrics, m)
+		}
+	}
+	return sm, nil
+}
+
+func parseOTLPMetric(b []byte) (otlpMetric, error) {
+	m := otlpMetric{}
+	fields, err := parseProtoMessage(b)
+	if err != nil {
+		return m, err
+	}
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			m.Name = string(f.data)
+		case 2:
+			m.Description = string(f.data)
+		case 3:
+			m.Unit = string(f.data)
+		case 5, 7, 9, 10, 11:
+			data, err := parseOTLPData(f.data)
+			if err != nil {
+				return m, err
+			}
+			switch f.number {
+			case 5:
+				m.Gauge = &data
+			case 7:
+				m.Sum = &data
+			case 9:
+				m.Histogram = &data
+			case 10:
+				m.ExponentialHistogram = &data
+			case 11:
+				m.Summary = &data
+			}
+		}
+	}
+	return m, nil
+}
+
+// parseOTLPData decodes the data_points, aggregation_temporality, and
+// is_monotonic fields shared by the metric data messages. Points are only
+// decoded as NumberDataPoints for gauges and sums, but counted for the rest.
+func parseOTLPData(b []byte) (otlpData, error) {
+	data := otlpData{}
+	fields, err := parseProtoMessage(b)
+	if err != nil {
+		return data, err
+	}
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			dp, err := parseOTLPDataPoint(f.data)
+			if err != nil {
+				return data, err
+			}
+			data.DataPoints = append(data.DataPoints, dp)
+		case 2:
+			data.AggregationTemporality = int(f.num)
+		case 3:
+			data.IsMonotonic = f.num != 0
+		}
+	}
+	return data, nil
+}
+
+func parseOTLPDataPoint(b []byte) (otlpDataPoint, error) {
+	dp := otlpDataPoint{}
+	fields, err := parseProtoMessage(b)
+	if err != nil {
+		return dp, err
+	}
+	for _, f := range fields {
+		switch f.number {
+		case 3:
+			dp.TimeUnixNano = json.Number(strconv.FormatUint(f.num, 10))
+		case 4:
+			dp.AsDouble = json.Number(formatValue(math.Float64frombits(f.num)))
+		case 6:
+			dp.AsInt = json.Number(strconv.FormatInt(int64(f.num), 10))
+		case 7:
+			kv, err := parseOTLPKeyValue(f.data)
+			if err != nil {
+				return dp, err
+			}
+			dp.Attributes = append(dp.Attributes, kv)
+		case 8:
+			dp.Flags = int(f.num)
+		}
+	}
+	return dp, nil
+}
+
+func parseOTLPKeyValue(b []byte) (otlpKeyValue, error) {
+	kv := otlpKeyValue{}
+	fields, err := parseProtoMessage(b)
+	if err != nil {
+		return kv, err
+	}
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			kv.Key = string(f.data)
+		case 2:
+			value, err := parseProtoMessage(f.data)
+			if err != nil {
+				return kv, err
+			}
+			for _, vf := range value {
+				switch vf.number {
+				case 1:
+					s := string(vf.data)
+					kv.Value.StringValue = &s
+				case 2:
+					v := vf.num != 0
+					kv.Value.BoolValue = &v
+				case 3:
+					kv.Value.IntValue = json.Number(strconv.FormatInt(int64(vf.num), 10))
+				case 4:
+					kv.Value.DoubleValue = json.Number(strconv.FormatFloat(math.Float64frombits(vf.num), 'g', -1, 64))
+				}
+			}
+		}
+	}
+	return kv, nil
+}
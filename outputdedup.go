@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// dedupedSeries counts duplicate series dropped from scrapes by this process
+var dedupedSeries int64
+
+// dedupSeries drops series that render identically to one already in the
+// output, which fan-in from several files can produce. Duplicates that
+// differ are left for Prometheus to reject. With strict_series set, any
+// duplicate fails the scrape instead, naming the conflicting series.
+func dedupSeries(metrics []metric) ([]metric, error) {
+	seen := map[string]string{}
+	conflicts := map[string]bool{}
+	deduped := make([]metric, 0, len(metrics))
+	for _, m := range metrics {
+		key := seriesKey(m)
+		rendered := m.String()
+		if prev, ok := seen[key]; ok {
+			if prev == rendered && !c.StrictSeries {
+				atomic.AddInt64(&dedupedSeries, 1)
+				continue
+			}
+			conflicts[key] = true
+		} else {
+			seen[key] = rendered
+		}
+		deduped = append(deduped, m)
+	}
+
+	if c.StrictSeries && len(conflicts) > 0 {
+		return nil, fmt.Errorf("duplicate series: %s", strings.Join(sortedKeys(conflicts), ", "))
+	}
+	if len(conflicts) > 0 {
+		tracef("dedup: %d series have conflicting duplicates", len(conflicts))
+	}
+	return deduped, nil
+}
+
+func dedupMetrics() []metric {
+	return []metric{{
+		Name:  "hook_exporter_deduplicated_series_total",
+		Type:  "counter",
+		Tags:  map[string]string{},
+		Value: strconv.FormatInt(atomic.LoadInt64(&dedupedSeries), 10),
+	}}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+const defaultPagerDutyFile = "pagerduty"
+
+type pagerDutyWebhook struct {
+	Event struct {
+		EventType string `json:"event_type"`
+		Data      struct {
+			ID      string `json:"id"`
+			Type    string `json:"type"`
+			Status  string `json:"status"`
+			Urgency string `json:"urgency"`
+			Service struct {
+				Summary string `json:"summary"`
+			} `json:"service"`
+		} `json:"data"`
+	} `json:"event"`
+}
+
+// pagerDutyToken checks the X-PagerDuty-Signature header, which lists one
+// v1=<hex> signature per active webhook secret
+func pagerDutyToken(header string, body []byte) (tokenConfig, bool) {
+	for _, sig := range strings.Split(header, ",") {
+		sig = strings.TrimSpace(sig)
+		if !strings.HasPrefix(sig, "v1=") {
+			continue
+		}
+		given, err := hex.DecodeString(strings.TrimPrefix(sig, "v1="))
+		if err != nil {
+			continue
+		}
+		if t, ok := hmacToken(given, body); ok {
+			return t, true
+		}
+	}
+	return tokenConfig{}, false
+}
+
+// pagerDutyHandler accepts PagerDuty V3 webhooks signed with a token's
+// hmac_secret. Each incident event updates a per-incident
+// pagerduty_incident_open series, and pagerduty_open_incidents counts the
+// open incidents by service and urgency. Resolved incidents are dropped.
+func pagerDutyHandler(req events.Request) (events.Response, error) {
+	body, err := req.DecodedBody()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+	}
+	t, ok := pagerDutyToken(requestHeader(req, "X-PagerDuty-Signature"), []byte(body))
+	if !ok {
+		return events.Reject("bad signature")
+	}
+	req = hmacRequest(req, t)
+
+	if err := checkWebhookLimits([]byte(body)); err != nil {
+		return events.Respond(400, fmt.Sprintf("rejected body: %s", err))
+	}
+	var hook pagerDutyWebhook
+	if err := json.Unmarshal([]byte(body), &hook); err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to unmarshal: %s", err))
+	}
+	data := hook.Event.Data
+	if data.Type != "incident" || data.ID == "" {
+		return events.Succeed("")
+	}
+
+	name := req.QueryStringParameters["name"]
+	if name == "" {
+		name = defaultPagerDutyFile
+	}
+	open := "1"
+	if data.Status == "resolved" {
+		open = "0"
+	}
+	mf := metricFile{FileName: name, Metrics: []metric{{
+		Name: "pagerduty_incident_open",
+		Type: "gauge",
+		Tags: map[string]string{
+			"incident": sanitizeLabel(data.ID),
+			"service":  sanitizeLabel(data.Service.Summary),
+			"urgency":  sanitizeLabel(data.Urgency),
+		},
+		Value: open,
+	}}}
+	mf.mergeSeries = true
+	mf.derive = countOpenIncidents
+	return pushMetricFile(req, mf)
+}
+
+// countOpenIncidents drops resolved incidents and recomputes
+// pagerduty_open_incidents, keeping services whose count fell to zero
+func countOpenIncidents(mf *metricFile) {
+	counts := map[string]int{}
+	groups := map[string]map[string]string{}
+	kept := []metric{}
+	for _, m := range mf.Metrics {
+		switch m.Name {
+		case "pagerduty_incident_open":
+			if m.Value == "0" {
+				continue
+			}
+			kept = append(kept, m)
+			tags := map[string]string{"service": m.Tags["service"], "urgency": m.Tags["urgency"]}
+			key := labelString(tags)
+			groups[key] = tags
+			counts[key]++
+		case "pagerduty_open_incidents":
+			key := labelString(m.Tags)
+			groups[key] = m.Tags
+		default:
+			kept = append(kept, m)
+		}
+	}
+
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		kept = append(kept, metric{
+			Name:  "pagerduty_open_incidents",
+			Type:  "gauge",
+			Tags:  groups[key],
+			Value: strconv.Itoa(counts[key]),
+		})
+	}
+	mf.Metrics = kept
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+const (
+	// defaultMaxScrapeBytes stays under the 6MB Lambda response payload limit
+	defaultMaxScrapeBytes = 5 * 1024 * 1024
+	defaultFamilyPageSize = 100
+	maxFamilyPageSize     = 1000
+)
+
+type familySeries struct {
+	File      string            `json:"file"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Value     string            `json:"value"`
+	Histogram *histogram        `json:"histogram,omitempty"`
+	Summary   *summary          `json:"summary,omitempty"`
+	PushedAt  int64             `json:"pushed_at,omitempty"`
+}
+
+type metricFamily struct {
+	Name   string         `json:"name"`
+	Type   string         `json:"type"`
+	Help   string         `json:"help,omitempty"`
+	Unit   string         `json:"unit,omitempty"`
+	Series []familySeries `json:"series"`
+}
+
+type familyPage struct {
+	Families []metricFamily `json:"families"`
+	Next     string         `json:"next,omitempty"`
+}
+
+func maxScrapeBytes() int {
+	if c.MaxScrapeBytes > 0 {
+		return c.MaxScrapeBytes
+	}
+	return defaultMaxScrapeBytes
+}
+
+// shardMetricFiles keeps only the files assigned to the requested shard when
+// ?shard=N&shards=M is given, so large deployments can split a scrape across
+// several targets.
+func shardMetricFiles(req events.Request, files []metricFile) ([]metricFile, error) {
+	shardParam := req.QueryStringParameters["shard"]
+	shardsParam := req.QueryStringParameters["shards"]
+	if shardParam == "" && shardsParam == "" {
+		return files, nil
+	}
+
+	shard, err := strconv.Atoi(shardParam)
+	if err != nil {
+		return nil, fmt.Errorf("invalid shard: %s", shardParam)
+	}
+	shards, err := strconv.Atoi(shardsParam)
+	if err != nil || shards < 1 {
+		return nil, fmt.Errorf("invalid shards: %s", shardsParam)
+	}
+	if shard < 0 || shard >= shards {
+		return nil, fmt.Errorf("shard must be between 0 and %d", shards-1)
+	}
+
+	result := []metricFile{}
+	for _, mf := range files {
+		h := fnv.New32a()
+		h.Write([]byte(mf.FileName))
+		if int(h.Sum32()%uint32(shards)) == shard {
+			result = append(result, mf)
+		}
+	}
+	return result, nil
+}
+
+func groupFamilies(files []metricFile) []metricFamily {
+	byName := map[string]*metricFamily{}
+	for _, mf := range files {
+		for _, m := range mf.Metrics {
+			f, ok := byName[m.Name]
+			if !ok {
+				f = &metricFamily{Name: m.Name, Type: m.Type, Help: m.Help, Unit: m.Unit}
+				byName[m.Name] = f
+			}
+			f.Series = append(f.Series, familySeries{
+				File:      mf.FileName,
+				Tags:      m.Tags,
+				Value:     m.Value,
+				Histogram: m.Histogram,
+				Summary:   m.Summary,
+				PushedAt:  mf.PushedAt,
+			})
+		}
+	}
+
+	families := make([]metricFamily, 0, len(byName))
+	for _, f := range byName {
+		families = append(families, *f)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].Name < families[j].Name
+	})
+	return families
+}
+
+// familiesHandler returns metric families as paged JSON. The next token is
+// opaque to clients and encodes the last family name returned.
+func familiesHandler(req events.Request) (events.Response, error) {
+	limit := defaultFamilyPageSize
+	if l := req.QueryStringParameters["limit"]; l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			return events.Respond(400, "invalid limit")
+		}
+		limit = n
+	}
+	if limit > maxFamilyPageSize {
+		limit = maxFamilyPageSize
+	}
+
+	after := ""
+	if p := req.QueryStringParameters["page"]; p != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(p)
+		if err != nil {
+			return events.Respond(400, "invalid page token")
+		}
+		after = string(decoded)
+	}
+
+	client, err := getClient()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+	}
+
+	files, err := readMetricFiles(client)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to read metrics: %s", err))
+	}
+	files, ok := scopeMetricFiles(req, files)
+	if !ok {
+		return events.Reject("bad auth token")
+	}
+	files = redactMetricFiles(files)
+
+	families := groupFamilies(files)
+	start := sort.Search(len(families), func(i int) bool {
+		return families[i].Name > after
+	})
+	end := start + limit
+	page := familyPage{}
+	if end < len(families) {
+		page.Next = base64.RawURLEncoding.EncodeToString([]byte(families[end-1].Name))
+	} else {
+		end = len(families)
+	}
+	page.Families = families[start:end]
+	return respondJSON(200, page)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+// exportJob is the job label used for files that weren't pushed through the
+// Pushgateway API, which are grouped by a file label instead
+const exportJob = "hook_exporter"
+
+type pushgatewayExport struct {
+	URL    string `json:"url"`
+	DryRun bool   `json:"dry_run"`
+}
+
+type exportResult struct {
+	File  string `json:"file"`
+	Path  string `json:"path"`
+	Error string `json:"error,omitempty"`
+}
+
+// exportGroupingKey returns the grouping key a file is exported under. Files
+// stored from /metrics/job/... keep their original grouping key, and other
+// files are grouped under job="hook_exporter" with their name as the file
+// label.
+func exportGroupingKey(name string) map[string]string {
+	prefix := pushgatewayPrefix + "/job/"
+	if strings.HasPrefix(name, prefix) {
+		labels, err := parseGroupingKey("job/" + strings.TrimPrefix(name, prefix))
+		if err == nil && groupFileName(labels) == name {
+			return labels
+		}
+	}
+	return map[string]string{"job": exportJob, "file": name}
+}
+
+// groupingKeyPath builds the /metrics/job/... path for a grouping key,
+// base64 encoding values the Pushgateway can't take as a path segment
+func groupingKeyPath(labels map[string]string) string {
+	segment := func(k, v string) string {
+		if v == "" || strings.Contains(v, "/") {
+			return k + "@base64/" + base64.URLEncoding.EncodeToString([]byte(v))
+		}
+		return k + "/" + v
+	}
+	path := "/metrics/" + segment("job", labels["job"])
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		if k != "job" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		path += "/" + segment(k, labels[k])
+	}
+	return path
+}
+
+// pushgatewayBody renders metrics in the text format with one TYPE line per
+// family, as the Pushgateway's parser requires. Timestamps are dropped
+// because the Pushgateway rejects them, and series carrying a grouping label
+// with a different value are skipped.
+func pushgatewayBody(metrics []metric, labels map[string]string) []byte {
+	var buf bytes.Buffer
+	for _, f := range familiesOf(metrics) {
+		series := []metric{}
+		for _, m := range f.Metrics {
+			if conflictsWithGroup(m.Tags, labels) {
+				continue
+			}
+			series = append(series, m)
+		}
+		if len(series) == 0 {
+			continue
+		}
+		if f.Help != "" {
+			fmt.Fprintf(&buf, "# HELP %s %s\n", f.Name, escapeHelp(f.Help))
+		}
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", f.Name, f.Type)
+		for _, m := range series {
+			for _, s := range m.samples() {
+				fmt.Fprintf(&buf, "%s%s %s\n", s.Name, s.TagString(), s.Value)
+			}
+		}
+	}
+	return buf.Bytes()
+}
+
+func conflictsWithGroup(tags, labels map[string]string) bool {
+	for k, v := range labels {
+		if t, ok := tags[k]; ok && t != v {
+			return true
+		}
+	}
+	return false
+}
+
+// pushToPushgateway replaces the group at path with body
+func pushToPushgateway(base, path string, body []byte) error {
+	target := strings.TrimSuffix(base, "/") + path
+	req, err := http.NewRequest("PUT", target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	client := &http.Client{Timeout: pushgatewayTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("pushgateway returned %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// pushgatewayExportHandler pushes each stored file, as it would be scraped,
+// to the Pushgateway given by {"url": "..."}, one group per file. With
+// "dry_run": true it only lists the groups.
+func pushgatewayExportHandler(req events.Request) (events.Response, error) {
+	if req.HTTPMethod != "POST" {
+		return events.Respond(405, "pushgateway export requires POST")
+	}
+	body, err := req.DecodedBody()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+	}
+	var params pushgatewayExport
+	if err := json.Unmarshal([]byte(body), &params); err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to unmarshal: %s", err))
+	}
+	if params.URL == "" {
+		return events.Respond(400, "pushgateway export requires a url")
+	}
+
+	client, err := getClient()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+	}
+	files, err := readMetricFiles(client)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to read metrics: %s", err))
+	}
+	files = redactMetricFiles(files)
+
+	code := 200
+	results := []exportResult{}
+	for _, mf := range files {
+		labels := exportGroupingKey(mf.FileName)
+		result := exportResult{File: mf.FileName, Path: groupingKeyPath(labels)}
+		if !params.DryRun {
+			err := pushToPushgateway(params.URL, result.Path, pushgatewayBody(mf.Metrics, labels))
+			if err != nil {
+				result.Error = err.Error()
+				code = 207
+			}
+		}
+		results = append(results, result)
+	}
+	return respondJSON(code, results)
+}
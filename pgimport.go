@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	pushTimeMetric    = "push_time_seconds"
+	pushFailureMetric = "push_failure_time_seconds"
+
+	pushgatewayTimeout = 30 * time.Second
+)
+
+type pushgatewayImport struct {
+	URL    string `json:"url"`
+	DryRun bool   `json:"dry_run"`
+}
+
+type importResponse struct {
+	Files   []string     `json:"files"`
+	Skipped []string     `json:"skipped"`
+	Results []pushResult `json:"results,omitempty"`
+}
+
+// fetchPushgateway scrapes a Pushgateway's /metrics in the text format
+func fetchPushgateway(base string) (string, error) {
+	target := strings.TrimSuffix(base, "/")
+	if !strings.HasSuffix(target, "/metrics") {
+		target += "/metrics"
+	}
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "text/plain")
+	client := &http.Client{Timeout: pushgatewayTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("pushgateway returned %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+// dropUnsupportedFamilies removes histogram and summary families, which
+// aren't stored, returning the filtered body and the dropped family names
+func dropUnsupportedFamilies(body string) (string, []string) {
+	dropped := map[string]bool{}
+	lines := strings.Split(body, "\n")
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) == 4 && fields[0] == "#" && fields[1] == "TYPE" &&
+			(fields[3] == "histogram" || fields[3] == "summary") {
+			dropped[fields[2]] = true
+		}
+	}
+	if len(dropped) == 0 {
+		return body, []string{}
+	}
+
+	kept := []string{}
+	for _, line := range lines {
+		name := strings.TrimSpace(line)
+		if fields := strings.Fields(name); len(fields) > 2 && fields[0] == "#" {
+			name = fields[2]
+		} else if end := strings.IndexAny(name, "{ "); end != -1 {
+			name = name[:end]
+		}
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			if base := strings.TrimSuffix(name, suffix); dropped[base] {
+				name = base
+			}
+		}
+		if !dropped[name] {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n"), sortedKeys(dropped)
+}
+
+// splitPushgatewayGroups assigns each series to the group whose grouping
+// labels it carries, using the push_time_seconds series the Pushgateway
+// exposes for every group. Series outside any group, like the Pushgateway's
+// own metrics, are dropped.
+func splitPushgatewayGroups(body string) ([]metricFile, []string, error) {
+	body, skipped := dropUnsupportedFamilies(body)
+	all, err := parseExposition("import", body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	groups := []map[string]string{}
+	for _, m := range all.Metrics {
+		if m.Name == pushTimeMetric {
+			groups = append(groups, m.Tags)
+		}
+	}
+	// Match the most specific grouping key first
+	sort.SliceStable(groups, func(i, j int) bool {
+		return len(groups[i]) > len(groups[j])
+	})
+
+	files := map[string]*metricFile{}
+	for _, m := range all.Metrics {
+		if m.Name == pushTimeMetric || m.Name == pushFailureMetric {
+			continue
+		}
+		for _, g := range groups {
+			if !hasLabels(m.Tags, g) {
+				continue
+			}
+			name := groupFileName(g)
+			if files[name] == nil {
+				files[name] = &metricFile{FileName: name}
+			}
+			files[name].Metrics = append(files[name].Metrics, m)
+			break
+		}
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]metricFile, len(names))
+	for i, name := range names {
+		result[i] = *files[name]
+	}
+	return result, skipped, nil
+}
+
+func hasLabels(tags, labels map[string]string) bool {
+	for k, v := range labels {
+		if tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func importMetricFile(req events.Request, client *s3.Client, mf metricFile) pushResult {
+	release, err := lockFile(mf.FileName)
+	if err != nil {
+		return *rejectPush(mf, 409, fmt.Sprintf("failed to lock %s: %s", mf.FileName, err))
+	}
+	defer release()
+
+	if r := prepareMetricFile(req, client, &mf); r != nil {
+		return *r
+	}
+	return storeMetricFile(client, mf)
+}
+
+// pushgatewayImportHandler scrapes the Pushgateway given by
+// {"url": "..."} and stores each of its groups as the file a push to the
+// same grouping key would use. With "dry_run": true it only lists the
+// files. Histogram and summary families are skipped.
+func pushgatewayImportHandler(req events.Request) (events.Response, error) {
+	if req.HTTPMethod != "POST" {
+		return events.Respond(405, "pushgateway import requires POST")
+	}
+	body, err := req.DecodedBody()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+	}
+	var params pushgatewayImport
+	if err := json.Unmarshal([]byte(body), &params); err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to unmarshal: %s", err))
+	}
+	if params.URL == "" {
+		return events.Respond(400, "pushgateway import requires a url")
+	}
+
+	scrape, err := fetchPushgateway(params.URL)
+	if err != nil {
+		return events.Respond(502, fmt.Sprintf("failed to scrape pushgateway: %s", err))
+	}
+	files, skipped, err := splitPushgatewayGroups(scrape)
+	if err != nil {
+		return events.Respond(502, fmt.Sprintf("failed to parse pushgateway: %s", err))
+	}
+
+	resp := importResponse{Files: []string{}, Skipped: skipped}
+	for _, mf := range files {
+		resp.Files = append(resp.Files, mf.FileName)
+	}
+	if params.DryRun {
+		return respondJSON(200, resp)
+	}
+
+	client, err := getClient()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+	}
+	code := 200
+	for _, mf := range files {
+		result := importMetricFile(req, client, mf)
+		if result.Status == pushRejected {
+			code = 207
+		}
+		resp.Results = append(resp.Results, result)
+	}
+	recordPush(resp.Results...)
+	return respondJSON(code, resp)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type piiConfig struct {
+	Mode     string            `json:"mode"`
+	Patterns map[string]string `json:"patterns"`
+}
+
+var defaultPIIPatterns = map[string]string{
+	"email":       `[^@\s]+@[^@\s]+\.[^@\s]+`,
+	"credit_card": `\b(?:\d[ -]?){13,19}\b`,
+}
+
+// piiRuleMode enforces the pii rule when pii_scan.mode is reject, the
+// setting that predates validation_rules
+func piiRuleMode() string {
+	switch c.PIIScan.Mode {
+	case "", "redact":
+		return ruleOff
+	}
+	return ruleEnforce
+}
+
+// redactPII replaces label values matching a PII pattern when pii_scan.mode
+// is redact. It runs before validation, so redacted values aren't reported
+// by the pii rule.
+func redactPII(mf *metricFile) error {
+	if c.PIIScan.Mode != "redact" {
+		return nil
+	}
+	patterns, err := piiPatterns()
+	if err != nil {
+		return err
+	}
+	for i, m := range mf.Metrics {
+		for k, v := range m.Tags {
+			for _, re := range patterns {
+				if re.MatchString(v) {
+					mf.Metrics[i].Tags[k] = redactedValue
+					break
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkPII reports label values matching a PII pattern
+func checkPII(_ *s3.Client, mf *metricFile, _ string) ([]validationFinding, error) {
+	patterns, err := piiPatterns()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(patterns))
+	for name := range patterns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	findings := []validationFinding{}
+	for _, m := range mf.Metrics {
+		for _, k := range labelKeys(m.Tags) {
+			for _, name := range names {
+				if patterns[name].MatchString(m.Tags[k]) {
+					findings = append(findings, validationFinding{
+						Metric:  m.Name,
+						Label:   k,
+						Message: fmt.Sprintf("matched %s pattern", name),
+					})
+					break
+				}
+			}
+		}
+	}
+	return findings, nil
+}
+
+func piiPatterns() (map[string]*regexp.Regexp, error) {
+	patterns := map[string]*regexp.Regexp{}
+	for name, p := range defaultPIIPatterns {
+		patterns[name] = regexp.MustCompile(p)
+	}
+	for name, p := range c.PIIScan.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pii pattern %s: %s", name, err)
+		}
+		patterns[name] = re
+	}
+	return patterns, nil
+}
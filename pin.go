@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/akerl/go-lambda/s3"
+	awsS3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/ghodss/yaml"
+)
+
+const (
+	pinSuffix      = ".pin"
+	configInterval = 60 * time.Second
+)
+
+// configPin pins the config to an S3 object version. It is stored beside
+// the config object, and only applies while S3_VERSION still matches the
+// value it had when the pin was set, so a deploy with a new S3_VERSION
+// takes precedence over an older pin.
+type configPin struct {
+	Version    string `json:"version"`
+	EnvVersion string `json:"env_version,omitempty"`
+	PinnedAt   int64  `json:"pinned_at"`
+}
+
+type pinStatus struct {
+	Version    string `json:"version"`
+	EnvVersion string `json:"env_version,omitempty"`
+	Pinned     bool   `json:"pinned"`
+}
+
+// loadedVersions is the version last loaded for each config file, which is
+// "" while following the latest version
+var (
+	pinLock        sync.Mutex
+	loadedVersions = map[*s3.ConfigFile]string{}
+)
+
+func pinKey(f *s3.ConfigFile) string {
+	return f.Key + pinSuffix
+}
+
+// pinnedVersion returns the config version to load, or "" to follow the
+// latest version
+func pinnedVersion(client *awsS3.Client, f *s3.ConfigFile) (string, error) {
+	env := os.Getenv("S3_VERSION")
+	key := pinKey(f)
+	result, err := client.GetObject(context.TODO(), &awsS3.GetObjectInput{
+		Bucket: &f.Bucket,
+		Key:    &key,
+	})
+	if isNotFound(err) {
+		return env, nil
+	} else if err != nil {
+		return "", err
+	}
+	defer result.Body.Close()
+
+	var pin configPin
+	if err := json.NewDecoder(result.Body).Decode(&pin); err != nil {
+		return "", err
+	}
+	if pin.EnvVersion != env {
+		return env, nil
+	}
+	return pin.Version, nil
+}
+
+// loadConfigVersion loads the given version of the config object, or the
+// latest when version is "". It decodes into a new config and swaps it in,
+// so nothing set only by the previously loaded version carries over.
+func loadConfigVersion(client *awsS3.Client, f *s3.ConfigFile, version string) error {
+	var fresh *config
+	if version == "" {
+		raw, err := s3.GetObject(f.Bucket, f.Key)
+		if err != nil {
+			return err
+		}
+		if err := yaml.Unmarshal(raw, &fresh); err != nil {
+			return err
+		}
+	} else if err := loadVersionInto(client, f, version, &fresh); err != nil {
+		return err
+	}
+	if fresh != nil {
+		if err := fresh.normalize(); err != nil {
+			return err
+		}
+	}
+
+	target := f.Config.(**config)
+	if c == *target {
+		c = fresh
+	}
+	*target = fresh
+	return nil
+}
+
+// reloadConfig reloads a config file outside of a request, holding stageLock
+// so that the reload can't land while a request is using the config
+func reloadConfig(f *s3.ConfigFile) error {
+	stageLock.Lock()
+	defer stageLock.Unlock()
+	return loadPinnedConfig(f)
+}
+
+// reloadConfigFile reloads a config file from within a request. Lambda
+// requests hold stageLock, so the reload happens right away. Standalone
+// requests only hold it for reading, alongside other requests, so the
+// reload is left to run once they finish.
+func reloadConfigFile(f *s3.ConfigFile) error {
+	if standalone {
+		go func() {
+			if err := reloadConfig(f); err != nil {
+				f.OnError(f, err)
+			}
+		}()
+		return nil
+	}
+	return loadPinnedConfig(f)
+}
+
+// loadPinnedConfig loads the pinned config version, or the latest if
+// unpinned. The caller must hold stageLock.
+func loadPinnedConfig(f *s3.ConfigFile) error {
+	pinLock.Lock()
+	defer pinLock.Unlock()
+
+	client, err := s3.Client()
+	if err != nil {
+		return err
+	}
+	version, err := pinnedVersion(client, f)
+	if err != nil {
+		return err
+	}
+	if version != "" && version == loadedVersions[f] {
+		return nil
+	}
+	if err := loadConfigVersion(client, f, version); err != nil {
+		return err
+	}
+	loadedVersions[f] = version
+	return nil
+}
+
+// watchConfig replaces Autoreload, reloading the config on an interval while
+// honoring the pin
+func watchConfig(f *s3.ConfigFile) {
+	go func() {
+		for {
+			time.Sleep(configInterval)
+			if err := reloadConfig(f); err != nil {
+				f.OnError(f, err)
+			}
+		}
+	}()
+}
+
+// latestConfigVersion returns the current version ID of the config object
+func latestConfigVersion(client *awsS3.Client) (string, error) {
+	head, err := client.HeadObject(context.TODO(), &awsS3.HeadObjectInput{
+		Bucket: &cf.Bucket,
+		Key:    &cf.Key,
+	})
+	if err != nil {
+		return "", err
+	}
+	if head.VersionId == nil || *head.VersionId == "null" {
+		return "", fmt.Errorf("config bucket does not have versioning enabled")
+	}
+	return *head.VersionId, nil
+}
+
+// configPinHandler reports the pinned config version on GET. POST with a
+// body of {"version": "<id>"} pins that version, with "latest" pinning the
+// current version, and DELETE removes the pin so the config follows the
+// latest version (or S3_VERSION, if set).
+func configPinHandler(req events.Request) (events.Response, error) {
+	if cf == nil {
+		return events.Fail("config file location unknown")
+	}
+	client, err := s3.Client()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+	}
+
+	switch req.HTTPMethod {
+	case "GET":
+	case "POST":
+		body, err := req.DecodedBody()
+		if err != nil {
+			return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+		}
+		var pin configPin
+		if err := json.Unmarshal([]byte(body), &pin); err != nil {
+			return events.Respond(400, fmt.Sprintf("failed to unmarshal: %s", err))
+		}
+		if pin.Version == "" || strings.EqualFold(pin.Version, "latest") {
+			pin.Version, err = latestConfigVersion(client)
+			if err != nil {
+				return events.Fail(fmt.Sprintf("failed to find latest version: %s", err))
+			}
+		}
+		var probe *config
+		err = loadVersionInto(client, cf, pin.Version, &probe)
+		if err == nil && probe != nil {
+			err = probe.normalize()
+		}
+		if err != nil {
+			return events.Respond(400, fmt.Sprintf("version %s is not a loadable config: %s", pin.Version, err))
+		}
+		pin.EnvVersion = os.Getenv("S3_VERSION")
+		pin.PinnedAt = time.Now().Unix()
+		content, err := json.Marshal(pin)
+		if err != nil {
+			return events.Fail(fmt.Sprintf("failed to marshal: %s", err))
+		}
+		if err := s3.PutObject(cf.Bucket, pinKey(cf), string(content)); err != nil {
+			return events.Fail(fmt.Sprintf("failed to save pin: %s", err))
+		}
+	case "DELETE":
+		key := pinKey(cf)
+		_, err := client.DeleteObject(context.TODO(), &awsS3.DeleteObjectInput{
+			Bucket: &cf.Bucket,
+			Key:    &key,
+		})
+		if err != nil {
+			return events.Fail(fmt.Sprintf("failed to remove pin: %s", err))
+		}
+	default:
+		return events.Respond(405, "config pin requires GET, POST, or DELETE")
+	}
+
+	if req.HTTPMethod != "GET" {
+		if err := reloadConfigFile(cf); err != nil {
+			return events.Fail(fmt.Sprintf("failed to reload config: %s", err))
+		}
+	}
+	version, err := pinnedVersion(client, cf)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load pin: %s", err))
+	}
+	return respondJSON(200, pinStatus{
+		Version:    version,
+		EnvVersion: os.Getenv("S3_VERSION"),
+		Pinned:     version != "",
+	})
+}
+
+func loadVersionInto(client *awsS3.Client, f *s3.ConfigFile, version string, v interface{}) error {
+	result, err := client.GetObject(context.TODO(), &awsS3.GetObjectInput{
+		Bucket:    &f.Bucket,
+		Key:       &f.Key,
+		VersionId: &version,
+	})
+	if err != nil {
+		return err
+	}
+	defer result.Body.Close()
+	raw, err := io.ReadAll(result.Body)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(raw, v)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+// promResponse is the envelope used by the Prometheus HTTP API, so tools
+// built against Prometheus can read from the exporter directly
+type promResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+func promSuccess(data interface{}) (events.Response, error) {
+	return respondJSON(200, promResponse{Status: "success", Data: data})
+}
+
+func promError(code int, errorType, msg string) (events.Response, error) {
+	return respondJSON(code, promResponse{Status: "error", ErrorType: errorType, Error: msg})
+}
+
+// readPromFiles loads the stored files visible to the request
+func readPromFiles(req events.Request) ([]metricFile, bool, error) {
+	client, err := getClient()
+	if err != nil {
+		return nil, true, err
+	}
+	files, err := readMetricFiles(client)
+	if err != nil {
+		return nil, true, err
+	}
+	files, ok := scopeMetricFiles(req, files)
+	if !ok {
+		return nil, false, nil
+	}
+	return redactMetricFiles(files), true, nil
+}
+
+// labelValuesHandler serves /api/v1/label/<name>/values. The __name__ label
+// lists metric names, as in Prometheus.
+func labelValuesHandler(req events.Request) (events.Response, error) {
+	label := req.PathParameters["name"]
+
+	files, ok, err := readPromFiles(req)
+	if err != nil {
+		return promError(500, "internal", fmt.Sprintf("failed to read metrics: %s", err))
+	}
+	if !ok {
+		return events.Reject("bad auth token")
+	}
+
+	seen := map[string]bool{}
+	for _, mf := range files {
+		for _, m := range mf.Metrics {
+			if label == "__name__" {
+				seen[m.Name] = true
+			} else if v, ok := m.Tags[label]; ok {
+				seen[v] = true
+			}
+		}
+	}
+
+	return promSuccess(sortedKeys(seen))
+}
+
+var (
+	selectorNameRegex    = regexp.MustCompile(`^\s*([a-zA-Z_:][\w:]*)?\s*`)
+	selectorMatcherRegex = regexp.MustCompile(`^\s*([a-zA-Z_]\w*)\s*(=~|!~|!=|=)\s*("(?:[^"\\]|\\.)*")\s*,?`)
+)
+
+type labelMatcher struct {
+	name  string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+func (lm labelMatcher) matches(v string) bool {
+	switch lm.op {
+	case "=":
+		return v == lm.value
+	case "!=":
+		return v != lm.value
+	case "=~":
+		return lm.re.MatchString(v)
+	default:
+		return !lm.re.MatchString(v)
+	}
+}
+
+// parseSelector parses a series selector such as up{job="api",env=~"prod.*"}
+func parseSelector(s string) ([]labelMatcher, error) {
+	matchers := []labelMatcher{}
+	loc := selectorNameRegex.FindStringSubmatchIndex(s)
+	if loc[2] != -1 {
+		matchers = append(matchers, labelMatcher{name: "__name__", op: "=", value: s[loc[2]:loc[3]]})
+	}
+	rest := strings.TrimSpace(s[loc[1]:])
+
+	if rest != "" {
+		if !strings.HasPrefix(rest, "{") || !strings.HasSuffix(rest, "}") {
+			return nil, fmt.Errorf("invalid selector: %s", s)
+		}
+		rest = rest[1 : len(rest)-1]
+		for strings.TrimSpace(rest) != "" {
+			m := selectorMatcherRegex.FindStringSubmatch(rest)
+			if m == nil {
+				return nil, fmt.Errorf("invalid matcher in %s", s)
+			}
+			rest = rest[len(m[0]):]
+			value, err := strconv.Unquote(m[3])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %s", m[3])
+			}
+			lm := labelMatcher{name: m[1], op: m[2], value: value}
+			if lm.op == "=~" || lm.op == "!~" {
+				lm.re, err = regexp.Compile("^(?:" + value + ")$")
+				if err != nil {
+					return nil, fmt.Errorf("invalid regex %s: %s", value, err)
+				}
+			}
+			matchers = append(matchers, lm)
+		}
+	}
+
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("empty selector")
+	}
+	return matchers, nil
+}
+
+// seriesLabels returns a metric's labels including __name__
+func seriesLabels(m metric) map[string]string {
+	labels := make(map[string]string, len(m.Tags)+1)
+	for k, v := range m.Tags {
+		labels[k] = v
+	}
+	labels["__name__"] = m.Name
+	return labels
+}
+
+func matchSelector(matchers []labelMatcher, labels map[string]string) bool {
+	for _, lm := range matchers {
+		if !lm.matches(labels[lm.name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// queryValues returns every value of a repeated query parameter
+func queryValues(req events.Request, name string) []string {
+	if values := req.MultiValueQueryStringParameters[name]; len(values) > 0 {
+		return values
+	}
+	if v, ok := req.QueryStringParameters[name]; ok {
+		return []string{v}
+	}
+	return nil
+}
+
+// seriesHandler serves /api/v1/series, listing the label sets of stored
+// series matching any of the match[] selectors
+func seriesHandler(req events.Request) (events.Response, error) {
+	selectors := [][]labelMatcher{}
+	for _, s := range queryValues(req, "match[]") {
+		matchers, err := parseSelector(s)
+		if err != nil {
+			return promError(400, "bad_data", err.Error())
+		}
+		selectors = append(selectors, matchers)
+	}
+	if len(selectors) == 0 {
+		return promError(400, "bad_data", "no match[] parameter provided")
+	}
+
+	files, ok, err := readPromFiles(req)
+	if err != nil {
+		return promError(500, "internal", fmt.Sprintf("failed to read metrics: %s", err))
+	}
+	if !ok {
+		return events.Reject("bad auth token")
+	}
+
+	seen := map[string]bool{}
+	series := []map[string]string{}
+	for _, mf := range files {
+		for _, m := range mf.Metrics {
+			key := seriesKey(m)
+			if seen[key] {
+				continue
+			}
+			labels := seriesLabels(m)
+			for _, matchers := range selectors {
+				if matchSelector(matchers, labels) {
+					seen[key] = true
+					series = append(series, labels)
+					break
+				}
+			}
+		}
+	}
+	return promSuccess(series)
+}
+
+type promMetadata struct {
+	Type string `json:"type"`
+	Help string `json:"help"`
+	Unit string `json:"unit"`
+}
+
+// metadataHandler serves /api/v1/metadata, optionally for one ?metric= and
+// capped at ?limit= metrics
+func metadataHandler(req events.Request) (events.Response, error) {
+	limit := -1
+	if l := req.QueryStringParameters["limit"]; l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil {
+			return promError(400, "bad_data", "invalid limit")
+		}
+		limit = n
+	}
+	only := req.QueryStringParameters["metric"]
+
+	files, ok, err := readPromFiles(req)
+	if err != nil {
+		return promError(500, "internal", fmt.Sprintf("failed to read metrics: %s", err))
+	}
+	if !ok {
+		return events.Reject("bad auth token")
+	}
+
+	metadata := map[string][]promMetadata{}
+	for _, mf := range files {
+		for _, m := range mf.Metrics {
+			if only != "" && m.Name != only {
+				continue
+			}
+			entry := promMetadata{Type: m.Type, Help: m.Help, Unit: m.Unit}
+			if containsMetadata(metadata[m.Name], entry) {
+				continue
+			}
+			if _, ok := metadata[m.Name]; !ok && limit >= 0 && len(metadata) >= limit {
+				continue
+			}
+			metadata[m.Name] = append(metadata[m.Name], entry)
+		}
+	}
+	return promSuccess(metadata)
+}
+
+func containsMetadata(entries []promMetadata, entry promMetadata) bool {
+	for _, e := range entries {
+		if e == entry {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// isProtobufPush matches the metricFile protobuf schema in
+// contrib/metricfile.proto. The Prometheus delimited format, sent as
+// application/vnd.google.protobuf, is only accepted on /metrics/job/.
+func isProtobufPush(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/x-protobuf") ||
+		strings.HasPrefix(contentType, "application/protobuf")
+}
+
+// parseProtoMetricFile decodes a MetricFile message. A name given by the
+// caller is used when the message doesn't carry one.
+func parseProtoMetricFile(name string, body []byte) (metricFile, error) {
+	fields, err := parseProtoMessage(body)
+	if err != nil {
+		return metricFile{}, err
+	}
+
+	mf := metricFile{}
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			mf.FileName = string(f.data)
+		case 2:
+			m, err := parseProtoPushMetric(f.data)
+			if err != nil {
+				return metricFile{}, fmt.Errorf("metric %d: %s", len(mf.Metrics)+1, err)
+			}
+			mf.Metrics = append(mf.Metrics, m)
+		case 3:
+			mf.Status = string(f.data)
+		case 4:
+			mf.CallbackURL = string(f.data)
+		}
+	}
+	if mf.FileName == "" {
+		mf.FileName = name
+	}
+	return mf, nil
+}
+
+func parseProtoPushMetric(b []byte) (metric, error) {
+	fields, err := parseProtoMessage(b)
+	if err != nil {
+		return metric{}, err
+	}
+
+	m := metric{Tags: map[string]string{}, Value: "0"}
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			m.Name = string(f.data)
+		case 2:
+			m.Type = string(f.data)
+		case 3:
+			k, v, err := parseProtoMapEntry(f.data)
+			if err != nil {
+				return metric{}, err
+			}
+			m.Tags[k] = v
+		case 4:
+			m.Value = formatProtoDouble(f.num)
+		case 5:
+			m.Unit = string(f.data)
+		case 6:
+			m.Help = string(f.data)
+		case 7:
+			m.Timestamp = int64(f.num)
+		case 8:
+			e, err := parseProtoExemplar(f.data)
+			if err != nil {
+				return metric{}, err
+			}
+			m.Exemplar = e
+		}
+	}
+	return m, nil
+}
+
+func parseProtoExemplar(b []byte) (*exemplar, error) {
+	fields, err := parseProtoMessage(b)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &exemplar{Labels: map[string]string{}, Value: "0"}
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			k, v, err := parseProtoMapEntry(f.data)
+			if err != nil {
+				return nil, err
+			}
+			e.Labels[k] = v
+		case 2:
+			e.Value = formatProtoDouble(f.num)
+		case 3:
+			e.Timestamp = int64(f.num)
+		}
+	}
+	return e, nil
+}
+
+// parseProtoMapEntry decodes a map<string, string> entry
+func parseProtoMapEntry(b []byte) (string, string, error) {
+	fields, err := parseProtoMessage(b)
+	if err != nil {
+		return "", "", err
+	}
+	var k, v string
+	for _, f := range fields {
+		if f.number == 1 {
+			k = string(f.data)
+		} else if f.number == 2 {
+			v = string(f.data)
+		}
+	}
+	return k, v, nil
+}
+
+func formatProtoDouble(bits uint64) string {
+	return formatValue(math.Float64frombits(bits))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Minimal protobuf wire encoding and decoding, enough to handle the Prometheus
+// client model messages without pulling in the protobuf runtime.
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+func appendVarint(b []byte, v uint64) []byte {
+	return binary.AppendUvarint(b, v)
+}
+
+func appendProtoTag(b []byte, field int, wireType int) []byte {
+	return appendVarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	b = appendProtoTag(b, field, wireVarint)
+	return appendVarint(b, v)
+}
+
+func appendProtoDouble(b []byte, field int, v float64) []byte {
+	b = appendProtoTag(b, field, wireFixed64)
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = appendProtoTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendProtoString(b []byte, field int, v string) []byte {
+	return appendProtoBytes(b, field, []byte(v))
+}
+
+// protoField is one decoded field. Varint and fixed64 values are held in
+// num; length-delimited values in data.
+type protoField struct {
+	number int
+	num    uint64
+	data   []byte
+}
+
+// parseProtoMessage splits an encoded message into its fields
+func parseProtoMessage(b []byte) ([]protoField, error) {
+	fields := []protoField{}
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("malformed field tag")
+		}
+		b = b[n:]
+		f := protoField{number: int(tag >> 3)}
+
+		switch tag & 7 {
+		case wireVarint:
+			f.num, n = binary.Uvarint(b)
+			if n <= 0 {
+				return nil, fmt.Errorf("malformed varint in field %d", f.number)
+			}
+			b = b[n:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return nil, fmt.Errorf("truncated field %d", f.number)
+			}
+			f.num = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case wireBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				return nil, fmt.Errorf("truncated field %d", f.number)
+			}
+			f.data = b[n : n+int(length)]
+			b = b[n+int(length):]
+		case wireFixed32:
+			if len(b) < 4 {
+				return nil, fmt.Errorf("truncated field %d", f.number)
+			}
+			f.num = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			return nil, fmt.Errorf("unsupported wire type in field %d", f.number)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// splitDelimited splits a stream of varint length-prefixed messages
+func splitDelimited(b []byte) ([][]byte, error) {
+	messages := [][]byte{}
+	for len(b) > 0 {
+		length, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < length {
+			return nil, fmt.Errorf("truncated message")
+		}
+		messages = append(messages, b[n:n+int(length)])
+		b = b[n+int(length):]
+	}
+	return messages, nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const pushgatewayPrefix = "pushgateway"
+
+// parseGroupingKey converts the path after /metrics/ into grouping labels.
+// Values may be base64url encoded by suffixing the label name with @base64,
+// as with the Pushgateway.
+func parseGroupingKey(path string) (map[string]string, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts)%2 != 0 {
+		return nil, fmt.Errorf("grouping key must be label/value pairs")
+	}
+
+	labels := map[string]string{}
+	for i := 0; i < len(parts); i += 2 {
+		name, value := parts[i], parts[i+1]
+		if strings.HasSuffix(name, "@base64") {
+			name = strings.TrimSuffix(name, "@base64")
+			decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+			if err != nil {
+				return nil, fmt.Errorf("invalid base64 value for %s", name)
+			}
+			value = string(decoded)
+		}
+		labels[name] = value
+	}
+	if labels["job"] == "" {
+		return nil, fmt.Errorf("job is required")
+	}
+	return labels, nil
+}
+
+// groupFileName maps a grouping key to a stable file name
+func groupFileName(labels map[string]string) string {
+	name := pushgatewayPrefix + "/job/" + labels["job"]
+	for _, pair := range strings.Split(labelString(labels), ";") {
+		kv := strings.SplitN(pair, "=", 2)
+		if kv[0] == "job" {
+			continue
+		}
+		name += "/" + kv[0] + "/" + kv[1]
+	}
+	return name
+}
+
+// pushgatewayHandler mirrors the Pushgateway push API under
+// /metrics/job/<job>/<label>/<value>... PUT replaces the group, POST
+// replaces only the pushed metric names, and DELETE removes the group if
+// the requesting token pushed it.
+func pushgatewayHandler(req events.Request) (events.Response, error) {
+	labels, err := parseGroupingKey("job/" + req.PathParameters["key"])
+	if err != nil {
+		return events.Respond(400, err.Error())
+	}
+	name := groupFileName(labels)
+
+	if req.HTTPMethod == "DELETE" {
+		client, err := getClient()
+		if err != nil {
+			return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+		}
+		old, err := readMetricFile(client, name)
+		if errors.Is(err, errMetricFileMissing) {
+			return events.Respond(202, "")
+		} else if err != nil {
+			return events.Fail(fmt.Sprintf("failed to read group: %s", err))
+		}
+		token, _ := identifyToken(req)
+		if old.Source != nil && old.Source.Token != "" && old.Source.Token != token {
+			return events.Reject("group was pushed by another token")
+		}
+		err = deleteMetricFile(client, name)
+		if err != nil {
+			return events.Fail(fmt.Sprintf("failed to delete: %s", err))
+		}
+		return events.Respond(202, "")
+	}
+	if req.HTTPMethod != "PUT" && req.HTTPMethod != "POST" {
+		return events.Respond(405, "pushgateway API requires PUT, POST, or DELETE")
+	}
+
+	body, err := req.DecodedBody()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+	}
+	if max := effectiveJSONLimits().MaxBodyBytes; len(body) > max {
+		return events.Respond(400, fmt.Sprintf("rejected body: body exceeds %d bytes", max))
+	}
+
+	var mf metricFile
+	if strings.HasPrefix(requestHeader(req, "Content-Type"), "application/vnd.google.protobuf") {
+		mf, err = parseProtoFamilies(name, []byte(body))
+	} else {
+		mf, err = parseExposition(name, body)
+	}
+	if err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to parse: %s", err))
+	}
+
+	for i := range mf.Metrics {
+		for k, v := range labels {
+			mf.Metrics[i].Tags[k] = v
+		}
+	}
+	mf.mergeExisting = req.HTTPMethod == "POST"
+	return pushMetricFile(req, mf)
+}
+
+// parseProtoFamilies decodes delimited io.prometheus.client.MetricFamily
+// messages, as sent by the Prometheus client libraries
+func parseProtoFamilies(name string, body []byte) (metricFile, error) {
+	messages, err := splitDelimited(body)
+	if err != nil {
+		return metricFile{}, err
+	}
+
+	mf := metricFile{FileName: name}
+	for _, msg := range messages {
+		fields, err := parseProtoMessage(msg)
+		if err != nil {
+			return metricFile{}, err
+		}
+
+		var family, help string
+		var kind uint64
+		var samples [][]byte
+		for _, f := range fields {
+			switch f.number {
+			case 1:
+				family = string(f.data)
+			case 2:
+				help = string(f.data)
+			case 3:
+				kind = f.num
+			case 4:
+				samples = append(samples, f.data)
+			}
+		}
+
+		typeName := "untyped"
+		for t, v := range protobufTypes {
+			if v == kind {
+				typeName = t
+			}
+		}
+		for _, s := range samples {
+			m, err := parseProtoMetric(s)
+			if err != nil {
+				return metricFile{}, fmt.Errorf("%s: %s", family, err)
+			}
+			m.Name = family
+			m.Type = typeName
+			m.Help = help
+			mf.Metrics = append(mf.Metrics, m)
+		}
+	}
+	return mf, nil
+}
+
+func parseProtoMetric(b []byte) (metric, error) {
+	fields, err := parseProtoMessage(b)
+	if err != nil {
+		return metric{}, err
+	}
+
+	m := metric{Tags: map[string]string{}}
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			label, err := parseProtoMessage(f.data)
+			if err != nil {
+				return metric{}, err
+			}
+			var k, v string
+			for _, lf := range label {
+				if lf.number == 1 {
+					k = string(lf.data)
+				} else if lf.number == 2 {
+					v = string(lf.data)
+				}
+			}
+			m.Tags[k] = v
+		case 2, 3, 5:
+			value, err := parseProtoMessage(f.data)
+			if err != nil {
+				return metric{}, err
+			}
+			for _, vf := range value {
+				if vf.number == 1 {
+					m.Value = formatValue(math.Float64frombits(vf.num))
+				}
+			}
+		case 4:
+			if m.Summary, err = parseProtoSummary(f.data); err != nil {
+				return metric{}, err
+			}
+		case 6:
+			m.Timestamp = int64(f.num)
+		case 7:
+			if m.Histogram, err = parseProtoHistogram(f.data); err != nil {
+				return metric{}, err
+			}
+		}
+	}
+	if m.Value == "" && m.Summary == nil && m.Histogram == nil {
+		m.Value = "0"
+	}
+	return m, nil
+}
+
+// parseProtoSummary decodes an io.prometheus.client.Summary
+func parseProtoSummary(b []byte) (*summary, error) {
+	fields, err := parseProtoMessage(b)
+	if err != nil {
+		return nil, err
+	}
+	s := &summary{Sum: "0", Quantiles: map[string]string{}}
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			s.Count = f.num
+		case 2:
+			s.Sum = formatValue(math.Float64frombits(f.num))
+		case 3:
+			entry, err := parseProtoMessage(f.data)
+			if err != nil {
+				return nil, err
+			}
+			var quantile, value float64
+			for _, ef := range entry {
+				if ef.number == 1 {
+					quantile = math.Float64frombits(ef.num)
+				} else if ef.number == 2 {
+					value = math.Float64frombits(ef.num)
+				}
+			}
+			s.Quantiles[formatValue(quantile)] = formatValue(value)
+		}
+	}
+	return s, nil
+}
+
+// parseProtoHistogram decodes an io.prometheus.client.Histogram. The client
+// libraries leave out the +Inf bucket, so it is added from the count.
+func parseProtoHistogram(b []byte) (*histogram, error) {
+	fields, err := parseProtoMessage(b)
+	if err != nil {
+		return nil, err
+	}
+	h := &histogram{Sum: "0"}
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			h.Count = f.num
+		case 2:
+			h.Sum = formatValue(math.Float64frombits(f.num))
+		case 3:
+			bucket, err := parseProtoMessage(f.data)
+			if err != nil {
+				return nil, err
+			}
+			var hb histogramBucket
+			var le float64
+			for _, bf := range bucket {
+				if bf.number == 1 {
+					hb.Count = bf.num
+				} else if bf.number == 2 {
+					le = math.Float64frombits(bf.num)
+				}
+			}
+			hb.LE = formatValue(le)
+			h.Buckets = append(h.Buckets, hb)
+		}
+	}
+	if n := len(h.Buckets); n == 0 || h.Buckets[n-1].LE != "+Inf" {
+		h.Buckets = append(h.Buckets, histogramBucket{LE: "+Inf", Count: h.Count})
+	}
+	return h, nil
+}
+
+// mergeExistingMetrics keeps the stored metrics whose names aren't in the
+// push, matching the Pushgateway's POST semantics
+func mergeExistingMetrics(client *s3.Client, mf *metricFile) error {
+	old, err := readMetricFile(client, mf.FileName)
+	if errors.Is(err, errMetricFileMissing) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	pushed := map[string]bool{}
+	for _, m := range mf.Metrics {
+		pushed[m.Name] = true
+	}
+	merged := []metric{}
+	for _, m := range old.Metrics {
+		if !pushed[m.Name] {
+			merged = append(merged, m)
+		}
+	}
+	mf.Metrics = append(merged, mf.Metrics...)
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+const quickTagPrefix = "tag."
+
+// quickPushHandler pushes a single metric from the query string, for clients
+// that can only make a plain GET. ?name= and ?value= are required; ?type=
+// (default gauge), ?help=, ?unit=, and tag.<key>= params are optional. The
+// metric is stored in the file given by ?file=, defaulting to its name, and
+// other series in that file are kept.
+func quickPushHandler(req events.Request) (events.Response, error) {
+	if c.ReadOnly {
+		return events.Respond(503, "this deployment is read-only")
+	}
+
+	params := req.QueryStringParameters
+	m := metric{
+		Name:  params["name"],
+		Type:  params["type"],
+		Help:  params["help"],
+		Unit:  params["unit"],
+		Value: params["value"],
+		Tags:  map[string]string{},
+	}
+	if m.Name == "" || m.Value == "" {
+		return events.Respond(400, "quick pushes require ?name= and ?value=")
+	}
+	if m.Type == "" {
+		m.Type = "gauge"
+	}
+
+	for k, v := range params {
+		if tag := strings.TrimPrefix(k, quickTagPrefix); tag != k {
+			m.Tags[tag] = v
+		}
+	}
+
+	file := params["file"]
+	if file == "" {
+		file = m.Name
+	}
+	mf := metricFile{FileName: file, Metrics: []metric{m}}
+	mf.mergeSeries = true
+	return pushMetricFile(req, mf)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const quotaObject = "quota_usage.json"
+
+// quotaUsage tracks stored series and bytes per token, keyed by file name
+type quotaUsage map[string]map[string]fileUsage
+
+type fileUsage struct {
+	Series int   `json:"series"`
+	Bytes  int64 `json:"bytes"`
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+var (
+	rateLock    sync.Mutex
+	rateWindows = map[string]*rateWindow{}
+)
+
+func (t tokenConfig) hasQuota() bool {
+	return t.SeriesQuota > 0 || t.BytesQuota > 0
+}
+
+// takeRate consumes one push from the token's per-minute window. Windows are
+// held per container, so the limit is enforced approximately across Lambdas.
+func takeRate(t tokenConfig, now time.Time) (int, bool) {
+	rateLock.Lock()
+	defer rateLock.Unlock()
+
+	w, ok := rateWindows[t.Name]
+	if !ok || now.Sub(w.start) >= time.Minute {
+		w = &rateWindow{start: now}
+		rateWindows[t.Name] = w
+	}
+	if w.count >= t.RateLimit {
+		return 0, false
+	}
+	w.count++
+	return t.RateLimit - w.count, true
+}
+
+func usageFor(mf metricFile) (fileUsage, error) {
+	content, err := json.Marshal(mf.Metrics)
+	if err != nil {
+		return fileUsage{}, err
+	}
+	return fileUsage{Series: len(mf.Metrics), Bytes: int64(len(content))}, nil
+}
+
+// checkQuota enforces the pushing token's rate limit and storage quotas,
+// recording the remaining headroom on the metricFile for the response.
+func checkQuota(req events.Request, client *s3.Client, mf *metricFile) *pushResult {
+	t, ok := lookupToken(req)
+	if !ok || (t.RateLimit == 0 && !t.hasQuota()) {
+		return nil
+	}
+	mf.quota = map[string]string{}
+
+	if t.RateLimit > 0 {
+		remaining, ok := takeRate(t, time.Now())
+		mf.quota["X-RateLimit-Remaining"] = strconv.Itoa(remaining)
+		if !ok {
+			return rejectPush(*mf, 429, "rate limit exceeded")
+		}
+	}
+
+	if !t.hasQuota() {
+		return nil
+	}
+
+	usage := quotaUsage{}
+	_, err := readInternalObject(client, quotaObject, &usage)
+	if err != nil {
+		return rejectPush(*mf, 500, fmt.Sprintf("failed to load quota usage: %s", err))
+	}
+	current, err := usageFor(*mf)
+	if err != nil {
+		return rejectPush(*mf, 500, fmt.Sprintf("failed to size push: %s", err))
+	}
+
+	total := current
+	for name, u := range usage[t.Name] {
+		if name == mf.FileName {
+			continue
+		}
+		total.Series += u.Series
+		total.Bytes += u.Bytes
+	}
+
+	var reason string
+	if t.SeriesQuota > 0 {
+		remaining := t.SeriesQuota - total.Series
+		if remaining < 0 {
+			reason = fmt.Sprintf("series quota of %d exceeded", t.SeriesQuota)
+			remaining = 0
+		}
+		mf.quota["X-Series-Quota-Remaining"] = strconv.Itoa(remaining)
+	}
+	if t.BytesQuota > 0 {
+		remaining := t.BytesQuota - total.Bytes
+		if remaining < 0 {
+			if reason == "" {
+				reason = fmt.Sprintf("bytes quota of %d exceeded", t.BytesQuota)
+			}
+			remaining = 0
+		}
+		mf.quota["X-Bytes-Quota-Remaining"] = strconv.FormatInt(remaining, 10)
+	}
+	if reason != "" {
+		return rejectPush(*mf, 429, reason)
+	}
+
+	mf.quotaToken = t.Name
+	mf.quotaUsage = current
+	return nil
+}
+
+// recordUsage persists the stored file's size against its token's quota,
+// and frees it from any other token that pushed the file before
+func recordUsage(client *s3.Client, mf metricFile) error {
+	if mf.quotaToken == "" && !quotasConfigured() {
+		return nil
+	}
+	return editQuotaUsage(client, func(usage quotaUsage) bool {
+		changed := false
+		for token, files := range usage {
+			if _, ok := files[mf.FileName]; ok && token != mf.quotaToken {
+				delete(files, mf.FileName)
+				changed = true
+			}
+		}
+		if mf.quotaToken != "" {
+			if usage[mf.quotaToken] == nil {
+				usage[mf.quotaToken] = map[string]fileUsage{}
+			}
+			usage[mf.quotaToken][mf.FileName] = mf.quotaUsage
+			changed = true
+		}
+		return changed
+	})
+}
+
+// removeUsage frees a deleted file's usage from every token's quota
+func removeUsage(client *s3.Client, file string) error {
+	return editQuotaUsage(client, func(usage quotaUsage) bool {
+		changed := false
+		for _, files := range usage {
+			if _, ok := files[file]; ok {
+				delete(files, file)
+				changed = true
+			}
+		}
+		return changed
+	})
+}
+
+// quotasConfigured reports whether any token has a storage quota, which is
+// when usage has to be kept current
+func quotasConfigured() bool {
+	for _, t := range c.Tokens {
+		if t.hasQuota() {
+			return true
+		}
+	}
+	return false
+}
+
+// editQuotaUsage applies edit to the stored usage, writing it back only if
+// edit reports a change
+func editQuotaUsage(client *s3.Client, edit func(quotaUsage) bool) error {
+	release, err := lockFile(internalPrefix + quotaObject)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	usage := quotaUsage{}
+	_, err = readInternalObject(client, quotaObject, &usage)
+	if err != nil {
+		return err
+	}
+	if !edit(usage) {
+		return nil
+	}
+	return writeInternalObject(client, quotaObject, usage)
+}
+
+func withQuotaHeaders(resp events.Response, quota map[string]string) events.Response {
+	if len(quota) == 0 {
+		return resp
+	}
+	if resp.Headers == nil {
+		resp.Headers = map[string]string{}
+	}
+	for k, v := range quota {
+		resp.Headers[k] = v
+	}
+	return resp
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	reconcileObject = "reconcile.json"
+
+	// reconcileCacheTTL bounds how often scrapes re-read the last result
+	reconcileCacheTTL = time.Minute
+)
+
+// reconcileReport is the outcome of comparing the manifest with the bucket.
+// Missing files are stored but absent from the manifest, extra files are in
+// the manifest but no longer stored, and stale files have a recorded size
+// that doesn't match the stored object.
+type reconcileReport struct {
+	ReconciledAt int64    `json:"reconciled_at"`
+	Rebuilt      bool     `json:"rebuilt"`
+	Missing      []string `json:"missing"`
+	Extra        []string `json:"extra"`
+	Stale        []string `json:"stale"`
+}
+
+type manifestDrift struct {
+	File string `json:"file"`
+	Kind string `json:"kind"`
+}
+
+var (
+	reconcileLock    sync.Mutex
+	reconcileCache   reconcileReport
+	reconcileChecked time.Time
+	reconcileBucket  string
+)
+
+// reconcileManifest repairs drift between the manifest and a full bucket
+// listing, which pushes that failed to update the manifest or objects
+// changed outside the exporter leave behind
+func reconcileManifest(client *s3.Client) (reconcileReport, error) {
+	report := reconcileReport{
+		ReconciledAt: time.Now().Unix(),
+		Missing:      []string{},
+		Extra:        []string{},
+		Stale:        []string{},
+	}
+
+	objects, err := listMetricObjects(client)
+	if err != nil {
+		return report, err
+	}
+
+	release, err := lockFile(internalPrefix + manifestObject)
+	if err != nil {
+		return report, err
+	}
+	m := newManifest()
+	found, err := readInternalObject(client, manifestObject, &m)
+	release()
+	if err != nil {
+		return report, err
+	}
+	if !found {
+		if _, err := rebuildManifest(client); err != nil {
+			return report, err
+		}
+		report.Rebuilt = true
+		return report, saveReconcileReport(client, report)
+	}
+
+	stored := map[string]bool{}
+	changed := []string{}
+	for _, obj := range objects {
+		stored[*obj.Key] = true
+		size, ok := m.Sizes[*obj.Key]
+		if !ok {
+			report.Missing = append(report.Missing, *obj.Key)
+			changed = append(changed, *obj.Key)
+		} else if size != obj.Size {
+			report.Stale = append(report.Stale, *obj.Key)
+			changed = append(changed, *obj.Key)
+		}
+	}
+	indexed := map[string]bool{}
+	for file := range m.Sizes {
+		indexed[file] = true
+	}
+	for _, files := range m.Families {
+		for _, file := range files {
+			indexed[file] = true
+		}
+	}
+	for file := range indexed {
+		if !stored[file] {
+			report.Extra = append(report.Extra, file)
+		}
+	}
+	sort.Strings(report.Extra)
+
+	files := map[string]metricFile{}
+	for _, name := range changed {
+		mf, err := readMetricFile(client, name)
+		if errors.Is(err, errMetricFileMissing) {
+			continue
+		} else if err != nil {
+			return report, err
+		}
+		files[name] = mf
+	}
+
+	err = editManifest(client, func(m *metricManifest) {
+		for _, file := range report.Extra {
+			m.remove(file)
+		}
+		for _, file := range changed {
+			m.remove(file)
+			if mf, ok := files[file]; ok {
+				m.add(mf)
+			}
+		}
+	})
+	if err != nil {
+		return report, err
+	}
+
+	for kind, list := range map[string][]string{"missing": report.Missing, "extra": report.Extra, "stale": report.Stale} {
+		for _, file := range list {
+			tracef("reconcile: %s %s", kind, file)
+			if err := publishEvent("Manifest Drift", manifestDrift{File: file, Kind: kind}); err != nil {
+				fmt.Printf("failed to publish manifest drift event: %s\n", err)
+			}
+		}
+	}
+	return report, saveReconcileReport(client, report)
+}
+
+func saveReconcileReport(client *s3.Client, report reconcileReport) error {
+	reconcileLock.Lock()
+	defer reconcileLock.Unlock()
+	reconcileCache = report
+	reconcileChecked = time.Now()
+	reconcileBucket = c.MetricBucket
+	return writeInternalObject(client, reconcileObject, report)
+}
+
+func loadReconcileReport() (reconcileReport, error) {
+	reconcileLock.Lock()
+	defer reconcileLock.Unlock()
+
+	if reconcileBucket == c.MetricBucket && time.Since(reconcileChecked) < reconcileCacheTTL {
+		traceCache("reconcile_hit")
+		return reconcileCache, nil
+	}
+	traceCache("reconcile_miss")
+
+	client, err := getClient()
+	if err != nil {
+		return reconcileReport{}, err
+	}
+	var report reconcileReport
+	_, err = readInternalObject(client, reconcileObject, &report)
+	if err != nil {
+		return reconcileReport{}, err
+	}
+	reconcileCache = report
+	reconcileChecked = time.Now()
+	reconcileBucket = c.MetricBucket
+	return report, nil
+}
+
+func reconcileMetrics() []metric {
+	report, err := loadReconcileReport()
+	if err != nil {
+		fmt.Printf("failed to load reconcile report: %s\n", err)
+		return []metric{}
+	}
+	if report.ReconciledAt == 0 {
+		return []metric{}
+	}
+
+	metrics := []metric{{
+		Name:  "hook_exporter_manifest_reconciled_timestamp_seconds",
+		Type:  "gauge",
+		Value: fmt.Sprintf("%d", report.ReconciledAt),
+	}}
+	counts := map[string]int{
+		"missing": len(report.Missing),
+		"extra":   len(report.Extra),
+		"stale":   len(report.Stale),
+	}
+	for _, kind := range []string{"missing", "extra", "stale"} {
+		metrics = append(metrics, metric{
+			Name:  "hook_exporter_manifest_drift_files",
+			Type:  "gauge",
+			Tags:  map[string]string{"kind": kind},
+			Value: fmt.Sprintf("%d", counts[kind]),
+		})
+	}
+	return metrics
+}
+
+// reconcileHandler returns the last reconciliation report on GET and runs a
+// new reconciliation on POST
+func reconcileHandler(req events.Request) (events.Response, error) {
+	if req.HTTPMethod == "POST" {
+		client, err := getClient()
+		if err != nil {
+			return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+		}
+		report, err := reconcileManifest(client)
+		if err != nil {
+			return events.Fail(fmt.Sprintf("failed to reconcile: %s", err))
+		}
+		return respondJSON(200, report)
+	}
+
+	report, err := loadReconcileReport()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load report: %s", err))
+	}
+	return respondJSON(200, report)
+}
+
+func runReconcileJob() error {
+	client, err := getClient()
+	if err != nil {
+		return err
+	}
+	_, err = reconcileManifest(client)
+	return err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+)
+
+type labelRule struct {
+	Label   string `json:"label"`
+	Action  string `json:"action"`
+	Pattern string `json:"pattern"`
+	Salt    string `json:"salt"`
+}
+
+const redactedValue = "redacted"
+
+// redactMetricFiles applies the configured label rules to a copy of the files,
+// leaving the stored objects untouched.
+func redactMetricFiles(files []metricFile) []metricFile {
+	if len(c.LabelRules) == 0 {
+		return files
+	}
+
+	rules := map[string][]labelRule{}
+	patterns := map[string]*regexp.Regexp{}
+	for _, r := range c.LabelRules {
+		if r.Pattern != "" {
+			re, err := regexp.Compile(r.Pattern)
+			if err != nil {
+				fmt.Printf("skipping label rule for %s: %s\n", r.Label, err)
+				continue
+			}
+			patterns[r.Pattern] = re
+		}
+		rules[r.Label] = append(rules[r.Label], r)
+	}
+
+	result := make([]metricFile, len(files))
+	for i, mf := range files {
+		result[i] = mf
+		result[i].Metrics = make([]metric, len(mf.Metrics))
+		for j, m := range mf.Metrics {
+			result[i].Metrics[j] = m
+			if len(m.Tags) == 0 {
+				continue
+			}
+			tags := make(map[string]string, len(m.Tags))
+			for k, v := range m.Tags {
+				tags[k] = applyLabelRules(rules[k], patterns, v)
+			}
+			result[i].Metrics[j].Tags = tags
+		}
+	}
+	return result
+}
+
+func applyLabelRules(rules []labelRule, patterns map[string]*regexp.Regexp, value string) string {
+	for _, r := range rules {
+		if r.Pattern != "" {
+			re, ok := patterns[r.Pattern]
+			if !ok || !re.MatchString(value) {
+				continue
+			}
+		}
+		switch r.Action {
+		case "hash":
+			sum := sha256.Sum256([]byte(r.Salt + value))
+			return hex.EncodeToString(sum[:])[:16]
+		case "redact":
+			return redactedValue
+		}
+	}
+	return value
+}
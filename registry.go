@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const registryObject = "registry.json"
+
+type registryRequest struct {
+	Names []string `json:"names"`
+}
+
+func loadRegistry(client *s3.Client) (map[string]bool, error) {
+	var names []string
+	_, err := readInternalObject(client, registryObject, &names)
+	if err != nil {
+		return nil, err
+	}
+
+	registry := map[string]bool{}
+	for _, n := range c.RegisteredFiles {
+		registry[n] = true
+	}
+	for _, n := range names {
+		registry[n] = true
+	}
+	return registry, nil
+}
+
+// checkRegistration rejects pushes to unregistered file names when
+// registration is required, suggesting a close match if there is one.
+func checkRegistration(client *s3.Client, name string) error {
+	if !c.RequireRegistration {
+		return nil
+	}
+
+	registry, err := loadRegistry(client)
+	if err != nil {
+		return fmt.Errorf("failed to load registry: %s", err)
+	}
+	if registry[name] {
+		return nil
+	}
+
+	msg := fmt.Sprintf(
+		"file %s is not registered; add it via POST /admin/registry or registered_files in config",
+		name,
+	)
+	if suggestion := closestName(name, registry); suggestion != "" {
+		msg += fmt.Sprintf(" (did you mean %s?)", suggestion)
+	}
+	return fmt.Errorf("%s", msg)
+}
+
+func closestName(name string, registry map[string]bool) string {
+	best := ""
+	bestDistance := 4
+	for n := range registry {
+		if d := levenshtein(name, n); d < bestDistance {
+			best = n
+			bestDistance = d
+		}
+	}
+	return best
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// registryHandler lists registered file names on GET, adds names on POST,
+// and removes them on DELETE. Names from config are always registered.
+func registryHandler(req events.Request) (events.Response, error) {
+	client, err := getClient()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+	}
+
+	var stored []string
+	_, err = readInternalObject(client, registryObject, &stored)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load registry: %s", err))
+	}
+
+	if req.HTTPMethod == "POST" || req.HTTPMethod == "DELETE" {
+		body, err := req.DecodedBody()
+		if err != nil {
+			return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+		}
+		var rr registryRequest
+		err = json.Unmarshal([]byte(body), &rr)
+		if err != nil {
+			return events.Fail(fmt.Sprintf("failed to unmarshal: %s", err))
+		}
+
+		set := map[string]bool{}
+		for _, n := range stored {
+			set[n] = true
+		}
+		for _, n := range rr.Names {
+			n = strings.TrimSpace(n)
+			if n == "" || strings.HasPrefix(n, internalPrefix) {
+				return events.Respond(400, fmt.Sprintf("invalid file name: %q", n))
+			}
+			set[n] = req.HTTPMethod == "POST"
+		}
+		stored = []string{}
+		for n, ok := range set {
+			if ok {
+				stored = append(stored, n)
+			}
+		}
+		sort.Strings(stored)
+
+		err = writeInternalObject(client, registryObject, stored)
+		if err != nil {
+			return events.Fail(fmt.Sprintf("failed to write registry: %s", err))
+		}
+	}
+
+	all := append([]string{}, stored...)
+	all = append(all, c.RegisteredFiles...)
+	sort.Strings(all)
+	return respondJSON(200, map[string]interface{}{
+		"required": c.RequireRegistration,
+		"files":    all,
+	})
+}
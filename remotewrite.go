@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/golang/snappy"
+)
+
+const defaultRemoteWriteFile = "remote_write"
+
+// staleMarker is the NaN Prometheus sends when a series goes stale, which
+// is distinct from a NaN sample
+const staleMarker = 0x7ff0000000000002
+
+// remoteWriteTypes maps prometheus.MetricMetadata.MetricType to our types.
+// Histogram and summary families arrive as their component series, which
+// are folded back together.
+var remoteWriteTypes = map[uint64]string{
+	1: "counter",
+	2: "gauge",
+	3: "histogram",
+	5: "summary",
+	6: "info",
+	7: "stateset",
+}
+
+// remoteWriteHandler accepts Prometheus remote_write requests and stores the
+// latest sample of each series in the file given by ?name=, defaulting to
+// remote_write. Series not in the request are kept.
+func remoteWriteHandler(req events.Request) (events.Response, error) {
+	name := req.QueryStringParameters["name"]
+	if name == "" {
+		name = defaultRemoteWriteFile
+	}
+
+	body, err := req.DecodedBody()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+	}
+	size, err := snappy.DecodedLen([]byte(body))
+	if err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to decompress: %s", err))
+	}
+	if max := effectiveJSONLimits().MaxBodyBytes; size > max {
+		return events.Respond(400, fmt.Sprintf("rejected body: body exceeds %d bytes", max))
+	}
+	decoded, err := snappy.Decode(nil, []byte(body))
+	if err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to decompress: %s", err))
+	}
+
+	mf, err := parseWriteRequest(name, decoded)
+	if err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to parse: %s", err))
+	}
+	mf.mergeSeries = true
+	return pushMetricFile(req, mf)
+}
+
+// parseWriteRequest decodes a prometheus.WriteRequest, keeping the newest
+// sample of each series and dropping staleness markers. The series of
+// histogram and summary families are folded as in text pushes.
+func parseWriteRequest(name string, b []byte) (metricFile, error) {
+	fields, err := parseProtoMessage(b)
+	if err != nil {
+		return metricFile{}, err
+	}
+
+	types := map[string]string{}
+	helps := map[string]string{}
+	for _, f := range fields {
+		if f.number != 3 {
+			continue
+		}
+		meta, err := parseProtoMessage(f.data)
+		if err != nil {
+			return metricFile{}, err
+		}
+		var family, help string
+		var kind uint64
+		for _, mf := range meta {
+			switch mf.number {
+			case 1:
+				kind = mf.num
+			case 2:
+				family = string(mf.data)
+			case 4:
+				help = string(mf.data)
+			}
+		}
+		if t, ok := remoteWriteTypes[kind]; ok {
+			types[family] = t
+		}
+		helps[family] = help
+	}
+
+	series := map[string]metric{}
+	for _, f := range fields {
+		if f.number != 1 {
+			continue
+		}
+		m, ok, err := parseTimeSeries(f.data)
+		if err != nil {
+			return metricFile{}, err
+		}
+		if !ok {
+			continue
+		}
+		key := seriesKey(m)
+		if existing, ok := series[key]; ok && existing.Timestamp > m.Timestamp {
+			continue
+		}
+		series[key] = m
+	}
+
+	keys := make([]string, 0, len(series))
+	for k := range series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	mf := metricFile{FileName: name}
+	for _, k := range keys {
+		m := series[k]
+		m.Type = types[m.Name]
+		if m.Type == "" {
+			m.Type = "untyped"
+		}
+		m.Help = helps[m.Name]
+		mf.Metrics = append(mf.Metrics, m)
+	}
+	mf.Metrics, err = foldSamples(mf.Metrics, types, helps)
+	if err != nil {
+		return metricFile{}, err
+	}
+	return mf, nil
+}
+
+// parseTimeSeries returns the newest sample of a prometheus.TimeSeries. It
+// reports false if the series has no usable samples.
+func parseTimeSeries(b []byte) (metric, bool, error) {
+	fields, err := parseProtoMessage(b)
+	if err != nil {
+		return metric{}, false, err
+	}
+
+	m := metric{Tags: map[string]string{}}
+	found := false
+	var value float64
+	for _, f := range fields {
+		switch f.number {
+		case 1:
+			label, err := parseProtoMessage(f.data)
+			if err != nil {
+				return metric{}, false, err
+			}
+			var k, v string
+			for _, lf := range label {
+				if lf.number == 1 {
+					k = string(lf.data)
+				} else if lf.number == 2 {
+					v = string(lf.data)
+				}
+			}
+			if k == "__name__" {
+				m.Name = v
+			} else {
+				m.Tags[k] = v
+			}
+		case 2:
+			sample, err := parseProtoMessage(f.data)
+			if err != nil {
+				return metric{}, false, err
+			}
+			var v float64
+			var ts int64
+			for _, sf := range sample {
+				if sf.number == 1 {
+					v = math.Float64frombits(sf.num)
+				} else if sf.number == 2 {
+					ts = int64(sf.num)
+				}
+			}
+			if math.Float64bits(v) == staleMarker || (found && ts < m.Timestamp) {
+				continue
+			}
+			found = true
+			value = v
+			m.Timestamp = ts
+		}
+	}
+	if m.Name == "" {
+		return metric{}, false, fmt.Errorf("series is missing __name__")
+	}
+	m.Value = formatValue(value)
+	return m, found, nil
+}
+
+// mergeExistingSeries keeps stored series that weren't pushed, and stored
+// samples that are newer than the pushed ones. Prometheus sends metadata
+// apart from samples, so untyped series of families stored as histograms
+// or summaries are folded using the stored types.
+func mergeExistingSeries(client *s3.Client, mf *metricFile) error {
+	old, err := readMetricFile(client, mf.FileName)
+	if errors.Is(err, errMetricFileMissing) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	types := map[string]string{}
+	helps := map[string]string{}
+	for _, m := range old.Metrics {
+		if m.Histogram != nil || m.Summary != nil {
+			types[m.Name] = m.Type
+			helps[m.Name] = m.Help
+		}
+	}
+	if len(types) > 0 {
+		if mf.Metrics, err = foldSamples(mf.Metrics, types, helps); err != nil {
+			return err
+		}
+	}
+
+	// Component series stored before their family's type was known are
+	// replaced by the folded family
+	folded := map[string]string{}
+	for _, m := range mf.Metrics {
+		if m.Histogram != nil || m.Summary != nil {
+			folded[m.Name] = m.Type
+		}
+	}
+	kept := []metric{}
+	for _, m := range old.Metrics {
+		if _, _, kind := sampleFamily(m.Name, folded); kind != "" && m.Histogram == nil && m.Summary == nil {
+			continue
+		}
+		kept = append(kept, m)
+	}
+	mergeSeriesInto(kept, mf)
+	return nil
+}
+
+func mergeSeriesInto(old []metric, mf *metricFile) {
+	pushed := map[string]int{}
+	for i, m := range mf.Metrics {
+		pushed[seriesKey(m)] = i
+	}
+	merged := []metric{}
+	for _, m := range old {
+		i, ok := pushed[seriesKey(m)]
+		if !ok {
+			merged = append(merged, m)
+		} else if m.Timestamp > mf.Metrics[i].Timestamp {
+			mf.Metrics[i] = m
+		}
+	}
+	mf.Metrics = append(merged, mf.Metrics...)
+}
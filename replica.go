@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/akerl/go-lambda/mux"
+)
+
+// writeRoute wraps a handler that mutates the bucket so that it refuses to
+// run on a read-only deployment, such as one scraping a replica bucket.
+func writeRoute(handler mux.HandleFunc) mux.HandleFunc {
+	return func(req events.Request) (events.Response, error) {
+		if c.ReadOnly && req.HTTPMethod != "GET" {
+			return events.Respond(503, "this deployment is read-only")
+		}
+		return handler(req)
+	}
+}
+
+// replicationMetrics reports how far behind a read-only replica is, measured
+// as the time since the newest push visible in the replica bucket. With at
+// least one frequent pusher (or a scheduled selftest) this tracks the
+// replication lag closely.
+func replicationMetrics(files []metricFile) []metric {
+	if !c.ReadOnly {
+		return []metric{}
+	}
+
+	var newest int64
+	for _, mf := range files {
+		if mf.PushedAt > newest {
+			newest = mf.PushedAt
+		}
+	}
+	if newest == 0 {
+		return []metric{}
+	}
+
+	return []metric{{
+		Name:  "hook_exporter_replica_newest_push_timestamp_seconds",
+		Type:  "gauge",
+		Value: fmt.Sprintf("%d", newest),
+	}, {
+		Name:  "hook_exporter_replication_lag_seconds",
+		Type:  "gauge",
+		Value: fmt.Sprintf("%d", time.Now().Unix()-newest),
+		Unit:  "seconds",
+	}}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type retentionAction struct {
+	File     string `json:"file"`
+	Policy   string `json:"policy"`
+	MaxAge   int64  `json:"max_age_seconds"`
+	Age      int64  `json:"age_seconds"`
+	Deleted  bool   `json:"deleted"`
+	Error    string `json:"error,omitempty"`
+	PushedAt int64  `json:"pushed_at"`
+}
+
+// retentionPolicy returns the longest matching retention prefix and its max
+// age in seconds. A max age of zero keeps files forever.
+func retentionPolicy(name string) (string, int64) {
+	policy := ""
+	var maxAge int64
+	best := -1
+	for prefix, seconds := range c.Retention {
+		if strings.HasPrefix(name, prefix) && len(prefix) > best {
+			best = len(prefix)
+			policy = prefix
+			maxAge = seconds
+		}
+	}
+	return policy, maxAge
+}
+
+func retentionPlan(files []metricFile, now time.Time) []retentionAction {
+	actions := []retentionAction{}
+	for _, mf := range files {
+		if mf.PushedAt == 0 {
+			continue
+		}
+		policy, maxAge := retentionPolicy(mf.FileName)
+		if maxAge == 0 {
+			continue
+		}
+		age := now.Unix() - mf.PushedAt
+		if age <= maxAge {
+			continue
+		}
+		actions = append(actions, retentionAction{
+			File:     mf.FileName,
+			Policy:   policy,
+			MaxAge:   maxAge,
+			Age:      age,
+			PushedAt: mf.PushedAt,
+		})
+	}
+	return actions
+}
+
+func enforceRetention(client *s3.Client) ([]retentionAction, error) {
+	files, err := readMetricFiles(client)
+	if err != nil {
+		return nil, err
+	}
+
+	actions := retentionPlan(files, time.Now())
+	for i := range actions {
+		err := deleteMetricFile(client, actions[i].File)
+		if err != nil {
+			actions[i].Error = err.Error()
+			continue
+		}
+		actions[i].Deleted = true
+	}
+	return actions, nil
+}
+
+// retentionHandler reports which files would be pruned on GET, and prunes
+// them on POST. Scheduled cleanup can invoke it via an EventBridge rule whose
+// constant input is an API Gateway-shaped POST to this path.
+func retentionHandler(req events.Request) (events.Response, error) {
+	client, err := getClient()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+	}
+
+	if req.HTTPMethod == "POST" {
+		actions, err := enforceRetention(client)
+		if err != nil {
+			return events.Fail(fmt.Sprintf("failed to enforce retention: %s", err))
+		}
+		return respondJSON(200, actions)
+	}
+
+	files, err := readMetricFiles(client)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to read metrics: %s", err))
+	}
+	return respondJSON(200, retentionPlan(files, time.Now()))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/akerl/go-lambda/s3"
+	"github.com/ghodss/yaml"
+)
+
+const (
+	rotateStage   = "stage"
+	rotatePromote = "promote"
+
+	secretKindToken = "token"
+	secretKindHMAC  = "hmac"
+)
+
+func generateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// rotationFields maps a secret kind to the active and pending config fields
+func rotationFields(kind string) (string, string, error) {
+	switch kind {
+	case "", secretKindToken:
+		return "token", "pending_token", nil
+	case secretKindHMAC:
+		return "hmac_secret", "pending_hmac_secret", nil
+	}
+	return "", "", fmt.Errorf("unknown secret kind: %s", kind)
+}
+
+// rotateSecret edits the raw config object so that unrelated settings and
+// unknown fields are preserved, then reloads the in-memory config. The edit
+// holds a file lock on the config object, so concurrent rotations don't
+// overwrite each other. While the config is pinned, the edit only applies
+// once the pin is advanced.
+func rotateSecret(name, action, kind string) (string, error) {
+	active, pending, err := rotationFields(kind)
+	if err != nil {
+		return "", err
+	}
+
+	release, err := lockFile(internalPrefix + "config/" + cf.Bucket + "/" + cf.Key)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	raw, err := s3.GetObject(cf.Bucket, cf.Key)
+	if err != nil {
+		return "", err
+	}
+	var doc map[string]interface{}
+	err = yaml.Unmarshal(raw, &doc)
+	if err != nil {
+		return "", err
+	}
+
+	tokens, _ := doc["tokens"].([]interface{})
+	var entry map[string]interface{}
+	for _, t := range tokens {
+		if m, ok := t.(map[string]interface{}); ok && m["name"] == name {
+			entry = m
+		}
+	}
+	if entry == nil {
+		return "", fmt.Errorf("no token named %s", name)
+	}
+
+	secret := ""
+	switch action {
+	case rotateStage:
+		secret, err = generateSecret()
+		if err != nil {
+			return "", err
+		}
+		entry[pending] = secret
+	case rotatePromote:
+		staged, _ := entry[pending].(string)
+		if staged == "" {
+			return "", fmt.Errorf("no staged %s for %s", active, name)
+		}
+		entry[active] = staged
+		delete(entry, pending)
+	}
+
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	err = s3.PutObject(cf.Bucket, cf.Key, string(out))
+	if err != nil {
+		return "", err
+	}
+	return secret, reloadConfigFile(cf)
+}
+
+// rotationHandler stages a new secret for a token (accepted alongside the
+// current one) or promotes the staged secret to active.
+func rotationHandler(req events.Request) (events.Response, error) {
+	if req.HTTPMethod != "POST" {
+		return events.Respond(405, "rotation requires POST")
+	}
+	if cf == nil {
+		return events.Fail("config file location unknown")
+	}
+
+	name := req.PathParameters["name"]
+	action := req.PathParameters["action"]
+	kind := req.QueryStringParameters["kind"]
+
+	secret, err := rotateSecret(name, action, kind)
+	if err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to %s: %s", action, err))
+	}
+
+	result := map[string]string{"name": name, "action": action}
+	if secret != "" {
+		result["secret"] = secret
+	}
+	return respondJSON(200, result)
+}
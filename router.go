@@ -3,16 +3,23 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/akerl/go-lambda/apigw/events"
 	awsConfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 type metric struct {
@@ -20,57 +27,156 @@ type metric struct {
 	Type  string            `json:"type"`
 	Tags  map[string]string `json:"tags"`
 	Value string            `json:"value"`
+	Unit  string            `json:"unit,omitempty"`
+	Help  string            `json:"help,omitempty"`
+
+	Timestamp int64      `json:"timestamp,omitempty"`
+	Exemplar  *exemplar  `json:"exemplar,omitempty"`
+	Histogram *histogram `json:"histogram,omitempty"`
+	Summary   *summary   `json:"summary,omitempty"`
+
+	file     string
+	pushedAt int64
 }
 
 type metricFile struct {
-	FileName string   `json:"name"`
-	Metrics  []metric `json:"metrics"`
+	FileName  string      `json:"name"`
+	Metrics   []metric    `json:"metrics"`
+	PushedAt  int64       `json:"pushed_at,omitempty"`
+	Source    *pushSource `json:"source,omitempty"`
+	Anomalies []string    `json:"anomalies,omitempty"`
+	Status    string      `json:"status,omitempty"`
+	Skewed    []string    `json:"skewed,omitempty"`
+	Version   int         `json:"version,omitempty"`
+
+	CallbackURL string      `json:"callback_url,omitempty"`
+	Ruleset     *rulesetRef `json:"ruleset,omitempty"`
+
+	jobTags    map[string]string
+	quota      map[string]string
+	quotaToken string
+	quotaUsage fileUsage
+
+	typesChanged  bool
+	mergeExisting bool
+	mergeSeries   bool
+	accumulate    bool
+
+	// derive recomputes series that depend on the merged file contents
+	derive func(*metricFile)
+}
+
+type pushSource struct {
+	Token        string `json:"token"`
+	SourceIPHash string `json:"source_ip_hash"`
+	UserAgent    string `json:"user_agent"`
 }
 
 var textRegex = regexp.MustCompile(`^[\w\-/]+$`)
-var valueRegex = regexp.MustCompile(`^\d+(.\d+)?$`)
+
+// metricNameRegex also allows the colons of recording rule names. Label
+// values may be any UTF-8, since every format escapes them.
+var metricNameRegex = regexp.MustCompile(`^[\w\-/:]+$`)
+var unitRegex = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+var baseUnits = map[string]bool{
+	"seconds": true,
+	"bytes":   true,
+	"ratio":   true,
+	"meters":  true,
+	"volts":   true,
+	"amperes": true,
+	"joules":  true,
+	"grams":   true,
+	"celsius": true,
+}
 
 func (m *metric) String() string {
-	return fmt.Sprintf(
-		"# TYPE %s %s\n%s%s %s\n\n",
-		m.Name,
-		m.Type,
-		m.Name,
-		m.TagString(),
-		m.Value,
-	)
+	var sb strings.Builder
+	writeTextHeader(&sb, m.Name, m.Type, m.Help, m.Unit)
+	m.writeTextSamples(&sb)
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+// writeTextHeader writes the comment lines that introduce a family
+func writeTextHeader(w io.Writer, name, metricType, help, unit string) {
+	if help != "" {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, escapeHelp(help))
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+	if unit != "" {
+		fmt.Fprintf(w, "# UNIT %s %s\n", name, unit)
+	}
+}
+
+func (m *metric) writeTextSamples(w io.Writer) {
+	timestamp := ""
+	if m.Timestamp != 0 {
+		timestamp = fmt.Sprintf(" %d", m.Timestamp)
+	}
+	for _, s := range m.samples() {
+		fmt.Fprintf(w, "%s%s %s%s\n", s.Name, s.TagString(), s.Value, timestamp)
+	}
+}
+
+func escapeHelp(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	return strings.ReplaceAll(v, "\n", `\n`)
 }
 
 func (m *metric) TagString() string {
 	if len(m.Tags) == 0 {
 		return ""
 	}
+	keys := make([]string, 0, len(m.Tags))
+	for k := range m.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
 	tagStrings := []string{}
-	for k, v := range m.Tags {
-		tagStrings = append(tagStrings, fmt.Sprintf("%s=\"%s\"", k, v))
+	for _, k := range keys {
+		tagStrings = append(tagStrings, fmt.Sprintf("%s=\"%s\"", k, escapeLabelValue(m.Tags[k])))
 	}
 	return fmt.Sprintf("{%s}", strings.Join(tagStrings, ","))
 }
 
-func (m *metric) Validate() bool {
-	if !textRegex.MatchString(m.Name) {
-		return false
+func escapeLabelValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return strings.ReplaceAll(v, `"`, `\"`)
+}
+
+func (m *metric) validateUnit() bool {
+	if !c.EnforceUnits {
+		return true
 	}
-	if !textRegex.MatchString(m.Type) {
-		return false
+	if m.Unit == "" {
+		return !hasUnitSuffix(m.Name, m.Type)
 	}
-	if !valueRegex.MatchString(m.Value) {
+	if !baseUnits[m.Unit] {
 		return false
 	}
-	for k, v := range m.Tags {
-		if !textRegex.MatchString(k) {
-			return false
-		}
-		if !textRegex.MatchString(v) {
-			return false
+	name := m.Name
+	if m.Type == "counter" {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	return strings.HasSuffix(name, "_"+m.Unit)
+}
+
+// hasUnitSuffix reports whether a name looks like it carries a base unit,
+// which under enforcement must then be declared explicitly.
+func hasUnitSuffix(name, metricType string) bool {
+	if metricType == "counter" {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	for u := range baseUnits {
+		if strings.HasSuffix(name, "_"+u) {
+			return true
 		}
 	}
-	return true
+	return false
 }
 
 func (mf *metricFile) String() string {
@@ -81,19 +187,81 @@ func (mf *metricFile) String() string {
 	return sb.String()
 }
 
-func (mf *metricFile) Validate() bool {
-	if mf.FileName == "" {
-		return false
+func metricAuth(req events.Request) (events.Response, error) {
+	if t, ok := lookupToken(req); ok {
+		if err := t.Window(time.Now()); err != nil {
+			return events.Reject(err.Error())
+		}
+		return events.Response{}, nil
 	}
-	for _, x := range mf.Metrics {
-		if !x.Validate() {
-			return false
+	if !strings.HasPrefix(req.Headers["Authorization"], "Bearer ") {
+		return events.Reject("no auth token")
+	}
+	return events.Reject("bad auth token")
+}
+
+func identifyToken(req events.Request) (string, bool) {
+	t, ok := lookupToken(req)
+	return t.Name, ok
+}
+
+func lookupToken(req events.Request) (tokenConfig, bool) {
+	if name, ok := req.RequestContext.Authorizer[signedTokenKey].(string); ok {
+		for _, t := range c.Tokens {
+			if t.Name == name {
+				return t, true
+			}
+		}
+		return tokenConfig{}, false
+	}
+	auth := req.Headers["Authorization"]
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return lookupCertIdentity(req)
+	}
+	token := []byte(auth[7:])
+
+	if c.AuthToken != "" && subtle.ConstantTimeCompare(token, []byte(c.AuthToken)) == 1 {
+		return tokenConfig{Name: "default", Token: c.AuthToken}, true
+	}
+	for _, t := range c.Tokens {
+		if t.Token != "" && subtle.ConstantTimeCompare(token, []byte(t.Token)) == 1 {
+			return t, true
+		}
+		if t.PendingToken != "" && subtle.ConstantTimeCompare(token, []byte(t.PendingToken)) == 1 {
+			return t, true
 		}
 	}
-	return true
+	return tokenConfig{}, false
 }
 
-func metricAuth(req events.Request) (events.Response, error) {
+func requestSource(req events.Request, token string) *pushSource {
+	userAgent := req.RequestContext.Identity.UserAgent
+	if userAgent == "" {
+		userAgent = req.Headers["User-Agent"]
+	}
+	return &pushSource{
+		Token:        token,
+		SourceIPHash: hashSourceIP(req.RequestContext.Identity.SourceIP),
+		UserAgent:    userAgent,
+	}
+}
+
+func hashSourceIP(ip string) string {
+	if ip == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(c.IPHashSalt + ip))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+func adminAuth(req events.Request) (events.Response, error) {
+	if c.AdminToken == "" {
+		return events.Reject("admin routes disabled")
+	}
+	return tokenAuth(req, c.AdminToken)
+}
+
+func tokenAuth(req events.Request, expected string) (events.Response, error) {
 	auth := req.Headers["Authorization"]
 
 	if !strings.HasPrefix(auth, "Bearer ") {
@@ -101,7 +269,7 @@ func metricAuth(req events.Request) (events.Response, error) {
 	}
 
 	token := auth[7:]
-	if subtle.ConstantTimeCompare([]byte(token), []byte(c.AuthToken)) != 1 {
+	if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
 		return events.Reject("bad auth token")
 	}
 	return events.Response{}, nil
@@ -113,52 +281,353 @@ func metricHandler(req events.Request) (events.Response, error) {
 		return events.Fail(fmt.Sprintf("failed to decode: %s", err))
 	}
 
-	var mf metricFile
-	err = json.Unmarshal([]byte(body), &mf)
-	if err != nil {
-		return events.Fail(fmt.Sprintf("failed to unmarshal: %s", err))
+	if isExposition(req.Headers["Content-Type"]) {
+		if max := effectiveJSONLimits().MaxBodyBytes; len(body) > max {
+			return events.Respond(400, fmt.Sprintf("rejected body: body exceeds %d bytes", max))
+		}
+		mf, err := parseExposition(req.QueryStringParameters["name"], body)
+		if err != nil {
+			return events.Respond(400, fmt.Sprintf("failed to parse: %s", err))
+		}
+		return pushMetricFile(req, mf)
+	}
+
+	if isNDJSON(req.Headers["Content-Type"]) {
+		if max := effectiveJSONLimits().MaxBodyBytes; len(body) > max {
+			return events.Respond(400, fmt.Sprintf("rejected body: body exceeds %d bytes", max))
+		}
+		name := req.QueryStringParameters["name"]
+		if name == "" {
+			name = req.Headers[ndjsonFileHeader]
+		}
+		mf, err := parseNDJSON(name, body)
+		if err != nil {
+			return events.Respond(400, fmt.Sprintf("failed to parse: %s", err))
+		}
+		return pushMetricFile(req, mf)
 	}
 
-	if !mf.Validate() {
-		return events.Fail("failed validation")
+	if isProtobufPush(req.Headers["Content-Type"]) {
+		if max := effectiveJSONLimits().MaxBodyBytes; len(body) > max {
+			return events.Respond(400, fmt.Sprintf("rejected body: body exceeds %d bytes", max))
+		}
+		mf, err := parseProtoMetricFile(req.QueryStringParameters["name"], []byte(body))
+		if err != nil {
+			return events.Respond(400, fmt.Sprintf("failed to parse: %s", err))
+		}
+		return pushMetricFile(req, mf)
 	}
 
-	content, err := json.Marshal(mf)
+	if isCSV(req.Headers["Content-Type"]) {
+		if max := effectiveJSONLimits().MaxBodyBytes; len(body) > max {
+			return events.Respond(400, fmt.Sprintf("rejected body: body exceeds %d bytes", max))
+		}
+		name := req.QueryStringParameters["name"]
+		if name == "" {
+			name = req.Headers[ndjsonFileHeader]
+		}
+		mf, err := parseCSV(name, body)
+		if err != nil {
+			return events.Respond(400, fmt.Sprintf("failed to parse: %s", err))
+		}
+		return pushMetricFile(req, mf)
+	}
+
+	err = checkJSONLimits([]byte(body))
 	if err != nil {
-		return events.Fail(fmt.Sprintf("failed to marshal: %s", err))
+		return events.Respond(400, fmt.Sprintf("rejected body: %s", err))
+	}
+
+	mf, err := parseMetricFile([]byte(body))
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to unmarshal: %s", err))
+	}
+
+	return pushMetricFile(req, mf)
+}
+
+type pushResult struct {
+	File      string `json:"file"`
+	Status    string `json:"status"`
+	Reason    string `json:"reason,omitempty"`
+	Reference string `json:"reference,omitempty"`
+	Unchanged bool   `json:"unchanged,omitempty"`
+	Version   string `json:"version,omitempty"`
+
+	Findings []validationFinding `json:"findings,omitempty"`
+
+	code int
+}
+
+const (
+	pushStored       = "stored"
+	pushRejected     = "rejected"
+	pushDeadLettered = "dead_lettered"
+	pushUnchanged    = "unchanged"
+)
+
+func rejectPush(mf metricFile, code int, reason string) *pushResult {
+	return &pushResult{File: mf.FileName, Status: pushRejected, Reason: reason, code: code}
+}
+
+// Response converts a pushResult into the single-file push response
+func (pr pushResult) Response() (events.Response, error) {
+	switch pr.Status {
+	case pushStored:
+		return events.Succeed("")
+	case pushUnchanged:
+		return respondJSON(200, map[string]interface{}{
+			"status":    pr.Status,
+			"unchanged": true,
+		})
+	case pushDeadLettered:
+		return respondJSON(202, map[string]string{
+			"status":    pr.Status,
+			"reference": pr.Reference,
+		})
+	}
+	if len(pr.Findings) > 0 {
+		return respondJSON(pr.code, map[string]interface{}{
+			"status":   pr.Status,
+			"reason":   pr.Reason,
+			"findings": pr.Findings,
+		})
 	}
+	return events.Respond(pr.code, pr.Reason)
+}
 
+// pushMetricFile runs a parsed metricFile through the shared push pipeline:
+// expansion, scanning, validation, stamping, and storage.
+func pushMetricFile(req events.Request, mf metricFile) (events.Response, error) {
 	client, err := getClient()
 	if err != nil {
 		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
 	}
 
-	_, err = client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: &c.MetricBucket,
-		Key:    &mf.FileName,
-		Body:   bytes.NewReader(content),
-	})
+	callback := takeCallback(req, &mf)
+
+	release, err := lockFile(mf.FileName)
+	if err != nil {
+		return events.Respond(409, fmt.Sprintf("failed to lock %s: %s", mf.FileName, err))
+	}
+	defer release()
+
+	start := time.Now()
+	rejected := prepareMetricFile(req, client, &mf)
+	tracePhase("prepare", start)
+	if rejected != nil {
+		recordPush(*rejected)
+		sendCallback(req, callback, mf, *rejected)
+		resp, err := rejected.Response()
+		return withQuotaHeaders(resp, mf.quota), err
+	}
+
+	start = time.Now()
+	result := storeMetricFile(client, mf)
+	tracePhase("store", start)
+	recordPush(result)
+	sendCallback(req, callback, mf, result)
+	resp, err := result.Response()
+	return withQuotaHeaders(resp, mf.quota), err
+}
+
+// prepareMetricFile expands, scans, validates, and stamps a metricFile ahead
+// of storage. It returns nil if the file is ready to be written.
+func prepareMetricFile(req events.Request, client *s3.Client, mf *metricFile) *pushResult {
+	if strings.HasPrefix(mf.FileName, internalPrefix) {
+		return rejectPush(*mf, 400, fmt.Sprintf("file names may not start with %s", internalPrefix))
+	}
+	if err := checkRegistration(client, mf.FileName); err != nil {
+		return rejectPush(*mf, 400, err.Error())
+	}
+
+	if mf.mergeExisting {
+		if err := mergeExistingMetrics(client, mf); err != nil {
+			return rejectPush(*mf, 500, fmt.Sprintf("failed to merge: %s", err))
+		}
+	}
+	if mf.mergeSeries {
+		if err := mergeExistingSeries(client, mf); err != nil {
+			return rejectPush(*mf, 500, fmt.Sprintf("failed to merge: %s", err))
+		}
+	}
+	if mf.accumulate {
+		if err := accumulateExisting(client, mf); err != nil {
+			return rejectPush(*mf, 500, fmt.Sprintf("failed to accumulate: %s", err))
+		}
+	}
+	if mf.derive != nil {
+		mf.derive(mf)
+	}
+
+	if mf.Status != "" {
+		err := expandJobStatus(client, mf)
+		if err != nil {
+			return rejectPush(*mf, 400, err.Error())
+		}
+	}
+
+	err := normalizeLabels(mf)
+	if err != nil {
+		return rejectPush(*mf, 400, err.Error())
+	}
+	canonicalizeValues(mf)
+
+	err = redactPII(mf)
+	if err != nil {
+		return rejectPush(*mf, 500, fmt.Sprintf("failed to scan: %s", err))
+	}
+
+	findings, err := validateFile(client, mf, false)
+	if err != nil {
+		return rejectPush(*mf, 500, fmt.Sprintf("failed to validate: %s", err))
+	}
+	for _, f := range findings {
+		tracef("validation: %s (%s)", f, f.Mode)
+	}
+	if enforced := enforcedFindings(findings); len(enforced) > 0 {
+		r := rejectPush(*mf, 400, fmt.Sprintf("failed validation: %s", enforced[0]))
+		r.Findings = enforced
+		return r
+	}
+	tracef("validation: %s passed with %d metrics", mf.FileName, len(mf.Metrics))
+
+	err = checkTimestamps(mf, time.Now())
 	if err != nil {
-		return events.Fail(fmt.Sprintf("failed to write: %s", err))
+		return rejectPush(*mf, 400, err.Error())
+	}
+
+	if r := checkQuota(req, client, mf); r != nil {
+		return r
+	}
+	if r := checkBucketQuota(client, mf); r != nil {
+		return r
+	}
+
+	token, _ := identifyToken(req)
+	mf.PushedAt = time.Now().Unix()
+	mf.Source = requestSource(req, token)
+	mf.Anomalies = nil
+	flagAnomalies(client, mf)
+	return nil
+}
+
+// storeMetricFile writes a prepared metricFile, skipping unchanged content
+// and falling back to the dead letter bucket if the write fails.
+func storeMetricFile(client *s3.Client, mf metricFile) pushResult {
+	if isUnchanged(client, mf) {
+		if err := touchMetricFile(client, mf); err != nil {
+			fmt.Printf("failed to update push time: %s\n", err)
+		}
+		if err := recordAccess(client, mf); err != nil {
+			fmt.Printf("failed to record token access: %s\n", err)
+		}
+		return pushResult{File: mf.FileName, Status: pushUnchanged, Unchanged: true, code: 200}
+	}
+
+	version, err := putMetricFile(client, mf)
+	if err == nil {
+		if err := recordUsage(client, mf); err != nil {
+			fmt.Printf("failed to record quota usage: %s\n", err)
+		}
+		if err := recordAccess(client, mf); err != nil {
+			fmt.Printf("failed to record token access: %s\n", err)
+		}
+		if err := recordTypes(client, mf); err != nil {
+			fmt.Printf("failed to record metric types: %s\n", err)
+		}
+		if err := updateManifest(client, mf); err != nil {
+			fmt.Printf("failed to update manifest: %s\n", err)
+		}
+		if err := mirrorMetricFile(mf); err != nil {
+			fmt.Printf("failed to update hot cache: %s\n", err)
+		}
+		return pushResult{File: mf.FileName, Status: pushStored, Version: version, code: 200}
+	}
+	if c.DeadLetterBucket == "" {
+		return *rejectPush(mf, 500, fmt.Sprintf("failed to write: %s", err))
+	}
+
+	ref, dlErr := deadLetter(client, mf)
+	if dlErr != nil {
+		return *rejectPush(mf, 500, fmt.Sprintf("failed to write: %s (dead letter failed: %s)", err, dlErr))
 	}
-	return events.Succeed("")
+	return pushResult{File: mf.FileName, Status: pushDeadLettered, Reference: ref, code: 202}
 }
 
-func indexHandler(_ events.Request) (events.Response, error) {
+func indexHandler(req events.Request) (events.Response, error) {
 	client, err := getClient()
 	if err != nil {
 		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
 	}
 
-	allMetrics, err := readMetrics(client)
+	start := time.Now()
+	mg := newMemoryGuard()
+	var files []metricFile
+	if c.HotTable != "" {
+		files, err = readHotFiles(client, mg)
+	} else if names := requestedFamilies(req); names != nil {
+		files, err = readFamilyFiles(client, mg, names)
+	} else {
+		files, err = readMetricFilesGuarded(client, mg)
+	}
 	if err != nil {
 		return events.Fail(fmt.Sprintf("failed to read metrics: %s", err))
 	}
+	tracePhase("read", start)
+	files, ok := scopeMetricFiles(req, files)
+	if !ok {
+		return events.Reject("bad auth token")
+	}
+	files, err = shardMetricFiles(req, files)
+	if err != nil {
+		return events.Respond(400, err.Error())
+	}
+	files = redactMetricFiles(files)
+
+	allMetrics := mergeMetricFiles(files)
+	allMetrics.Metrics, err = dedupSeries(allMetrics.Metrics)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to render metrics: %s", err))
+	}
+	allMetrics.Metrics = append(allMetrics.Metrics, selfMetrics(files)...)
+	allMetrics.Metrics = orderMetrics(req, allMetrics.Metrics)
+
+	f, err := selectFormatter(req)
+	if err != nil {
+		return events.Respond(400, err.Error())
+	}
+
+	start = time.Now()
+	body, err := f.Format(guardMetrics(allMetrics.Metrics, mg))
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to render metrics: %s", err))
+	}
+	tracePhase("render", start)
+	if len(body) > maxScrapeBytes() {
+		return events.Respond(413, fmt.Sprintf(
+			"scrape output is %d bytes, over the %d byte cap; split it with ?shard=N&shards=M",
+			len(body),
+			maxScrapeBytes(),
+		))
+	}
 
+	resp := formattedResponse(f, body)
+	if err := signResponse(&resp, body); err != nil {
+		return events.Fail(fmt.Sprintf("failed to sign output: %s", err))
+	}
+	return resp, nil
+}
+
+func respondJSON(code int, v interface{}) (events.Response, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to marshal: %s", err))
+	}
 	return events.Response{
-		StatusCode: 200,
-		Body:       allMetrics.String(),
-		Headers:    map[string]string{"Content-Type": "text/plain"},
+		StatusCode: code,
+		Body:       string(body),
+		Headers:    map[string]string{"Content-Type": "application/json"},
 	}, nil
 }
 
@@ -168,69 +637,163 @@ func getClient() (*s3.Client, error) {
 		return nil, err
 	}
 
-	return s3.NewFromConfig(cfg), nil
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.APIOptions = append(o.APIOptions, countS3Calls, traceS3Calls)
+	}), nil
 }
 
 func readMetrics(client *s3.Client) (metricFile, error) {
-	files, err := listMetricFiles(client)
+	files, err := readMetricFiles(client)
 	if err != nil {
 		return metricFile{}, err
 	}
+	return mergeMetricFiles(files), nil
+}
 
+func mergeMetricFiles(files []metricFile) metricFile {
 	allMetrics := metricFile{FileName: "__all__"}
+	for _, mf := range files {
+		for _, m := range mf.Metrics {
+			m.file = mf.FileName
+			m.pushedAt = mf.PushedAt
+			allMetrics.Metrics = append(allMetrics.Metrics, m)
+		}
+	}
+	return allMetrics
+}
+
+func readMetricFiles(client *s3.Client) ([]metricFile, error) {
+	files, err := listMetricFiles(client)
+	if err != nil {
+		return []metricFile{}, err
+	}
+
+	metricFiles := []metricFile{}
 	for _, f := range files {
 		mf, err := readMetricFile(client, f)
-		if err != nil {
-			return metricFile{}, err
+		if errors.Is(err, errMetricFileMissing) {
+			continue
+		} else if err != nil {
+			return []metricFile{}, err
 		}
-		allMetrics.Metrics = append(allMetrics.Metrics, mf.Metrics...)
+		metricFiles = append(metricFiles, mf)
 	}
-	return allMetrics, nil
+	return metricFiles, nil
 }
 
 func readMetricFile(client *s3.Client, f string) (metricFile, error) {
-	input := &s3.GetObjectInput{
-		Bucket: &c.MetricBucket,
-		Key:    &f,
+	if isKnownMissing(f) {
+		return metricFile{}, fmt.Errorf("%w: %s", errMetricFileMissing, f)
 	}
 
-	result, err := client.GetObject(context.TODO(), input)
+	entry, err := readObjectEntry(client, f)
 	if err != nil {
-		return metricFile{}, err
+		return metricFile{}, missingError(f, err)
 	}
 
-	body, err := io.ReadAll(result.Body)
+	var mf metricFile
+	err = json.Unmarshal(entry.Body, &mf)
 	if err != nil {
 		return metricFile{}, err
 	}
+	// Unchanged pushes only update the pushed-at metadata
+	if at, err := strconv.ParseInt(entry.Metadata[pushedAtMeta], 10, 64); err == nil && at > mf.PushedAt {
+		mf.PushedAt = at
+	}
 
-	var mf metricFile
-	err = json.Unmarshal(body, &mf)
+	if err := mf.checkStored(); err != nil {
+		return metricFile{}, fmt.Errorf("%s: %s", f, err)
+	}
+	return mf, nil
+}
+
+func writeMetricFile(client *s3.Client, mf metricFile) error {
+	_, err := putMetricFile(client, mf)
+	return err
+}
+
+// putMetricFile writes mf and returns the stored object's version ID, which
+// is empty unless the bucket is versioned
+func putMetricFile(client *s3.Client, mf metricFile) (string, error) {
+	content, err := json.Marshal(mf)
 	if err != nil {
-		return metricFile{}, err
+		return "", err
 	}
 
-	if !mf.Validate() {
-		return metricFile{}, fmt.Errorf("failed validation for %s", f)
+	meta := writeMetadata(mf)
+	out, err := client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket:   &c.MetricBucket,
+		Key:      &mf.FileName,
+		Body:     bytes.NewReader(content),
+		Metadata: meta,
+	})
+	if err != nil {
+		return "", err
 	}
-	return mf, nil
+	clearMissing(mf.FileName)
+	storeDiskEntry(mf.FileName, out.ETag, content, meta)
+	if out.VersionId == nil {
+		return "", nil
+	}
+	return *out.VersionId, nil
+}
+
+func deleteMetricFile(client *s3.Client, f string) error {
+	_, err := client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+		Bucket: &c.MetricBucket,
+		Key:    &f,
+	})
+	if err != nil {
+		return err
+	}
+	markMissing(f)
+	dropDiskEntry(f)
+	dropLockStats(f)
+	if err := removeFromManifest(client, f); err != nil {
+		fmt.Printf("failed to update manifest: %s\n", err)
+	}
+	if err := removeUsage(client, f); err != nil {
+		fmt.Printf("failed to update quota usage: %s\n", err)
+	}
+	if err := removeTypes(client, f); err != nil {
+		fmt.Printf("failed to update metric types: %s\n", err)
+	}
+	if err := removeHotFile(f); err != nil {
+		fmt.Printf("failed to update hot cache: %s\n", err)
+	}
+	return nil
 }
 
 func listMetricFiles(client *s3.Client) ([]string, error) {
+	objects, err := listMetricObjects(client)
+	if err != nil {
+		return []string{}, err
+	}
+	metricFiles := make([]string, len(objects))
+	for i, obj := range objects {
+		metricFiles[i] = *obj.Key
+	}
+	return metricFiles, nil
+}
+
+func listMetricObjects(client *s3.Client) ([]types.Object, error) {
 	paginator := s3.NewListObjectsV2Paginator(
 		client,
 		&s3.ListObjectsV2Input{Bucket: &c.MetricBucket},
 	)
-	metricFiles := []string{}
+	objects := []types.Object{}
 
 	for paginator.HasMorePages() {
 		page, err := paginator.NextPage(context.TODO())
 		if err != nil {
-			return []string{}, err
+			return []types.Object{}, err
 		}
 		for _, obj := range page.Contents {
-			metricFiles = append(metricFiles, *obj.Key)
+			if strings.HasPrefix(*obj.Key, internalPrefix) {
+				continue
+			}
+			objects = append(objects, obj)
 		}
 	}
-	return metricFiles, nil
+	return objects, nil
 }
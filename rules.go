@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/ghodss/yaml"
+)
+
+type alertRule struct {
+	Alert       string            `json:"alert"`
+	Expr        string            `json:"expr"`
+	For         string            `json:"for,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ruleGroup struct {
+	Name  string      `json:"name"`
+	Rules []alertRule `json:"rules"`
+}
+
+type ruleFile struct {
+	Groups []ruleGroup `json:"groups"`
+}
+
+var ruleNameRegex = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+func suggestedRules(names []string) ruleFile {
+	freshness := ruleGroup{Name: "hook-exporter-freshness", Rules: []alertRule{}}
+	for _, name := range names {
+		slo := fileSLO(name)
+		if slo == 0 {
+			continue
+		}
+		selector := fmt.Sprintf(`hook_exporter_file_last_push_timestamp_seconds{file=%q}`, name)
+		id := ruleNameRegex.ReplaceAllString(name, "_")
+		freshness.Rules = append(freshness.Rules, alertRule{
+			Alert: "HookExporterFileStale_" + id,
+			Expr: fmt.Sprintf(
+				"time() - %s > %d unless on(file) hook_exporter_maintenance_window == 1",
+				selector,
+				slo,
+			),
+			For: "5m",
+			Labels: map[string]string{
+				"severity": "warning",
+				"file":     name,
+			},
+			Annotations: map[string]string{
+				"summary": fmt.Sprintf("%s has not been pushed for over %ds", name, slo),
+			},
+		}, alertRule{
+			Alert: "HookExporterFileAbsent_" + id,
+			Expr:  fmt.Sprintf("absent(%s)", selector),
+			For:   "15m",
+			Labels: map[string]string{
+				"severity": "warning",
+				"file":     name,
+			},
+			Annotations: map[string]string{
+				"summary": fmt.Sprintf("%s is missing from hook-exporter", name),
+			},
+		})
+	}
+
+	failures := ruleGroup{Name: "hook-exporter-failures", Rules: []alertRule{{
+		Alert: "HookExporterJobFailed",
+		Expr:  "job_last_run_status == 0",
+		Labels: map[string]string{
+			"severity": "warning",
+		},
+		Annotations: map[string]string{
+			"summary": "Job {{ $labels.job }} reported a failed run",
+		},
+	}}}
+
+	return ruleFile{Groups: []ruleGroup{freshness, failures}}
+}
+
+func suggestedRulesHandler(_ events.Request) (events.Response, error) {
+	client, err := getClient()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+	}
+
+	files, err := listMetricFiles(client)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to list metrics: %s", err))
+	}
+	registry, err := loadRegistry(client)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load registry: %s", err))
+	}
+
+	set := map[string]bool{}
+	for _, f := range files {
+		set[f] = true
+	}
+	for f := range registry {
+		set[f] = true
+	}
+	names := make([]string, 0, len(set))
+	for f := range set {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+
+	body, err := yaml.Marshal(suggestedRules(names))
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to marshal: %s", err))
+	}
+	return events.Response{
+		StatusCode: 200,
+		Body:       string(body),
+		Headers:    map[string]string{"Content-Type": "application/yaml"},
+	}, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// scheduledJobs are the maintenance tasks that Lambda deployments trigger
+// from EventBridge rules, runnable in-process by the standalone server.
+var scheduledJobs = map[string]func() error{
+	"retention": runRetentionJob,
+	"freshness": runFreshnessJob,
+	"counters":  flushCounters,
+	"manifest":  runManifestJob,
+	"reconcile": runReconcileJob,
+	"hotcache":  runHotCacheJob,
+	"migrate":   runMigrationJob,
+}
+
+// startScheduler runs the jobs configured in c.Schedule on their cron
+// expressions. The schedule is re-read each minute so config reloads apply.
+// Jobs hold stageLock for reading, as standalone requests do.
+func startScheduler() {
+	go func() {
+		for {
+			now := time.Now()
+			time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+			stageLock.RLock()
+			runScheduledJobs(time.Now())
+			stageLock.RUnlock()
+		}
+	}()
+}
+
+func runScheduledJobs(now time.Time) {
+	for name, expr := range c.Schedule {
+		job, ok := scheduledJobs[name]
+		if !ok {
+			fmt.Printf("unknown scheduled job: %s\n", name)
+			continue
+		}
+		cs, err := parseCron(expr)
+		if err != nil {
+			fmt.Printf("invalid schedule for %s: %s\n", name, err)
+			continue
+		}
+		if !cs.Matches(now) {
+			continue
+		}
+		go func(name string, job func() error) {
+			stageLock.RLock()
+			defer stageLock.RUnlock()
+			if err := job(); err != nil {
+				fmt.Printf("scheduled job %s failed: %s\n", name, err)
+			}
+		}(name, job)
+	}
+}
+
+func runRetentionJob() error {
+	client, err := getClient()
+	if err != nil {
+		return err
+	}
+	actions, err := enforceRetention(client)
+	if err != nil {
+		return err
+	}
+	for _, a := range actions {
+		if a.Error != "" {
+			return fmt.Errorf("failed to prune %s: %s", a.File, a.Error)
+		}
+	}
+	return nil
+}
+
+// runFreshnessJob announces files that are past their freshness SLO
+func runFreshnessJob() error {
+	client, err := getClient()
+	if err != nil {
+		return err
+	}
+	files, err := readMetricFiles(client)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, mf := range files {
+		f := freshnessFor(mf, now)
+		if !f.Overdue {
+			continue
+		}
+		fmt.Printf("file %s is overdue (last push %d, slo %ds)\n", f.File, f.PushedAt, f.SLO)
+		if err := publishEvent("File Overdue", f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const currentSchemaVersion = 2
+
+type exemplar struct {
+	Labels    map[string]string `json:"labels"`
+	Value     string            `json:"value"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+}
+
+type sampleV2 struct {
+	Labels    map[string]string `json:"labels"`
+	Value     string            `json:"value"`
+	Timestamp int64             `json:"timestamp,omitempty"`
+	Exemplar  *exemplar         `json:"exemplar,omitempty"`
+	Histogram *histogram        `json:"histogram,omitempty"`
+	Summary   *summary          `json:"summary,omitempty"`
+}
+
+type metricV2 struct {
+	Name    string            `json:"name"`
+	Type    string            `json:"type"`
+	Help    string            `json:"help"`
+	Unit    string            `json:"unit"`
+	Tags    map[string]string `json:"tags"`
+	Samples []sampleV2        `json:"samples"`
+}
+
+type metricFileV2 struct {
+	Version  int        `json:"version"`
+	FileName string     `json:"name"`
+	Status   string     `json:"status"`
+	Metrics  []metricV2 `json:"metrics"`
+
+	CallbackURL string `json:"callback_url,omitempty"`
+}
+
+var schemaParsers = map[int]func([]byte) (metricFile, error){
+	1: parseMetricFileV1,
+	2: parseMetricFileV2,
+}
+
+// parseMetricFile decodes a push body, dispatching on its version field.
+// Bodies without a version are treated as version 1.
+func parseMetricFile(body []byte) (metricFile, error) {
+	var probe struct {
+		Version int `json:"version"`
+	}
+	err := json.Unmarshal(body, &probe)
+	if err != nil {
+		return metricFile{}, err
+	}
+	if probe.Version == 0 {
+		probe.Version = 1
+	}
+
+	parser, ok := schemaParsers[probe.Version]
+	if !ok {
+		return metricFile{}, fmt.Errorf(
+			"unsupported version %d (max %d)", probe.Version, currentSchemaVersion,
+		)
+	}
+	return parser(body)
+}
+
+func parseMetricFileV1(body []byte) (metricFile, error) {
+	var mf metricFile
+	err := decodeJSON(body, &mf)
+	return mf, err
+}
+
+// parseMetricFileV2 flattens each v2 sample into a metric, merging the
+// metric-level tags with the sample's own labels.
+func parseMetricFileV2(body []byte) (metricFile, error) {
+	var v2 metricFileV2
+	err := decodeJSON(body, &v2)
+	if err != nil {
+		return metricFile{}, err
+	}
+
+	mf := metricFile{FileName: v2.FileName, Status: v2.Status, CallbackURL: v2.CallbackURL}
+	for _, m := range v2.Metrics {
+		if len(m.Samples) == 0 {
+			return metricFile{}, fmt.Errorf("metric %s has no samples", m.Name)
+		}
+		for _, s := range m.Samples {
+			tags := map[string]string{}
+			for k, v := range m.Tags {
+				tags[k] = v
+			}
+			for k, v := range s.Labels {
+				tags[k] = v
+			}
+			mf.Metrics = append(mf.Metrics, metric{
+				Name:      m.Name,
+				Type:      m.Type,
+				Help:      m.Help,
+				Unit:      m.Unit,
+				Tags:      tags,
+				Value:     s.Value,
+				Timestamp: s.Timestamp,
+				Exemplar:  s.Exemplar,
+				Histogram: s.Histogram,
+				Summary:   s.Summary,
+			})
+		}
+	}
+	return mf, nil
+}
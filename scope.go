@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+// scopeMetricFiles restricts files to the read prefixes of the presented
+// token or certificate identity. Anonymous requests are unrestricted unless
+// require_read_token is set; requests with an unrecognized token are
+// refused.
+func scopeMetricFiles(req events.Request, files []metricFile) ([]metricFile, bool) {
+	t, ok := lookupToken(req)
+	if !ok {
+		_, presented := req.Headers["Authorization"]
+		return files, !presented && !c.RequireReadToken
+	}
+	if t.Window(time.Now()) != nil {
+		return nil, false
+	}
+	if len(t.ReadPrefixes) == 0 {
+		return files, true
+	}
+
+	scoped := []metricFile{}
+	for _, mf := range files {
+		if hasAnyPrefix(mf.FileName, t.ReadPrefixes) {
+			scoped = append(scoped, mf)
+		}
+	}
+	return scoped, true
+}
+
+func hasAnyPrefix(name string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
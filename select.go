@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const selectHeaderQuery = "SELECT s.name, s.pushed_at, s.source, s.anomalies, s.skewed, s.version FROM S3Object s"
+
+// requestedFamilies returns the family names given with ?family=a,b
+func requestedFamilies(req events.Request) []string {
+	selected := req.QueryStringParameters["family"]
+	if selected == "" {
+		return nil
+	}
+	names := []string{}
+	for _, name := range strings.Split(selected, ",") {
+		names = append(names, strings.TrimSpace(name))
+	}
+	return names
+}
+
+// readFamilyFiles reads only the files holding the requested families, as
+// listed in the manifest. When select_min_bytes is set, files at or above
+// that size are filtered in S3 with S3 Select, so large files aren't
+// downloaded and parsed in full.
+func readFamilyFiles(client *s3.Client, mg *memoryGuard, names []string) ([]metricFile, error) {
+	var objects []types.Object
+	var err error
+	if hasSelfFamily(names) {
+		objects, err = listMetricObjects(client)
+	} else {
+		objects, err = manifestObjects(client, names)
+	}
+	if err != nil {
+		return []metricFile{}, err
+	}
+
+	metricFiles := []metricFile{}
+	for _, obj := range objects {
+		if mg.Exceeded() {
+			break
+		}
+		var mf metricFile
+		if c.SelectMinBytes > 0 && obj.Size >= c.SelectMinBytes {
+			mf, err = selectMetricFile(client, *obj.Key, names)
+		} else {
+			mf, err = readMetricFile(client, *obj.Key)
+		}
+		if errors.Is(err, errMetricFileMissing) {
+			continue
+		} else if err != nil {
+			return []metricFile{}, err
+		}
+		metricFiles = append(metricFiles, mf)
+	}
+	return metricFiles, nil
+}
+
+// hasSelfFamily reports whether any of the names is one of the exporter's own
+// metrics, which are computed from every file rather than stored in one
+func hasSelfFamily(names []string) bool {
+	for _, name := range names {
+		if strings.HasPrefix(name, selfMetricPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectMetricFile fetches a file's top-level fields and the metrics in the
+// named families with two S3 Select queries.
+func selectMetricFile(client *s3.Client, f string, names []string) (metricFile, error) {
+	quoted := []string{}
+	for _, name := range names {
+		if metricNameRegex.MatchString(name) {
+			quoted = append(quoted, "'"+name+"'")
+		}
+	}
+
+	var mf metricFile
+	err := selectObject(client, f, selectHeaderQuery, func(dec *json.Decoder) error {
+		return dec.Decode(&mf)
+	})
+	if err != nil {
+		return metricFile{}, err
+	}
+	if len(quoted) == 0 {
+		return mf, nil
+	}
+
+	query := fmt.Sprintf(
+		"SELECT m.* FROM S3Object[*].metrics[*] m WHERE m.name IN (%s)",
+		strings.Join(quoted, ", "),
+	)
+	err = selectObject(client, f, query, func(dec *json.Decoder) error {
+		for {
+			var m metric
+			err := dec.Decode(&m)
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := checkMetric(m); err != nil {
+				return fmt.Errorf("%s: %s", f, err)
+			}
+			mf.Metrics = append(mf.Metrics, m)
+		}
+	})
+	if err != nil {
+		return metricFile{}, err
+	}
+	traceCache("select")
+	return mf, nil
+}
+
+func selectObject(client *s3.Client, f, query string, decode func(*json.Decoder) error) error {
+	delimiter := "\n"
+	out, err := client.SelectObjectContent(context.TODO(), &s3.SelectObjectContentInput{
+		Bucket:         &c.MetricBucket,
+		Key:            &f,
+		Expression:     &query,
+		ExpressionType: types.ExpressionTypeSql,
+		InputSerialization: &types.InputSerialization{
+			JSON: &types.JSONInput{Type: types.JSONTypeDocument},
+		},
+		OutputSerialization: &types.OutputSerialization{
+			JSON: &types.JSONOutput{RecordDelimiter: &delimiter},
+		},
+	})
+	if err != nil {
+		return missingError(f, err)
+	}
+
+	stream := out.GetStream()
+	defer stream.Close()
+
+	var buf bytes.Buffer
+	for event := range stream.Events() {
+		if records, ok := event.(*types.SelectObjectContentEventStreamMemberRecords); ok {
+			buf.Write(records.Value.Payload)
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return err
+	}
+	return decode(json.NewDecoder(&buf))
+}
@@ -0,0 +1,47 @@
+package main
+
+const selfMetricPrefix = "hook_exporter_"
+
+func selfMetrics(files []metricFile) []metric {
+	metrics := freshnessMetrics(files)
+	metrics = append(metrics, tokenMetrics()...)
+	metrics = append(metrics, counterMetrics()...)
+	metrics = append(metrics, replicationMetrics(files)...)
+	metrics = append(metrics, lockMetrics()...)
+	metrics = append(metrics, reconcileMetrics()...)
+	metrics = append(metrics, bucketQuotaMetrics()...)
+	metrics = append(metrics, dedupMetrics()...)
+	for _, mf := range files {
+		for _, name := range mf.Anomalies {
+			metrics = append(metrics, metric{
+				Name:  "hook_exporter_value_anomaly",
+				Type:  "gauge",
+				Tags:  map[string]string{"file": mf.FileName, "metric": name},
+				Value: "1",
+			})
+		}
+		for _, name := range mf.Skewed {
+			metrics = append(metrics, metric{
+				Name:  "hook_exporter_timestamp_skew",
+				Type:  "gauge",
+				Tags:  map[string]string{"file": mf.FileName, "metric": name},
+				Value: "1",
+			})
+		}
+		if mf.Source == nil {
+			continue
+		}
+		metrics = append(metrics, metric{
+			Name: "hook_exporter_last_push_info",
+			Type: "gauge",
+			Tags: map[string]string{
+				"file":           mf.FileName,
+				"token":          mf.Source.Token,
+				"source_ip_hash": mf.Source.SourceIPHash,
+				"user_agent":     mf.Source.UserAgent,
+			},
+			Value: "1",
+		})
+	}
+	return metrics
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type selftestStage struct {
+	Name     string  `json:"name"`
+	Success  bool    `json:"success"`
+	Duration float64 `json:"duration_seconds"`
+	Error    string  `json:"error,omitempty"`
+}
+
+type selftestResult struct {
+	Success bool            `json:"success"`
+	Stages  []selftestStage `json:"stages"`
+}
+
+func (sr *selftestResult) Run(name string, fn func() error) bool {
+	start := time.Now()
+	err := fn()
+	stage := selftestStage{
+		Name:     name,
+		Success:  err == nil,
+		Duration: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		stage.Error = err.Error()
+		sr.Success = false
+	}
+	sr.Stages = append(sr.Stages, stage)
+	return err == nil
+}
+
+func selftestHandler(req events.Request) (events.Response, error) {
+	if req.HTTPMethod != "POST" {
+		return events.Respond(405, "selftest requires POST")
+	}
+
+	client, err := getClient()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+	}
+
+	now := time.Now()
+	mf := metricFile{
+		FileName: fmt.Sprintf("selftest/%d", now.UnixNano()),
+		Metrics: []metric{{
+			Name:  "hook_exporter_selftest",
+			Type:  "gauge",
+			Tags:  map[string]string{"run": fmt.Sprintf("%d", now.UnixNano())},
+			Value: fmt.Sprintf("%d", now.Unix()),
+		}},
+	}
+	result := runSelftest(client, mf)
+
+	code := 200
+	if !result.Success {
+		code = 500
+	}
+	return respondJSON(code, result)
+}
+
+func runSelftest(client *s3.Client, mf metricFile) selftestResult {
+	result := selftestResult{Success: true}
+	expected := mf.Metrics[0].String()
+
+	stages := []struct {
+		name string
+		fn   func() error
+	}{
+		{"validate", func() error {
+			return mf.checkStored()
+		}},
+		{"write", func() error {
+			return writeMetricFile(client, mf)
+		}},
+		{"list", func() error {
+			files, err := listMetricFiles(client)
+			if err != nil {
+				return err
+			}
+			for _, f := range files {
+				if f == mf.FileName {
+					return nil
+				}
+			}
+			return fmt.Errorf("%s missing from listing", mf.FileName)
+		}},
+		{"read", func() error {
+			stored, err := readMetricFile(client, mf.FileName)
+			if err != nil {
+				return err
+			}
+			if stored.String() != mf.String() {
+				return fmt.Errorf("stored content does not match pushed content")
+			}
+			return nil
+		}},
+		{"render", func() error {
+			allMetrics, err := readMetrics(client)
+			if err != nil {
+				return err
+			}
+			if !strings.Contains(allMetrics.String(), expected) {
+				return fmt.Errorf("synthetic metric missing from rendered output")
+			}
+			return nil
+		}},
+	}
+
+	written := false
+	for _, stage := range stages {
+		if !result.Run(stage.name, stage.fn) {
+			break
+		}
+		if stage.name == "write" {
+			written = true
+		}
+	}
+
+	if written {
+		result.Run("delete", func() error {
+			return deleteMetricFile(client, mf.FileName)
+		})
+	}
+	return result
+}
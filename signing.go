@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/kms/types"
+)
+
+const defaultSigningAlgorithm = types.SigningAlgorithmSpecEcdsaSha256
+
+// signResponse adds a detached KMS signature over the SHA-256 digest of the
+// response body when signing_key_id is configured. Consumers verify it with
+// the key's public half, from kms:GetPublicKey.
+func signResponse(resp *events.Response, body []byte) error {
+	if c.SigningKeyID == "" {
+		return nil
+	}
+
+	digest := sha256.Sum256(body)
+	algorithm := types.SigningAlgorithmSpec(c.SigningAlgorithm)
+	if algorithm == "" {
+		algorithm = defaultSigningAlgorithm
+	}
+
+	cfg, err := awsConfig.LoadDefaultConfig(context.TODO())
+	if err != nil {
+		return err
+	}
+	client := kms.NewFromConfig(cfg)
+	out, err := client.Sign(context.TODO(), &kms.SignInput{
+		KeyId:            &c.SigningKeyID,
+		Message:          digest[:],
+		MessageType:      types.MessageTypeDigest,
+		SigningAlgorithm: algorithm,
+	})
+	if err != nil {
+		return err
+	}
+
+	if resp.Headers == nil {
+		resp.Headers = map[string]string{}
+	}
+	resp.Headers["X-Content-SHA256"] = hex.EncodeToString(digest[:])
+	resp.Headers["X-Signature"] = base64.StdEncoding.EncodeToString(out.Signature)
+	resp.Headers["X-Signature-Key"] = *out.KeyId
+	resp.Headers["X-Signature-Algorithm"] = string(out.SigningAlgorithm)
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	defaultMaxFutureSkew = 5 * 60
+	defaultMaxPastAge    = 60 * 60
+
+	skewActionClamp  = "clamp"
+	skewActionFlag   = "flag"
+	skewActionReject = "reject"
+)
+
+// checkTimestamps validates per-metric timestamps (in milliseconds) against
+// the configured skew window. Far-future timestamps are always rejected;
+// far-past timestamps are clamped (dropped so the scrape time is used),
+// flagged, or rejected depending on config.
+func checkTimestamps(mf *metricFile, now time.Time) error {
+	maxFuture := c.MaxFutureSkew
+	if maxFuture == 0 {
+		maxFuture = defaultMaxFutureSkew
+	}
+	maxPast := c.MaxPastAge
+	if maxPast == 0 {
+		maxPast = defaultMaxPastAge
+	}
+	action := c.PastTimestampAction
+	if action == "" {
+		action = skewActionClamp
+	}
+
+	nowMs := now.UnixMilli()
+	mf.Skewed = nil
+	flagged := map[string]bool{}
+	for i, m := range mf.Metrics {
+		if m.Timestamp == 0 {
+			continue
+		}
+		if m.Timestamp > nowMs+maxFuture*1000 {
+			return fmt.Errorf("metric %s timestamp is more than %ds in the future", m.Name, maxFuture)
+		}
+		if m.Timestamp >= nowMs-maxPast*1000 {
+			continue
+		}
+		switch action {
+		case skewActionReject:
+			return fmt.Errorf("metric %s timestamp is more than %ds in the past", m.Name, maxPast)
+		case skewActionFlag:
+			if !flagged[m.Name] {
+				flagged[m.Name] = true
+				mf.Skewed = append(mf.Skewed, m.Name)
+			}
+		default:
+			mf.Metrics[i].Timestamp = 0
+		}
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+// snsHostRegex matches the hosts SNS serves signing certs and subscription
+// URLs from, so a forged message can't point us elsewhere
+var snsHostRegex = regexp.MustCompile(`^sns\.[a-z0-9\-]+\.amazonaws\.com(\.cn)?$`)
+
+// snsTimeout bounds fetching signing certs and confirming subscriptions. A
+// cert fetch holds snsCertLock, so a slow one would hold up every delivery.
+const snsTimeout = 5 * time.Second
+
+var (
+	snsCertLock sync.Mutex
+	snsCerts    = map[string]*x509.Certificate{}
+)
+
+// snsMessage is an SNS delivery, either the body of an HTTP(S) delivery or
+// the Sns field of a Lambda event record. Field names differ only in case
+// between the two, which encoding/json ignores.
+type snsMessage struct {
+	Type             string `json:"Type"`
+	MessageID        string `json:"MessageId"`
+	Token            string `json:"Token"`
+	TopicArn         string `json:"TopicArn"`
+	Subject          string `json:"Subject"`
+	Message          string `json:"Message"`
+	Timestamp        string `json:"Timestamp"`
+	SignatureVersion string `json:"SignatureVersion"`
+	Signature        string `json:"Signature"`
+	SigningCertURL   string `json:"SigningCertURL"`
+	SubscribeURL     string `json:"SubscribeURL"`
+}
+
+// handleSNS replays each record of an SNS event as a request to /sns, so it
+// passes through the same receivers and checks as an HTTP delivery
+func (sr *stageReceiver) handleSNS(ctx context.Context, raw json.RawMessage) (events.Response, error) {
+	var event struct {
+		Records []struct {
+			Sns json.RawMessage `json:"Sns"`
+		} `json:"Records"`
+	}
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return events.Fail(fmt.Sprintf("failed to parse sns event: %s", err))
+	}
+	for _, record := range event.Records {
+		resp, err := sr.HandleWithContext(ctx, events.Request{
+			HTTPMethod: "POST",
+			Path:       "/sns",
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       string(record.Sns),
+		})
+		if err != nil {
+			return resp, err
+		}
+		if resp.StatusCode >= 300 {
+			return resp, fmt.Errorf("sns record rejected with %d: %s", resp.StatusCode, resp.Body)
+		}
+	}
+	return events.Succeed("")
+}
+
+// snsHandler accepts SNS deliveries from the topics in sns_topics. The
+// message signature is verified in place of a bearer token, subscription
+// confirmations are completed, and notifications are pushed as metricFiles.
+// CloudWatch alarm notifications are converted to alarm state gauges.
+func snsHandler(req events.Request) (events.Response, error) {
+	body, err := req.DecodedBody()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+	}
+	var msg snsMessage
+	if err := json.Unmarshal([]byte(body), &msg); err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to unmarshal: %s", err))
+	}
+
+	if !snsTopicAllowed(msg.TopicArn) {
+		return events.Reject(fmt.Sprintf("topic not allowed: %s", msg.TopicArn))
+	}
+	if err := verifySNSMessage(msg); err != nil {
+		return events.Reject(fmt.Sprintf("invalid signature: %s", err))
+	}
+
+	switch msg.Type {
+	case "SubscriptionConfirmation":
+		if err := confirmSNSSubscription(msg); err != nil {
+			return events.Fail(fmt.Sprintf("failed to confirm subscription: %s", err))
+		}
+		return events.Succeed("")
+	case "UnsubscribeConfirmation":
+		return events.Succeed("")
+	case "Notification":
+	default:
+		return events.Respond(400, fmt.Sprintf("unsupported message type: %s", msg.Type))
+	}
+
+	if err := checkJSONLimits([]byte(msg.Message)); err != nil {
+		return events.Respond(400, fmt.Sprintf("rejected body: %s", err))
+	}
+	if mf, ok, err := parseAlarmMessage(msg.Message); ok {
+		if err != nil {
+			return events.Respond(400, fmt.Sprintf("failed to parse alarm: %s", err))
+		}
+		return pushMetricFile(req, mf)
+	}
+	mf, err := parseMetricFile([]byte(msg.Message))
+	if err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to unmarshal message: %s", err))
+	}
+	return pushMetricFile(req, mf)
+}
+
+func snsTopicAllowed(arn string) bool {
+	for _, t := range c.SNSTopics {
+		if t == arn {
+			return true
+		}
+	}
+	return false
+}
+
+// snsStringToSign builds the canonical string SNS signs for each type
+func snsStringToSign(msg snsMessage) string {
+	pairs := [][2]string{{"Message", msg.Message}, {"MessageId", msg.MessageID}}
+	if msg.Type == "Notification" {
+		if msg.Subject != "" {
+			pairs = append(pairs, [2]string{"Subject", msg.Subject})
+		}
+	} else {
+		pairs = append(pairs, [2]string{"SubscribeURL", msg.SubscribeURL})
+	}
+	pairs = append(pairs, [2]string{"Timestamp", msg.Timestamp})
+	if msg.Type != "Notification" {
+		pairs = append(pairs, [2]string{"Token", msg.Token})
+	}
+	pairs = append(pairs, [2]string{"TopicArn", msg.TopicArn}, [2]string{"Type", msg.Type})
+
+	s := ""
+	for _, p := range pairs {
+		s += p[0] + "\n" + p[1] + "\n"
+	}
+	return s
+}
+
+func verifySNSMessage(msg snsMessage) error {
+	var hash crypto.Hash
+	var digest []byte
+	switch msg.SignatureVersion {
+	case "1":
+		sum := sha1.Sum([]byte(snsStringToSign(msg)))
+		hash, digest = crypto.SHA1, sum[:]
+	case "2":
+		sum := sha256.Sum256([]byte(snsStringToSign(msg)))
+		hash, digest = crypto.SHA256, sum[:]
+	default:
+		return fmt.Errorf("unsupported signature version %s", msg.SignatureVersion)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(msg.Signature)
+	if err != nil {
+		return err
+	}
+	cert, err := snsCert(msg.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("signing cert does not hold an RSA key")
+	}
+	return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+}
+
+func snsURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "https" || !snsHostRegex.MatchString(u.Host) {
+		return "", fmt.Errorf("url is not an SNS endpoint: %s", raw)
+	}
+	return u.String(), nil
+}
+
+// snsCert fetches and caches the signing cert for certURL
+func snsCert(certURL string) (*x509.Certificate, error) {
+	certURL, err := snsURL(certURL)
+	if err != nil {
+		return nil, err
+	}
+
+	snsCertLock.Lock()
+	defer snsCertLock.Unlock()
+	if cert, ok := snsCerts[certURL]; ok {
+		traceCache("sns_cert_hit")
+		return cert, nil
+	}
+	traceCache("sns_cert_miss")
+
+	client := &http.Client{Timeout: snsTimeout}
+	resp, err := client.Get(certURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("signing cert is not PEM encoded")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	snsCerts[certURL] = cert
+	return cert, nil
+}
+
+func confirmSNSSubscription(msg snsMessage) error {
+	subscribeURL, err := snsURL(msg.SubscribeURL)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: snsTimeout}
+	resp, err := client.Get(subscribeURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("subscribe url returned %d", resp.StatusCode)
+	}
+	return nil
+}
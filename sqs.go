@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	lambdaEvents "github.com/aws/aws-lambda-go/events"
+)
+
+// handleSQS pushes the metricFile in each record of an SQS batch. Records
+// that fail are reported individually, so SQS retries only those and moves
+// them to the queue's dead letter queue once retries run out. The event
+// source mapping needs ReportBatchItemFailures enabled.
+func (sr *stageReceiver) handleSQS(ctx context.Context, raw json.RawMessage) (lambdaEvents.SQSEventResponse, error) {
+	var event lambdaEvents.SQSEvent
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return lambdaEvents.SQSEventResponse{}, err
+	}
+
+	result := lambdaEvents.SQSEventResponse{
+		BatchItemFailures: []lambdaEvents.SQSBatchItemFailure{},
+	}
+	for _, record := range event.Records {
+		req := events.Request{
+			HTTPMethod: "POST",
+			Path:       "/sqs",
+			Body:       record.Body,
+		}
+		resp, err := sr.inStage(ctx, req, func() (events.Response, error) {
+			return pushRoute(sqsRecordHandler)(req)
+		})
+		if err == nil && resp.StatusCode >= 300 {
+			err = fmt.Errorf("rejected with %d: %s", resp.StatusCode, resp.Body)
+		}
+		if err != nil {
+			fmt.Printf("sqs message %s failed: %s\n", record.MessageId, err)
+			result.BatchItemFailures = append(result.BatchItemFailures, lambdaEvents.SQSBatchItemFailure{
+				ItemIdentifier: record.MessageId,
+			})
+		}
+	}
+	return result, nil
+}
+
+func sqsRecordHandler(req events.Request) (events.Response, error) {
+	err := checkJSONLimits([]byte(req.Body))
+	if err != nil {
+		return events.Respond(400, fmt.Sprintf("rejected body: %s", err))
+	}
+	mf, err := parseMetricFile([]byte(req.Body))
+	if err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to unmarshal: %s", err))
+	}
+	return pushMetricFile(req, mf)
+}
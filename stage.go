@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/akerl/go-lambda/mux"
+	"github.com/akerl/go-lambda/s3"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+var (
+	stageFiles  = map[string]*s3.ConfigFile{}
+	stageLock   sync.RWMutex
+	environment string
+)
+
+// stageReceiver selects the config for each request from API Gateway stage
+// variables or the invoked Lambda alias, so one function version can serve
+// several stages. Requests are handled one at a time per Lambda environment,
+// so the selected config is swapped into place for the duration of the call,
+// holding stageLock, which config reloads also take. Standalone requests
+// only use the default config, and hold stageLock for reading.
+type stageReceiver struct {
+	mux.Receiver
+}
+
+func (sr *stageReceiver) HandleWithContext(ctx context.Context, req events.Request) (events.Response, error) {
+	return sr.inStage(ctx, req, func() (events.Response, error) {
+		return sr.Receiver.Handle(req)
+	})
+}
+
+// HandleInvocation accepts API Gateway requests as well as the non-HTTP
+// event sources the exporter can be wired to, which are told apart by the
+// records they carry.
+func (sr *stageReceiver) HandleInvocation(ctx context.Context, raw json.RawMessage) (interface{}, error) {
+	// SNS records spell it EventSource and others eventSource, which
+	// encoding/json matches alike
+	var probe struct {
+		Records []struct {
+			EventSource string `json:"eventSource"`
+		} `json:"Records"`
+	}
+	if err := json.Unmarshal(raw, &probe); err == nil && len(probe.Records) > 0 {
+		switch probe.Records[0].EventSource {
+		case "aws:sns":
+			return sr.handleSNS(ctx, raw)
+		case "aws:sqs":
+			return sr.handleSQS(ctx, raw)
+		case "aws:s3":
+			return sr.handleS3Drop(ctx, raw)
+		}
+	}
+
+	var eventProbe struct {
+		DetailType string `json:"detail-type"`
+	}
+	if err := json.Unmarshal(raw, &eventProbe); err == nil && eventProbe.DetailType != "" {
+		return sr.handleEventBridge(ctx, raw)
+	}
+
+	var req events.Request
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return events.Fail(fmt.Sprintf("failed to parse invocation: %s", err))
+	}
+	return sr.HandleWithContext(ctx, req)
+}
+
+// inStage runs handle with the config for the request's stage swapped in
+func (sr *stageReceiver) inStage(ctx context.Context, req events.Request, handle func() (events.Response, error)) (events.Response, error) {
+	alias := ""
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		alias = aliasFromARN(lc.InvokedFunctionArn)
+	}
+
+	params := events.Params{Request: &req}
+	bucket := stageLookup(params, alias, "S3_BUCKET")
+	key := stageLookup(params, alias, "S3_KEY")
+	env := stageLookup(params, alias, "ENVIRONMENT")
+	if env == "" {
+		env = alias
+	}
+
+	stageLock.Lock()
+	defer stageLock.Unlock()
+
+	defer func() {
+		c, cf = defaultConfig, defaultFile
+		environment = ""
+	}()
+
+	sc, scf, err := stageConfig(bucket, key)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load stage config: %s", err))
+	}
+	if sc != nil {
+		c, cf = sc, scf
+	}
+	environment = env
+	return handle()
+}
+
+// stageLookup checks stage variables and the environment, preferring an
+// alias-specific environment variable (e.g. S3_KEY_PROD) when one is set.
+func stageLookup(params events.Params, alias, name string) string {
+	if v := params.Request.StageVariables[name]; v != "" {
+		return v
+	}
+	if alias != "" {
+		if v := os.Getenv(name + "_" + strings.ToUpper(alias)); v != "" {
+			return v
+		}
+	}
+	return params.Lookup(name)
+}
+
+func aliasFromARN(arn string) string {
+	parts := strings.Split(arn, ":")
+	if len(parts) != 8 {
+		return ""
+	}
+	return parts[7]
+}
+
+// stageConfig returns the config for a non-default bucket/key, loading it on
+// first use. It returns nil when the default config applies.
+func stageConfig(bucket, key string) (*config, *s3.ConfigFile, error) {
+	if bucket == os.Getenv("S3_BUCKET") && key == os.Getenv("S3_KEY") {
+		return nil, nil, nil
+	}
+
+	id := bucket + "/" + key
+	if scf, ok := stageFiles[id]; ok {
+		return *scf.Config.(**config), scf, nil
+	}
+
+	var sc *config
+	scf, err := s3.GetConfig(bucket, key, &sc)
+	if err != nil {
+		return nil, nil, err
+	}
+	scf.OnError = func(_ *s3.ConfigFile, err error) {
+		fmt.Println(err)
+	}
+	if err := loadPinnedConfig(scf); err != nil {
+		return nil, nil, err
+	}
+	watchConfig(scf)
+
+	stageFiles[id] = scf
+	return *scf.Config.(**config), scf, nil
+}
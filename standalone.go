@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/akerl/go-lambda/mux"
+)
+
+// standalone is set when serving HTTP directly. Requests are then handled
+// concurrently, each holding stageLock for reading, so config reloads wait
+// for them and none of them sees c change partway through.
+var standalone bool
+
+// serveStandalone runs the dispatcher as a plain HTTP server instead of a
+// Lambda handler. TLS is enabled when TLS_CERT_FILE and TLS_KEY_FILE are set,
+// and client certificates are verified against TLS_CLIENT_CA_FILE if given.
+func serveStandalone(addr string, r mux.Receiver) error {
+	server := &http.Server{
+		Addr:    addr,
+		Handler: standaloneHandler(r),
+	}
+
+	certFile := os.Getenv("TLS_CERT_FILE")
+	keyFile := os.Getenv("TLS_KEY_FILE")
+	if certFile == "" || keyFile == "" {
+		return server.ListenAndServe()
+	}
+
+	if caFile := os.Getenv("TLS_CLIENT_CA_FILE"); caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("no certificates found in %s", caFile)
+		}
+		server.TLSConfig = &tls.Config{
+			ClientAuth: tls.VerifyClientCertIfGiven,
+			ClientCAs:  pool,
+		}
+	}
+	return server.ListenAndServeTLS(certFile, keyFile)
+}
+
+func standaloneHandler(r mux.Receiver) http.HandlerFunc {
+	return func(w http.ResponseWriter, hr *http.Request) {
+		stageLock.RLock()
+		defer stageLock.RUnlock()
+
+		req, err := toRequest(w, hr)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("rejected body: body exceeds %d bytes", tooLarge.Limit), 413)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("failed to read request: %s", err), 400)
+			return
+		}
+
+		resp, err := r.Handle(req)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		writeResponse(w, resp)
+	}
+}
+
+// toRequest converts an HTTP request into an API Gateway event. Bodies are
+// capped at max_body_bytes as they are read, since API Gateway's own limit
+// doesn't apply.
+func toRequest(w http.ResponseWriter, hr *http.Request) (events.Request, error) {
+	limit := int64(effectiveJSONLimits().MaxBodyBytes)
+	body, err := io.ReadAll(http.MaxBytesReader(w, hr.Body, limit))
+	if err != nil {
+		return events.Request{}, err
+	}
+
+	req := events.Request{
+		Path:                  hr.URL.Path,
+		HTTPMethod:            hr.Method,
+		Headers:               map[string]string{},
+		QueryStringParameters: map[string]string{},
+		PathParameters:        map[string]string{},
+		StageVariables:        map[string]string{},
+		Body:                  base64.StdEncoding.EncodeToString(body),
+		IsBase64Encoded:       true,
+	}
+	for k := range hr.Header {
+		req.Headers[k] = hr.Header.Get(k)
+	}
+	for k := range hr.URL.Query() {
+		req.QueryStringParameters[k] = hr.URL.Query().Get(k)
+	}
+
+	if host, _, err := net.SplitHostPort(hr.RemoteAddr); err == nil {
+		req.RequestContext.Identity.SourceIP = host
+	}
+	req.RequestContext.Identity.UserAgent = hr.UserAgent()
+
+	if c.ClientCertHeader != "" {
+		delete(req.Headers, http.CanonicalHeaderKey(c.ClientCertHeader))
+		delete(req.Headers, c.ClientCertHeader)
+		if hr.TLS != nil && len(hr.TLS.VerifiedChains) > 0 {
+			req.Headers[c.ClientCertHeader] = hr.TLS.VerifiedChains[0][0].Subject.String()
+		}
+	}
+	return req, nil
+}
+
+func writeResponse(w http.ResponseWriter, resp events.Response) {
+	for k, v := range resp.Headers {
+		w.Header().Set(k, v)
+	}
+	for k, vs := range resp.MultiValueHeaders {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+
+	code := resp.StatusCode
+	if code == 0 {
+		code = 200
+	}
+	w.WriteHeader(code)
+
+	body := []byte(resp.Body)
+	if resp.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(resp.Body)
+		if err == nil {
+			body = decoded
+		}
+	}
+	if _, err := w.Write(body); err != nil {
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+var statsdNameReplacer = strings.NewReplacer(".", "_", ":", "_", " ", "_")
+
+type statsdSeries struct {
+	name   string
+	tags   map[string]string
+	kind   string
+	value  float64
+	count  int
+	values map[string]bool
+}
+
+// statsdHandler accepts newline-delimited statsd lines for the file given by
+// ?name=. Counters and timer sums accumulate onto the stored values, so
+// repeated pushes behave like a statsd server's running totals; metrics not
+// in the push are kept.
+func statsdHandler(req events.Request) (events.Response, error) {
+	name := req.QueryStringParameters["name"]
+	if name == "" {
+		return events.Respond(400, "statsd pushes require a ?name= file name")
+	}
+
+	body, err := req.DecodedBody()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+	}
+	if max := effectiveJSONLimits().MaxBodyBytes; len(body) > max {
+		return events.Respond(400, fmt.Sprintf("rejected body: body exceeds %d bytes", max))
+	}
+
+	mf, err := parseStatsd(name, body)
+	if err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to parse: %s", err))
+	}
+	mf.accumulate = true
+	return pushMetricFile(req, mf)
+}
+
+// parseStatsd converts statsd lines into metrics. Counters become counters,
+// gauges become gauges, sets become a gauge of distinct values, and timers
+// and histograms become _sum and _count counters (timers in seconds).
+func parseStatsd(name, body string) (metricFile, error) {
+	series := map[string]*statsdSeries{}
+	order := []string{}
+
+	for i, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		s, sample, rate, err := parseStatsdLine(line)
+		if err != nil {
+			return metricFile{}, fmt.Errorf("line %d: %s", i+1, err)
+		}
+
+		key := s.kind + "|" + s.name + "|" + labelString(s.tags)
+		existing, ok := series[key]
+		if !ok {
+			existing = s
+			existing.values = map[string]bool{}
+			series[key] = existing
+			order = append(order, key)
+		}
+
+		switch s.kind {
+		case "c":
+			v, err := parseValue(sample)
+			if err != nil {
+				return metricFile{}, fmt.Errorf("line %d: invalid value %s", i+1, sample)
+			}
+			existing.value += v / rate
+		case "g":
+			if strings.HasPrefix(sample, "+") || strings.HasPrefix(sample, "-") {
+				return metricFile{}, fmt.Errorf("line %d: relative gauges are not supported", i+1)
+			}
+			v, err := parseValue(sample)
+			if err != nil {
+				return metricFile{}, fmt.Errorf("line %d: invalid value %s", i+1, sample)
+			}
+			existing.value = v
+		case "s":
+			existing.values[sample] = true
+		default:
+			v, err := parseValue(sample)
+			if err != nil {
+				return metricFile{}, fmt.Errorf("line %d: invalid value %s", i+1, sample)
+			}
+			if s.kind == "ms" {
+				v /= 1000
+			}
+			existing.value += v
+			existing.count++
+		}
+	}
+
+	mf := metricFile{FileName: name}
+	for _, key := range order {
+		s := series[key]
+		switch s.kind {
+		case "c":
+			mf.Metrics = append(mf.Metrics, statsdMetric(s.name, "counter", s.tags, s.value))
+		case "g":
+			mf.Metrics = append(mf.Metrics, statsdMetric(s.name, "gauge", s.tags, s.value))
+		case "s":
+			mf.Metrics = append(mf.Metrics, statsdMetric(s.name, "gauge", s.tags, float64(len(s.values))))
+		default:
+			base := s.name
+			if s.kind == "ms" {
+				base += "_seconds"
+			}
+			mf.Metrics = append(mf.Metrics,
+				statsdMetric(base+"_sum", "counter", s.tags, s.value),
+				statsdMetric(base+"_count", "counter", s.tags, float64(s.count)),
+			)
+		}
+	}
+	return mf, nil
+}
+
+// parseStatsdLine splits `name:value|type|@rate|#tag:value,...`
+func parseStatsdLine(line string) (*statsdSeries, string, float64, error) {
+	colon := strings.Index(line, ":")
+	if colon <= 0 {
+		return nil, "", 0, fmt.Errorf("missing value")
+	}
+	parts := strings.Split(line[colon+1:], "|")
+	if len(parts) < 2 {
+		return nil, "", 0, fmt.Errorf("missing type")
+	}
+
+	s := &statsdSeries{
+		name: statsdNameReplacer.Replace(line[:colon]),
+		kind: parts[1],
+		tags: map[string]string{},
+	}
+	switch s.kind {
+	case "c", "g", "s", "ms", "h", "d":
+	default:
+		return nil, "", 0, fmt.Errorf("unsupported type %s", s.kind)
+	}
+
+	rate := 1.0
+	for _, p := range parts[2:] {
+		switch {
+		case strings.HasPrefix(p, "@"):
+			r, err := strconv.ParseFloat(p[1:], 64)
+			if err != nil || r <= 0 || r > 1 {
+				return nil, "", 0, fmt.Errorf("invalid sample rate %s", p)
+			}
+			rate = r
+		case strings.HasPrefix(p, "#"):
+			for _, tag := range strings.Split(p[1:], ",") {
+				kv := strings.SplitN(tag, ":", 2)
+				if len(kv) == 1 {
+					kv = append(kv, "true")
+				}
+				s.tags[statsdNameReplacer.Replace(kv[0])] = kv[1]
+			}
+		}
+	}
+	return s, parts[0], rate, nil
+}
+
+func statsdMetric(name, kind string, tags map[string]string, value float64) metric {
+	return metric{
+		Name:  name,
+		Type:  kind,
+		Tags:  tags,
+		Value: formatValue(value),
+	}
+}
+
+// accumulateExisting adds the stored values of counter series to the pushed
+// ones and keeps stored series that weren't pushed
+func accumulateExisting(client *s3.Client, mf *metricFile) error {
+	old, err := readMetricFile(client, mf.FileName)
+	if errors.Is(err, errMetricFileMissing) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	accumulateInto(old.Metrics, mf)
+	return nil
+}
+
+func accumulateInto(old []metric, mf *metricFile) {
+	previous := map[string]metric{}
+	for _, m := range old {
+		previous[seriesKey(m)] = m
+	}
+
+	for i, m := range mf.Metrics {
+		key := seriesKey(m)
+		p, ok := previous[key]
+		delete(previous, key)
+		if !ok || m.Type != "counter" || p.Type != "counter" {
+			continue
+		}
+		oldValue, err := parseValue(p.Value)
+		if err != nil {
+			continue
+		}
+		newValue, err := parseValue(m.Value)
+		if err != nil {
+			continue
+		}
+		mf.Metrics[i].Value = formatValue(oldValue + newValue)
+	}
+
+	kept := make([]string, 0, len(previous))
+	for key := range previous {
+		kept = append(kept, key)
+	}
+	sort.Strings(kept)
+	for _, key := range kept {
+		mf.Metrics = append(mf.Metrics, previous[key])
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	stripeScheme = "stripe"
+
+	// stripeTolerance is how old a signed Stripe timestamp may be, matching
+	// Stripe's own libraries
+	stripeTolerance = 5 * time.Minute
+)
+
+// stripeRuleset is the bundled ruleset served at /hook/stripe. Amounts are in
+// the currency's smallest unit, as Stripe reports them, and active
+// subscriptions are the created total minus the canceled total.
+var stripeRuleset = transformRuleset{
+	Name:       "stripe",
+	File:       "stripe",
+	Accumulate: true,
+	Signature:  &transformSignature{Scheme: stripeScheme},
+	Metrics: []transformMetric{
+		{
+			Name:  "stripe_charges_total",
+			Type:  "counter",
+			When:  "type == 'charge.succeeded' || type == 'charge.failed'",
+			Value: "`1`",
+			Tags:  map[string]string{"currency": "data.object.currency", "status": "data.object.status"},
+		},
+		{
+			Name:  "stripe_revenue_minor_units_total",
+			Type:  "counter",
+			When:  "type == 'charge.succeeded'",
+			Value: "data.object.amount",
+			Tags:  map[string]string{"currency": "data.object.currency"},
+		},
+		{
+			Name:  "stripe_refunded_minor_units_total",
+			Type:  "counter",
+			When:  "type == 'charge.refunded'",
+			Value: "data.object.amount_refunded",
+			Tags:  map[string]string{"currency": "data.object.currency"},
+		},
+		{
+			Name:  "stripe_invoices_paid_total",
+			Type:  "counter",
+			When:  "type == 'invoice.paid'",
+			Value: "`1`",
+			Tags:  map[string]string{"currency": "data.object.currency"},
+		},
+		{
+			Name:  "stripe_payment_failures_total",
+			Type:  "counter",
+			When:  "type == 'invoice.payment_failed'",
+			Value: "`1`",
+			Tags:  map[string]string{"currency": "data.object.currency"},
+		},
+		{
+			Name:  "stripe_subscriptions_created_total",
+			Type:  "counter",
+			When:  "type == 'customer.subscription.created'",
+			Value: "`1`",
+			Tags:  map[string]string{"plan": "data.object.items.data[0].price.id"},
+		},
+		{
+			Name:  "stripe_subscriptions_canceled_total",
+			Type:  "counter",
+			When:  "type == 'customer.subscription.deleted'",
+			Value: "`1`",
+			Tags:  map[string]string{"plan": "data.object.items.data[0].price.id"},
+		},
+		{
+			Name:  "stripe_last_event_timestamp_seconds",
+			Type:  "gauge",
+			Value: "created",
+			Tags:  map[string]string{"type": "type"},
+		},
+	},
+}
+
+// builtinTransforms are bundled rulesets, used unless transforms defines a
+// ruleset with the same name
+var builtinTransforms = []transformRuleset{stripeRuleset}
+
+// stripeToken checks a Stripe-Signature header of the form
+// t=<timestamp>,v1=<hex>[,v1=<hex>...], which signs "<timestamp>.<body>"
+func stripeToken(header string, body []byte, now time.Time) (tokenConfig, bool) {
+	var timestamp string
+	signatures := [][]byte{}
+	for _, part := range strings.Split(header, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "t":
+			timestamp = v
+		case "v1":
+			if sig, err := hex.DecodeString(v); err == nil {
+				signatures = append(signatures, sig)
+			}
+		}
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return tokenConfig{}, false
+	}
+	age := now.Sub(time.Unix(ts, 0))
+	if age > stripeTolerance || age < -stripeTolerance {
+		return tokenConfig{}, false
+	}
+
+	signed := append([]byte(timestamp+"."), body...)
+	for _, sig := range signatures {
+		if t, ok := hmacToken(sig, signed); ok {
+			return t, true
+		}
+	}
+	return tokenConfig{}, false
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// summary is a summary sample: the value at each quantile, keyed by the
+// quantile, and the sum and count of observations. Like histogram bounds,
+// quantiles and values are strings, so NaN can be written for quantiles
+// without observations.
+type summary struct {
+	Quantiles map[string]string `json:"quantiles"`
+	Sum       string            `json:"sum"`
+	Count     uint64            `json:"count"`
+}
+
+// sortedQuantiles orders a summary's quantiles numerically, which is how
+// they are rendered
+func (s *summary) sortedQuantiles() []string {
+	keys := make([]string, 0, len(s.Quantiles))
+	for q := range s.Quantiles {
+		keys = append(keys, q)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, _ := parseValue(keys[i])
+		b, _ := parseValue(keys[j])
+		return a < b
+	})
+	return keys
+}
+
+// summarySamples expands a summary metric into its quantile series and its
+// _sum and _count series
+func (m metric) summarySamples() []metric {
+	samples := []metric{}
+	for _, q := range m.Summary.sortedQuantiles() {
+		tags := make(map[string]string, len(m.Tags)+1)
+		for k, v := range m.Tags {
+			tags[k] = v
+		}
+		tags["quantile"] = q
+		samples = append(samples, metric{Name: m.Name, Type: m.Type, Tags: tags, Value: m.Summary.Quantiles[q], Timestamp: m.Timestamp})
+	}
+	return append(samples,
+		metric{Name: m.Name + "_sum", Type: m.Type, Tags: m.Tags, Value: m.Summary.Sum, Timestamp: m.Timestamp},
+		metric{Name: m.Name + "_count", Type: m.Type, Tags: m.Tags, Value: strconv.FormatUint(m.Summary.Count, 10), Timestamp: m.Timestamp},
+	)
+}
+
+// checkSummary requires quantiles to be distinct and between 0 and 1, and
+// only allows summaries to carry them
+func checkSummary(m metric) []validationFinding {
+	finding := func(format string, args ...interface{}) []validationFinding {
+		return []validationFinding{{Metric: m.Name, Message: fmt.Sprintf(format, args...)}}
+	}
+	s := m.Summary
+	if m.Type != "summary" {
+		return finding("quantiles are only allowed on summaries, not %s", m.Type)
+	}
+	if _, ok := m.Tags["quantile"]; ok {
+		return finding("summary tags cannot include quantile")
+	}
+	if !validValue(s.Sum) {
+		return finding("invalid summary sum %q", s.Sum)
+	}
+	seen := map[float64]string{}
+	for _, q := range s.sortedQuantiles() {
+		v, err := parseValue(q)
+		if err != nil || math.IsNaN(v) || v < 0 || v > 1 {
+			return finding("invalid quantile %q", q)
+		}
+		if other, ok := seen[v]; ok {
+			return finding("quantiles %q and %q are the same", other, q)
+		}
+		seen[v] = q
+		if !validValue(s.Quantiles[q]) {
+			return finding("invalid value %q for quantile %s", s.Quantiles[q], q)
+		}
+	}
+	return nil
+}
+
+// appendProtoSummary encodes an io.prometheus.client.Summary
+func appendProtoSummary(buf []byte, field int, s *summary) ([]byte, error) {
+	sum, err := parseValue(s.Sum)
+	if err != nil {
+		return nil, err
+	}
+	var msg []byte
+	msg = appendProtoVarint(msg, 1, s.Count)
+	msg = appendProtoDouble(msg, 2, sum)
+	for _, q := range s.sortedQuantiles() {
+		quantile, err := parseValue(q)
+		if err != nil {
+			return nil, err
+		}
+		value, err := parseValue(s.Quantiles[q])
+		if err != nil {
+			return nil, err
+		}
+		var entry []byte
+		entry = appendProtoDouble(entry, 1, quantile)
+		entry = appendProtoDouble(entry, 2, value)
+		msg = appendProtoBytes(msg, 3, entry)
+	}
+	return appendProtoBytes(buf, field, msg), nil
+}
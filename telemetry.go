@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/akerl/go-lambda/mux"
+	"github.com/aws/smithy-go/middleware"
+)
+
+var s3Calls int64
+
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+type emfDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+type emfLine struct {
+	AWS         emfMetadata `json:"_aws"`
+	Route       string      `json:"Route"`
+	Environment string      `json:"Environment,omitempty"`
+	Invocations int         `json:"Invocations"`
+	Errors      int         `json:"Errors"`
+	S3Calls     int64       `json:"S3Calls"`
+	Duration    float64     `json:"Duration"`
+}
+
+// instrumentedReceiver wraps a Receiver and writes a CloudWatch Embedded
+// Metric Format line for each request it handles.
+type instrumentedReceiver struct {
+	mux.Receiver
+}
+
+func (ir *instrumentedReceiver) Handle(req events.Request) (events.Response, error) {
+	start := time.Now()
+	calls := atomic.LoadInt64(&s3Calls)
+
+	resp, err := ir.Receiver.Handle(req)
+	class := routeClass(req.HTTPMethod, req.Path)
+	countRequest(class, resp.StatusCode, err)
+	observeLatency(class, time.Since(start))
+
+	if c.EMFNamespace != "" {
+		errors := 0
+		if err != nil || resp.StatusCode >= 500 {
+			errors = 1
+		}
+		writeEMF(emfLine{
+			Route:       routeFamily(req.Path),
+			Environment: environment,
+			Invocations: 1,
+			Errors:      errors,
+			S3Calls:     atomic.LoadInt64(&s3Calls) - calls,
+			Duration:    float64(time.Since(start).Microseconds()) / 1000,
+		}, start)
+	}
+	return resp, err
+}
+
+func writeEMF(line emfLine, ts time.Time) {
+	line.AWS = emfMetadata{
+		Timestamp: ts.UnixMilli(),
+		CloudWatchMetrics: []emfDirective{{
+			Namespace:  c.EMFNamespace,
+			Dimensions: [][]string{{"Route"}},
+			Metrics: []emfMetric{
+				{Name: "Invocations", Unit: "Count"},
+				{Name: "Errors", Unit: "Count"},
+				{Name: "S3Calls", Unit: "Count"},
+				{Name: "Duration", Unit: "Milliseconds"},
+			},
+		}},
+	}
+	body, err := json.Marshal(line)
+	if err != nil {
+		fmt.Printf("failed to marshal emf line: %s\n", err)
+		return
+	}
+	fmt.Println(string(body))
+}
+
+// routeFamily reduces a request path to its first segment to keep the EMF
+// dimension cardinality bounded.
+func routeFamily(path string) string {
+	segment := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+	if segment == "" {
+		return "index"
+	}
+	return segment
+}
+
+func countS3Calls(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc(
+		"CountS3Calls",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (
+			middleware.InitializeOutput, middleware.Metadata, error,
+		) {
+			atomic.AddInt64(&s3Calls, 1)
+			return next.HandleInitialize(ctx, in)
+		},
+	), middleware.Before)
+}
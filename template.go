@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/akerl/go-lambda/apigw/events"
+)
+
+type templateLimits struct {
+	MaxBodyBytes int   `json:"max_body_bytes"`
+	RateLimit    int   `json:"rate_limit,omitempty"`
+	SeriesQuota  int   `json:"series_quota,omitempty"`
+	BytesQuota   int64 `json:"bytes_quota,omitempty"`
+}
+
+type templateResponse struct {
+	Type       string         `json:"type"`
+	Token      string         `json:"token"`
+	File       string         `json:"file"`
+	Endpoint   string         `json:"endpoint"`
+	Payload    interface{}    `json:"payload"`
+	Curl       string         `json:"curl"`
+	PowerShell string         `json:"powershell"`
+	Limits     templateLimits `json:"limits"`
+	Notes      []string       `json:"notes,omitempty"`
+}
+
+var templateTypes = map[string]func(file string) (string, interface{}){
+	"cronjob": func(file string) (string, interface{}) {
+		return "/job/" + file + "/result", jobResult{
+			ExitCode:        new(int),
+			DurationSeconds: 42,
+			Hostname:        "my-host",
+		}
+	},
+	"ci": func(file string) (string, interface{}) {
+		tags := map[string]string{"pipeline": "main"}
+		return "/metric", metricFile{FileName: file, Metrics: []metric{{
+			Name:  "ci_build_duration_seconds",
+			Type:  "gauge",
+			Tags:  tags,
+			Value: "180",
+			Unit:  "seconds",
+		}, {
+			Name:  "ci_build_success",
+			Type:  "gauge",
+			Tags:  tags,
+			Value: "1",
+		}}}
+	},
+	"heartbeat": func(file string) (string, interface{}) {
+		return "/metric", metricFile{FileName: file, Metrics: []metric{{
+			Name:  "heartbeat_timestamp_seconds",
+			Type:  "gauge",
+			Tags:  map[string]string{},
+			Value: "1700000000",
+			Unit:  "seconds",
+		}}}
+	},
+}
+
+// templateHandler returns an example push for the calling token, built from
+// the live config so the suggested file name and limits will be accepted.
+func templateHandler(req events.Request) (events.Response, error) {
+	kind := req.QueryStringParameters["type"]
+	build, ok := templateTypes[kind]
+	if !ok {
+		kinds := make([]string, 0, len(templateTypes))
+		for k := range templateTypes {
+			kinds = append(kinds, k)
+		}
+		sort.Strings(kinds)
+		return events.Respond(400, fmt.Sprintf("type must be one of: %s", strings.Join(kinds, ", ")))
+	}
+
+	t, _ := lookupToken(req)
+	file := t.Name + "/" + kind
+	if len(t.ReadPrefixes) > 0 {
+		file = t.ReadPrefixes[0] + kind
+	}
+	path, payload := build(file)
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to marshal: %s", err))
+	}
+
+	base := "$EXPORTER_URL"
+	if host := req.Headers["Host"]; host != "" {
+		base = "https://" + host
+	}
+	url := base + path
+
+	resp := templateResponse{
+		Type:     kind,
+		Token:    t.Name,
+		File:     file,
+		Endpoint: path,
+		Payload:  payload,
+		Curl: fmt.Sprintf(
+			"curl -s -XPOST -H \"Authorization: Bearer $EXPORTER_TOKEN\" -d '%s' %s",
+			body, url,
+		),
+		PowerShell: fmt.Sprintf(
+			"Invoke-RestMethod -Method Post -Uri '%s' -Headers @{Authorization = \"Bearer $env:EXPORTER_TOKEN\"} -Body '%s'",
+			url, body,
+		),
+		Limits: templateLimits{
+			MaxBodyBytes: effectiveJSONLimits().MaxBodyBytes,
+			RateLimit:    t.RateLimit,
+			SeriesQuota:  t.SeriesQuota,
+			BytesQuota:   t.BytesQuota,
+		},
+	}
+
+	if c.RequireRegistration {
+		resp.Notes = append(resp.Notes, fmt.Sprintf("%s must be registered by an admin before the first push", file))
+	}
+	if kind == "heartbeat" {
+		resp.Notes = append(resp.Notes, "replace the value with the current unix time on each push")
+	}
+	return respondJSON(200, resp)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Window checks whether the token is currently inside its validity window
+func (t tokenConfig) Window(now time.Time) error {
+	if t.NotBefore != "" {
+		notBefore, err := time.Parse(time.RFC3339, t.NotBefore)
+		if err != nil {
+			return fmt.Errorf("token has invalid not_before")
+		}
+		if now.Before(notBefore) {
+			return fmt.Errorf("token not yet valid")
+		}
+	}
+	if t.Expires != "" {
+		expires, err := time.Parse(time.RFC3339, t.Expires)
+		if err != nil {
+			return fmt.Errorf("token has invalid expires")
+		}
+		if !now.Before(expires) {
+			return fmt.Errorf("token expired")
+		}
+	}
+	return nil
+}
+
+func tokenMetrics() []metric {
+	now := time.Now()
+	metrics := []metric{}
+	for _, t := range c.Tokens {
+		if t.Expires == "" {
+			continue
+		}
+		expires, err := time.Parse(time.RFC3339, t.Expires)
+		if err != nil {
+			continue
+		}
+		tags := map[string]string{"token": t.Name}
+		expired := "0"
+		if !now.Before(expires) {
+			expired = "1"
+		}
+		metrics = append(metrics, metric{
+			Name:  "hook_exporter_token_expiry_timestamp_seconds",
+			Type:  "gauge",
+			Tags:  tags,
+			Value: fmt.Sprintf("%d", expires.Unix()),
+		}, metric{
+			Name:  "hook_exporter_token_expired",
+			Type:  "gauge",
+			Tags:  tags,
+			Value: expired,
+		})
+	}
+	return metrics
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/jmespath/go-jmespath"
+)
+
+const transformPrefix = "hook/"
+
+// transformRuleset maps an arbitrary webhook payload, posted to
+// /hook/<name>, to metrics using JMESPath expressions. Payloads for which
+// When is falsy are accepted and ignored. With Each set, the metrics are
+// evaluated once per element of the array it selects.
+type transformRuleset struct {
+	Name       string              `json:"name"`
+	File       string              `json:"file"`
+	FilePath   string              `json:"file_path"`
+	When       string              `json:"when"`
+	Each       string              `json:"each"`
+	Accumulate bool                `json:"accumulate"`
+	Signature  *transformSignature `json:"signature"`
+	Metrics    []transformMetric   `json:"metrics"`
+}
+
+// transformSignature authenticates deliveries by an HMAC-SHA256 of the body
+// keyed with a token's hmac_secret, in place of a bearer token. Setting
+// Scheme to stripe checks a Stripe-Signature header instead.
+type transformSignature struct {
+	Scheme   string `json:"scheme"`
+	Header   string `json:"header"`
+	Prefix   string `json:"prefix"`
+	Encoding string `json:"encoding"`
+}
+
+// transformMetric builds one metric. Value and Tags are expressions; a
+// metric whose value is null is skipped.
+type transformMetric struct {
+	Name  string            `json:"name"`
+	Type  string            `json:"type"`
+	Help  string            `json:"help"`
+	Unit  string            `json:"unit"`
+	When  string            `json:"when"`
+	Value string            `json:"value"`
+	Tags  map[string]string `json:"tags"`
+}
+
+func findRuleset(name string) (transformRuleset, bool) {
+	for _, rs := range c.Transforms {
+		if rs.Name == name {
+			return rs, true
+		}
+	}
+	for _, rs := range builtinTransforms {
+		if rs.Name == name {
+			return rs, true
+		}
+	}
+	return transformRuleset{}, false
+}
+
+// truthy follows JMESPath's definition of false values
+func truthy(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return x
+	case string:
+		return x != ""
+	case []interface{}:
+		return len(x) > 0
+	case map[string]interface{}:
+		return len(x) > 0
+	}
+	return true
+}
+
+func searchTruthy(expr string, data interface{}) (bool, error) {
+	if expr == "" {
+		return true, nil
+	}
+	result, err := jmespath.Search(expr, data)
+	if err != nil {
+		return false, fmt.Errorf("when %q: %s", expr, err)
+	}
+	return truthy(result), nil
+}
+
+// transformScalar renders an expression result as a metric value or label
+func transformScalar(v interface{}) (string, error) {
+	switch x := v.(type) {
+	case float64:
+		return formatValue(x), nil
+	case bool:
+		if x {
+			return "1", nil
+		}
+		return "0", nil
+	case string:
+		return x, nil
+	}
+	return "", fmt.Errorf("expected a scalar, got %T", v)
+}
+
+// Apply evaluates the ruleset against a decoded payload
+func (rs transformRuleset) Apply(payload interface{}) (metricFile, error) {
+	mf := metricFile{FileName: rs.File, Metrics: []metric{}}
+	if mf.FileName == "" {
+		mf.FileName = transformPrefix + rs.Name
+	}
+	if rs.FilePath != "" {
+		result, err := jmespath.Search(rs.FilePath, payload)
+		if err != nil {
+			return mf, fmt.Errorf("file_path: %s", err)
+		}
+		if name, ok := result.(string); ok && name != "" {
+			mf.FileName = strings.TrimSuffix(mf.FileName, "/") + "/" + sanitizeLabel(name)
+		}
+	}
+
+	ok, err := searchTruthy(rs.When, payload)
+	if err != nil || !ok {
+		return mf, err
+	}
+
+	items := []interface{}{payload}
+	if rs.Each != "" {
+		result, err := jmespath.Search(rs.Each, payload)
+		if err != nil {
+			return mf, fmt.Errorf("each: %s", err)
+		}
+		if result == nil {
+			return mf, nil
+		}
+		list, ok := result.([]interface{})
+		if !ok {
+			return mf, fmt.Errorf("each: expected an array, got %T", result)
+		}
+		items = list
+	}
+
+	for _, item := range items {
+		for _, tm := range rs.Metrics {
+			m, ok, err := tm.build(item)
+			if err != nil {
+				return mf, fmt.Errorf("%s: %s", tm.Name, err)
+			}
+			if ok {
+				mf.Metrics = append(mf.Metrics, m)
+			}
+		}
+	}
+	mf.Metrics = combineSeries(mf.Metrics)
+	return mf, nil
+}
+
+// combineSeries folds repeated series from one delivery into one, summing
+// counters and keeping the last value of anything else
+func combineSeries(metrics []metric) []metric {
+	index := map[string]int{}
+	combined := []metric{}
+	for _, m := range metrics {
+		i, ok := index[seriesKey(m)]
+		if !ok {
+			index[seriesKey(m)] = len(combined)
+			combined = append(combined, m)
+			continue
+		}
+		if m.Type == "counter" {
+			a, errA := parseValue(combined[i].Value)
+			b, errB := parseValue(m.Value)
+			if errA == nil && errB == nil {
+				m.Value = formatValue(a + b)
+			}
+		}
+		combined[i] = m
+	}
+	return combined
+}
+
+func (tm transformMetric) build(data interface{}) (metric, bool, error) {
+	ok, err := searchTruthy(tm.When, data)
+	if err != nil || !ok {
+		return metric{}, false, err
+	}
+	result, err := jmespath.Search(tm.Value, data)
+	if err != nil {
+		return metric{}, false, fmt.Errorf("value %q: %s", tm.Value, err)
+	}
+	if result == nil {
+		return metric{}, false, nil
+	}
+	value, err := transformScalar(result)
+	if err != nil {
+		return metric{}, false, fmt.Errorf("value %q: %s", tm.Value, err)
+	}
+
+	m := metric{
+		Name:  tm.Name,
+		Type:  tm.Type,
+		Help:  tm.Help,
+		Unit:  tm.Unit,
+		Value: value,
+		Tags:  map[string]string{},
+	}
+	if m.Type == "" {
+		m.Type = "gauge"
+	}
+	for k, expr := range tm.Tags {
+		result, err := jmespath.Search(expr, data)
+		if err != nil {
+			return metric{}, false, fmt.Errorf("tag %s: %s", k, err)
+		}
+		if result == nil {
+			continue
+		}
+		v, err := transformScalar(result)
+		if err != nil {
+			return metric{}, false, fmt.Errorf("tag %s: %s", k, err)
+		}
+		m.Tags[k] = sanitizeLabel(v)
+	}
+	return m, true, nil
+}
+
+// verify checks the delivery's signature and returns the signing token
+func (s transformSignature) verify(req events.Request, body []byte) (tokenConfig, bool) {
+	if s.Scheme == stripeScheme {
+		return stripeToken(requestHeader(req, "Stripe-Signature"), body, time.Now())
+	}
+	header := requestHeader(req, s.Header)
+	if !strings.HasPrefix(header, s.Prefix) {
+		return tokenConfig{}, false
+	}
+	encoded := strings.TrimPrefix(header, s.Prefix)
+	var given []byte
+	var err error
+	if s.Encoding == "base64" {
+		given, err = base64.StdEncoding.DecodeString(encoded)
+	} else {
+		given, err = hex.DecodeString(encoded)
+	}
+	if err != nil {
+		return tokenConfig{}, false
+	}
+	return hmacToken(given, body)
+}
+
+// authorizeTransform applies the ruleset's signature check, or requires a
+// bearer token when it has none
+func authorizeTransform(req events.Request, rs transformRuleset, body []byte) (events.Request, *events.Response) {
+	if rs.Signature == nil {
+		resp, _ := metricAuth(req)
+		if resp.StatusCode > 0 {
+			return req, &resp
+		}
+		return req, nil
+	}
+	t, ok := rs.Signature.verify(req, body)
+	if !ok {
+		resp, _ := events.Reject("bad signature")
+		return req, &resp
+	}
+	return hmacRequest(req, t), nil
+}
+
+func decodeTransformPayload(body string) (interface{}, error) {
+	if err := checkWebhookLimits([]byte(body)); err != nil {
+		return nil, fmt.Errorf("rejected body: %s", err)
+	}
+	var payload interface{}
+	if err := json.Unmarshal([]byte(body), &payload); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal: %s", err)
+	}
+	return payload, nil
+}
+
+// transformHandler runs a webhook delivery through the active version of
+// the ruleset named in the path and pushes the resulting metrics. Series not
+// in the delivery are kept, and counters accumulate when the ruleset sets
+// accumulate. With archive_hook_payloads set, the delivery is kept so files
+// can be derived from it again after a rollback.
+func transformHandler(req events.Request) (events.Response, error) {
+	rs, ok := findRuleset(req.PathParameters["ruleset"])
+	if !ok {
+		return events.Respond(404, fmt.Sprintf("unknown ruleset: %s", req.PathParameters["ruleset"]))
+	}
+	body, err := req.DecodedBody()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+	}
+	req, denied := authorizeTransform(req, rs, []byte(body))
+	if denied != nil {
+		return *denied, nil
+	}
+
+	payload, err := decodeTransformPayload(body)
+	if err != nil {
+		return events.Respond(400, err.Error())
+	}
+	client, err := getClient()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+	}
+	if c.ArchivePayloads {
+		if err := archivePayload(client, rs.Name, body); err != nil {
+			fmt.Printf("failed to archive payload: %s\n", err)
+		}
+	}
+	rs, version, err := activeRuleset(client, rs)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load ruleset versions: %s", err))
+	}
+	mf, err := rs.Apply(payload)
+	if err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to transform: %s", err))
+	}
+	if len(mf.Metrics) == 0 {
+		return events.Succeed("")
+	}
+	mf.Ruleset = &rulesetRef{Name: rs.Name, Version: version}
+	if rs.Accumulate {
+		mf.accumulate = true
+	} else {
+		mf.mergeSeries = true
+	}
+	return pushMetricFile(req, mf)
+}
+
+type transformTestResult struct {
+	File     string              `json:"file"`
+	Metrics  []metric            `json:"metrics"`
+	Valid    bool                `json:"valid"`
+	Findings []validationFinding `json:"findings,omitempty"`
+	Output   string              `json:"output"`
+}
+
+// transformTestHandler runs a sample payload through a ruleset and returns
+// the metrics it would produce, without storing anything. It takes a bearer
+// token even for signed rulesets, since sample payloads aren't signed.
+func transformTestHandler(req events.Request) (events.Response, error) {
+	rs, ok := findRuleset(req.PathParameters["ruleset"])
+	if !ok {
+		return events.Respond(404, fmt.Sprintf("unknown ruleset: %s", req.PathParameters["ruleset"]))
+	}
+	if req.HTTPMethod != "POST" {
+		return events.Respond(405, "ruleset tests require POST")
+	}
+	body, err := req.DecodedBody()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+	}
+	payload, err := decodeTransformPayload(body)
+	if err != nil {
+		return events.Respond(400, err.Error())
+	}
+	mf, err := rs.Apply(payload)
+	if err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to transform: %s", err))
+	}
+
+	output, err := textFormatter{}.Format(mf.Metrics)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to render metrics: %s", err))
+	}
+	findings, err := validateFile(nil, &mf, false)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to validate: %s", err))
+	}
+	return respondJSON(200, transformTestResult{
+		File:     mf.FileName,
+		Metrics:  mf.Metrics,
+		Valid:    len(enforcedFindings(findings)) == 0,
+		Findings: findings,
+		Output:   string(output),
+	})
+}
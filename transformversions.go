@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	rulesetPrefix = "transforms/"
+	payloadPrefix = "payloads/"
+)
+
+// rulesetVersion is a ruleset as it was configured at some point
+type rulesetVersion struct {
+	Version    int              `json:"version"`
+	Digest     string           `json:"digest"`
+	RecordedAt int64            `json:"recorded_at"`
+	Ruleset    transformRuleset `json:"ruleset"`
+}
+
+// rulesetHistory is every version of a ruleset seen, and the one deliveries
+// use. A ruleset that differs from the newest version is recorded as a new
+// version and made active, so a config change takes precedence over an
+// earlier rollback.
+type rulesetHistory struct {
+	Active   int              `json:"active"`
+	Versions []rulesetVersion `json:"versions"`
+}
+
+// rulesetRef records the ruleset version that produced a stored file
+type rulesetRef struct {
+	Name    string `json:"name"`
+	Version int    `json:"version"`
+}
+
+type rulesetRollback struct {
+	Version  int  `json:"version"`
+	Rederive bool `json:"rederive"`
+}
+
+type rulesetRollbackResult struct {
+	Active  int          `json:"active"`
+	Results []pushResult `json:"results,omitempty"`
+}
+
+func rulesetDigest(rs transformRuleset) (string, error) {
+	content, err := json.Marshal(rs)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (h rulesetHistory) version(v int) (rulesetVersion, bool) {
+	for _, rv := range h.Versions {
+		if rv.Version == v {
+			return rv, true
+		}
+	}
+	return rulesetVersion{}, false
+}
+
+func readRulesetHistory(client *s3.Client, name string) (rulesetHistory, error) {
+	var h rulesetHistory
+	_, err := readInternalObject(client, rulesetPrefix+name, &h)
+	return h, err
+}
+
+// activeRuleset returns the version of rs that deliveries should use,
+// recording rs as a new version first if it has changed
+func activeRuleset(client *s3.Client, rs transformRuleset) (transformRuleset, int, error) {
+	digest, err := rulesetDigest(rs)
+	if err != nil {
+		return rs, 0, err
+	}
+	h, err := readRulesetHistory(client, rs.Name)
+	if err != nil {
+		return rs, 0, err
+	}
+	if n := len(h.Versions); n == 0 || h.Versions[n-1].Digest != digest {
+		h, err = recordRuleset(client, rs, digest)
+		if err != nil {
+			return rs, 0, err
+		}
+	}
+	active, ok := h.version(h.Active)
+	if !ok {
+		return rs, 0, fmt.Errorf("active version %d of %s is missing", h.Active, rs.Name)
+	}
+	return active.Ruleset, active.Version, nil
+}
+
+func recordRuleset(client *s3.Client, rs transformRuleset, digest string) (rulesetHistory, error) {
+	name := rulesetPrefix + rs.Name
+	release, err := lockFile(internalPrefix + name)
+	if err != nil {
+		return rulesetHistory{}, err
+	}
+	defer release()
+
+	h, err := readRulesetHistory(client, rs.Name)
+	if err != nil {
+		return h, err
+	}
+	n := len(h.Versions)
+	if n > 0 && h.Versions[n-1].Digest == digest {
+		return h, nil
+	}
+	next := 1
+	if n > 0 {
+		next = h.Versions[n-1].Version + 1
+	}
+	h.Versions = append(h.Versions, rulesetVersion{
+		Version:    next,
+		Digest:     digest,
+		RecordedAt: time.Now().Unix(),
+		Ruleset:    rs,
+	})
+	h.Active = next
+	return h, writeInternalObject(client, name, h)
+}
+
+// archivePayload keeps a delivery so files can be derived from it again
+func archivePayload(client *s3.Client, name, body string) error {
+	key := fmt.Sprintf("%s%s/%d", payloadPrefix, name, time.Now().UnixNano())
+	return writeInternalObject(client, key, json.RawMessage(body))
+}
+
+// listArchivedPayloads returns a ruleset's archived deliveries in the order
+// they arrived, since their fixed-width timestamps list in that order
+func listArchivedPayloads(client *s3.Client, name string) ([]string, error) {
+	return listInternalObjects(client, payloadPrefix+name+"/")
+}
+
+// rederiveFiles replays every archived delivery for rs in order, building
+// its files as the deliveries would have, and replaces the stored files with
+// the result. Files are rebuilt from the archive alone.
+func rederiveFiles(req events.Request, client *s3.Client, rs transformRuleset, version int) ([]pushResult, error) {
+	keys, err := listArchivedPayloads(client, rs.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]*metricFile{}
+	names := []string{}
+	for _, key := range keys {
+		var body json.RawMessage
+		if _, err := readInternalObject(client, key, &body); err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err)
+		}
+		payload, err := decodeTransformPayload(string(body))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err)
+		}
+		mf, err := rs.Apply(payload)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err)
+		}
+		if len(mf.Metrics) == 0 {
+			continue
+		}
+		previous, ok := files[mf.FileName]
+		if !ok {
+			names = append(names, mf.FileName)
+		} else if rs.Accumulate {
+			accumulateInto(previous.Metrics, &mf)
+		} else {
+			mergeSeriesInto(previous.Metrics, &mf)
+		}
+		mf.Ruleset = &rulesetRef{Name: rs.Name, Version: version}
+		files[mf.FileName] = &mf
+	}
+
+	sort.Strings(names)
+	results := []pushResult{}
+	for _, name := range names {
+		results = append(results, importMetricFile(req, client, *files[name]))
+	}
+	recordPush(results...)
+	return results, nil
+}
+
+// rulesetHandler lists a ruleset's versions on GET. POST with
+// {"version": N} makes that version active, and with "rederive": true also
+// rebuilds the ruleset's files from its archived deliveries.
+func rulesetHandler(req events.Request) (events.Response, error) {
+	rs, ok := findRuleset(req.PathParameters["name"])
+	if !ok {
+		return events.Respond(404, fmt.Sprintf("unknown ruleset: %s", req.PathParameters["name"]))
+	}
+	client, err := getClient()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+	}
+
+	switch req.HTTPMethod {
+	case "GET":
+		h, err := readRulesetHistory(client, rs.Name)
+		if err != nil {
+			return events.Fail(fmt.Sprintf("failed to load versions: %s", err))
+		}
+		return respondJSON(200, h)
+	case "POST":
+	default:
+		return events.Respond(405, "rulesets require GET or POST")
+	}
+
+	body, err := req.DecodedBody()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+	}
+	var params rulesetRollback
+	if err := json.Unmarshal([]byte(body), &params); err != nil {
+		return events.Respond(400, fmt.Sprintf("failed to unmarshal: %s", err))
+	}
+
+	name := rulesetPrefix + rs.Name
+	release, err := lockFile(internalPrefix + name)
+	if err != nil {
+		return events.Respond(409, fmt.Sprintf("failed to lock %s: %s", rs.Name, err))
+	}
+	h, err := readRulesetHistory(client, rs.Name)
+	if err != nil {
+		release()
+		return events.Fail(fmt.Sprintf("failed to load versions: %s", err))
+	}
+	target, ok := h.version(params.Version)
+	if !ok {
+		release()
+		return events.Respond(400, fmt.Sprintf("unknown version: %d", params.Version))
+	}
+	h.Active = target.Version
+	err = writeInternalObject(client, name, h)
+	release()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to save versions: %s", err))
+	}
+
+	result := rulesetRollbackResult{Active: h.Active}
+	if !params.Rederive {
+		return respondJSON(200, result)
+	}
+	result.Results, err = rederiveFiles(req, client, target.Ruleset, target.Version)
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to rederive: %s", err))
+	}
+	code := 200
+	for _, r := range result.Results {
+		if r.Status == pushRejected {
+			code = 207
+		}
+	}
+	return respondJSON(code, result)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	typesObject = "metric_types.json"
+
+	typeActionWarn   = "warn"
+	typeActionReject = "reject"
+)
+
+// declaredType is the first type seen for a metric name, along with the
+// files that have pushed the name with that type
+type declaredType struct {
+	Type  string   `json:"type"`
+	Files []string `json:"files"`
+}
+
+type typeConflict struct {
+	File     string `json:"file"`
+	Metric   string `json:"metric"`
+	Type     string `json:"type"`
+	Declared string `json:"declared"`
+}
+
+// typeRuleMode maps type_consistency, the setting that predates
+// validation_rules, to the type_consistency rule's default mode
+func typeRuleMode() string {
+	switch c.TypeConsistency {
+	case typeActionWarn:
+		return ruleWarn
+	case typeActionReject:
+		return ruleEnforce
+	}
+	return ruleOff
+}
+
+// checkTypeConsistency compares the pushed metric types against the types
+// declared by earlier pushes. A file that is the only one using a name may
+// change its type. In warn mode, each conflict is also announced as an event.
+func checkTypeConsistency(client *s3.Client, mf *metricFile, mode string) ([]validationFinding, error) {
+	if client == nil {
+		return nil, nil
+	}
+
+	declared := map[string]declaredType{}
+	_, err := readInternalObject(client, typesObject, &declared)
+	if err != nil {
+		fmt.Printf("skipping type check, failed to load metric types: %s\n", err)
+		return nil, nil
+	}
+
+	conflicts := []typeConflict{}
+	seen := map[string]bool{}
+	for _, m := range mf.Metrics {
+		d, ok := declared[m.Name]
+		if !ok || seen[m.Name] || d.Type == m.Type {
+			continue
+		}
+		seen[m.Name] = true
+		if len(d.Files) == 1 && d.Files[0] == mf.FileName {
+			continue
+		}
+		conflicts = append(conflicts, typeConflict{
+			File:     mf.FileName,
+			Metric:   m.Name,
+			Type:     m.Type,
+			Declared: d.Type,
+		})
+	}
+
+	mf.typesChanged = typesChanged(declared, *mf)
+	findings := []validationFinding{}
+	for _, tc := range conflicts {
+		findings = append(findings, validationFinding{
+			Metric:  tc.Metric,
+			Message: fmt.Sprintf("declared as %s, not %s", tc.Declared, tc.Type),
+		})
+		if mode != ruleWarn {
+			continue
+		}
+		if err := publishEvent("Metric Type Conflict", tc); err != nil {
+			fmt.Printf("failed to publish type conflict event: %s\n", err)
+		}
+	}
+	return findings, nil
+}
+
+func typesChanged(declared map[string]declaredType, mf metricFile) bool {
+	for _, m := range mf.Metrics {
+		d, ok := declared[m.Name]
+		if !ok {
+			return true
+		}
+		if d.Type == m.Type && !containsSorted(d.Files, mf.FileName) {
+			return true
+		}
+		if d.Type != m.Type && len(d.Files) == 1 && d.Files[0] == mf.FileName {
+			return true
+		}
+	}
+	return false
+}
+
+// recordTypes adds a stored file's metric types to the declared types
+func recordTypes(client *s3.Client, mf metricFile) error {
+	if !mf.typesChanged {
+		return nil
+	}
+	return editTypes(client, func(declared map[string]declaredType) {
+		for _, m := range mf.Metrics {
+			d, ok := declared[m.Name]
+			if !ok || (d.Type != m.Type && len(d.Files) == 1 && d.Files[0] == mf.FileName) {
+				declared[m.Name] = declaredType{Type: m.Type, Files: []string{mf.FileName}}
+				continue
+			}
+			if d.Type != m.Type {
+				continue
+			}
+			if containsSorted(d.Files, mf.FileName) {
+				continue
+			}
+			i := sort.SearchStrings(d.Files, mf.FileName)
+			d.Files = append(d.Files, "")
+			copy(d.Files[i+1:], d.Files[i:])
+			d.Files[i] = mf.FileName
+			declared[m.Name] = d
+		}
+	})
+}
+
+// removeTypes drops a deleted file from the declared types, forgetting a
+// metric's type once no file declares it
+func removeTypes(client *s3.Client, file string) error {
+	return editTypes(client, func(declared map[string]declaredType) {
+		for name, d := range declared {
+			i := sort.SearchStrings(d.Files, file)
+			if i == len(d.Files) || d.Files[i] != file {
+				continue
+			}
+			d.Files = append(d.Files[:i], d.Files[i+1:]...)
+			if len(d.Files) == 0 {
+				delete(declared, name)
+				continue
+			}
+			declared[name] = d
+		}
+	})
+}
+
+func editTypes(client *s3.Client, edit func(map[string]declaredType)) error {
+	release, err := lockFile(internalPrefix + typesObject)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	declared := map[string]declaredType{}
+	_, err = readInternalObject(client, typesObject, &declared)
+	if err != nil {
+		return err
+	}
+	edit(declared)
+	return writeInternalObject(client, typesObject, declared)
+}
+
+func containsSorted(list []string, s string) bool {
+	i := sort.SearchStrings(list, s)
+	return i < len(list) && list[i] == s
+}
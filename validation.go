@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	ruleOff     = "off"
+	ruleWarn    = "warn"
+	ruleEnforce = "enforce"
+)
+
+// validationFinding is one problem a rule found in a pushed file
+type validationFinding struct {
+	Rule    string `json:"rule"`
+	Mode    string `json:"mode"`
+	Metric  string `json:"metric,omitempty"`
+	Label   string `json:"label,omitempty"`
+	Message string `json:"message"`
+}
+
+func (f validationFinding) String() string {
+	parts := []string{f.Rule + ":"}
+	if f.Metric != "" {
+		parts = append(parts, "metric "+f.Metric)
+	}
+	if f.Label != "" {
+		parts = append(parts, "label "+f.Label)
+	}
+	return strings.Join(append(parts, f.Message), " ")
+}
+
+// validationRule is a named check on pushed files. Structural rules cover
+// what can be stored and rendered, so they also run when stored files are
+// read back; the rest only run on pushes. Checks are given the rule's mode,
+// and those that need a client pass when run without one.
+type validationRule struct {
+	name        string
+	structural  bool
+	defaultMode func() string
+	check       func(client *s3.Client, mf *metricFile, mode string) ([]validationFinding, error)
+}
+
+var validationRules = []validationRule{
+	{name: "naming", structural: true, defaultMode: enforced, check: eachMetric(checkNaming)},
+	{name: "values", structural: true, defaultMode: enforced, check: eachMetric(checkValues)},
+	{name: "units", defaultMode: enforced, check: eachMetric(checkUnits)},
+	{name: "cardinality", defaultMode: enforced, check: checkCardinality},
+	{name: "pii", defaultMode: piiRuleMode, check: checkPII},
+	{name: "type_consistency", defaultMode: typeRuleMode, check: checkTypeConsistency},
+}
+
+func enforced() string {
+	return ruleEnforce
+}
+
+// ruleMode returns the mode set for a rule under validation_rules, or the
+// rule's default when it is unset or not a known mode
+func ruleMode(rule validationRule) string {
+	switch mode := c.ValidationRules[rule.name]; mode {
+	case ruleOff, ruleWarn, ruleEnforce:
+		return mode
+	}
+	return rule.defaultMode()
+}
+
+func eachMetric(fn func(m metric) []validationFinding) func(*s3.Client, *metricFile, string) ([]validationFinding, error) {
+	return func(_ *s3.Client, mf *metricFile, _ string) ([]validationFinding, error) {
+		findings := []validationFinding{}
+		for _, m := range mf.Metrics {
+			findings = append(findings, fn(m)...)
+		}
+		return findings, nil
+	}
+}
+
+// validateFile runs the rules that aren't off against mf, stamping each
+// finding with its rule's mode. A file without a name is always rejected.
+func validateFile(client *s3.Client, mf *metricFile, structuralOnly bool) ([]validationFinding, error) {
+	findings := []validationFinding{}
+	if mf.FileName == "" {
+		findings = append(findings, validationFinding{Rule: "file", Mode: ruleEnforce, Message: "name is required"})
+	}
+	for _, rule := range validationRules {
+		mode := ruleMode(rule)
+		if mode == ruleOff || (structuralOnly && !rule.structural) {
+			continue
+		}
+		found, err := rule.check(client, mf, mode)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", rule.name, err)
+		}
+		for _, f := range found {
+			f.Rule = rule.name
+			f.Mode = mode
+			findings = append(findings, f)
+		}
+	}
+	return findings, nil
+}
+
+func enforcedFindings(findings []validationFinding) []validationFinding {
+	enforced := []validationFinding{}
+	for _, f := range findings {
+		if f.Mode == ruleEnforce {
+			enforced = append(enforced, f)
+		}
+	}
+	return enforced
+}
+
+// checkStored runs the structural rules on a file read from the bucket,
+// returning the first enforced finding as an error
+func (mf *metricFile) checkStored() error {
+	findings, err := validateFile(nil, mf, true)
+	if err != nil {
+		return err
+	}
+	if enforced := enforcedFindings(findings); len(enforced) > 0 {
+		return fmt.Errorf("failed validation: %s", enforced[0])
+	}
+	return nil
+}
+
+// checkMetric runs the structural rules on a single stored metric
+func checkMetric(m metric) error {
+	mf := metricFile{FileName: "-", Metrics: []metric{m}}
+	return mf.checkStored()
+}
+
+func checkNaming(m metric) []validationFinding {
+	findings := []validationFinding{}
+	if !metricNameRegex.MatchString(m.Name) {
+		findings = append(findings, validationFinding{Metric: m.Name, Message: "invalid name"})
+	}
+	if !textRegex.MatchString(m.Type) {
+		findings = append(findings, validationFinding{Metric: m.Name, Message: fmt.Sprintf("invalid type %q", m.Type)})
+	}
+	if m.Unit != "" && !unitRegex.MatchString(m.Unit) {
+		findings = append(findings, validationFinding{Metric: m.Name, Message: fmt.Sprintf("invalid unit %q", m.Unit)})
+	}
+	for _, k := range labelKeys(m.Tags) {
+		if !textRegex.MatchString(k) || !utf8.ValidString(m.Tags[k]) {
+			findings = append(findings, validationFinding{Metric: m.Name, Label: k, Message: "invalid label"})
+		}
+	}
+	if m.Exemplar != nil {
+		for _, k := range labelKeys(m.Exemplar.Labels) {
+			if !textRegex.MatchString(k) || !utf8.ValidString(m.Exemplar.Labels[k]) {
+				findings = append(findings, validationFinding{Metric: m.Name, Label: k, Message: "invalid exemplar label"})
+			}
+		}
+	}
+	return findings
+}
+
+func labelKeys(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func checkValues(m metric) []validationFinding {
+	if m.Histogram != nil {
+		return checkHistogram(m)
+	}
+	if m.Summary != nil {
+		return checkSummary(m)
+	}
+	findings := []validationFinding{}
+	if !validValue(m.Value) {
+		findings = append(findings, validationFinding{Metric: m.Name, Message: fmt.Sprintf("invalid value %q", m.Value)})
+	}
+	if m.Exemplar != nil && !validValue(m.Exemplar.Value) {
+		findings = append(findings, validationFinding{Metric: m.Name, Message: fmt.Sprintf("invalid exemplar value %q", m.Exemplar.Value)})
+	}
+	return findings
+}
+
+// checkUnits applies enforce_units. It only runs on pushes, so turning
+// enforcement on leaves files already stored without units readable.
+func checkUnits(m metric) []validationFinding {
+	if m.validateUnit() {
+		return nil
+	}
+	if m.Unit == "" {
+		return []validationFinding{{Metric: m.Name, Message: "name has a unit suffix but no unit is declared"}}
+	}
+	return []validationFinding{{Metric: m.Name, Message: fmt.Sprintf("invalid unit %q", m.Unit)}}
+}
+
+// checkCardinality limits the series one file may push for a metric name,
+// per max_series_per_metric
+func checkCardinality(_ *s3.Client, mf *metricFile, _ string) ([]validationFinding, error) {
+	if c.MaxSeriesPerMetric <= 0 {
+		return nil, nil
+	}
+	counts := map[string]int{}
+	for _, m := range mf.Metrics {
+		counts[m.Name]++
+	}
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	findings := []validationFinding{}
+	for _, name := range names {
+		if counts[name] > c.MaxSeriesPerMetric {
+			findings = append(findings, validationFinding{
+				Metric:  name,
+				Message: fmt.Sprintf("%d series exceeds the limit of %d", counts[name], c.MaxSeriesPerMetric),
+			})
+		}
+	}
+	return findings, nil
+}
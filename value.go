@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// parseValue parses a sample value: a decimal float with an optional sign
+// and exponent, or one of NaN, +Inf, and -Inf. strconv.ParseFloat alone also
+// takes hex floats, underscores, and spellings like "inf" and "Infinity",
+// which Prometheus parsers don't, and values too large for a float64, which
+// it turns into infinities.
+func parseValue(s string) (float64, error) {
+	switch s {
+	case "NaN":
+		return math.NaN(), nil
+	case "+Inf":
+		return math.Inf(1), nil
+	case "-Inf":
+		return math.Inf(-1), nil
+	}
+	if !isDecimal(s) {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return v, nil
+}
+
+func validValue(s string) bool {
+	_, err := parseValue(s)
+	return err == nil
+}
+
+// isDecimal reports whether s is digits with an optional sign, decimal
+// point, and exponent, with at least one digit before the exponent
+func isDecimal(s string) bool {
+	i := 0
+	digits := func() int {
+		start := i
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		return i - start
+	}
+	sign := func() {
+		if i < len(s) && (s[i] == '+' || s[i] == '-') {
+			i++
+		}
+	}
+
+	sign()
+	n := digits()
+	if i < len(s) && s[i] == '.' {
+		i++
+		n += digits()
+	}
+	if n == 0 {
+		return false
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		i++
+		sign()
+		if digits() == 0 {
+			return false
+		}
+	}
+	return i == len(s)
+}
+
+// formatValue writes the shortest decimal that parses back to v. Values are
+// written without an exponent between 1e-6 and 1e21, so counts stay plain
+// integers, and the special values use the exposition format's tokens.
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	if a := math.Abs(v); a != 0 && (a < 1e-6 || a >= 1e21) {
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// canonicalValue rewrites a valid value in formatValue's form, so that
+// "1.50", "+1.5", and "15e-1" are all stored as "1.5"
+func canonicalValue(s string) (string, bool) {
+	v, err := parseValue(s)
+	if err != nil {
+		return s, false
+	}
+	return formatValue(v), true
+}
+
+// canonicalizeValues rewrites the values pushed in mf, leaving invalid ones
+// for the values rule to report
+func canonicalizeValues(mf *metricFile) {
+	for i := range mf.Metrics {
+		m := &mf.Metrics[i]
+		m.Value, _ = canonicalValue(m.Value)
+		if m.Exemplar != nil {
+			m.Exemplar.Value, _ = canonicalValue(m.Exemplar.Value)
+		}
+		if m.Summary != nil {
+			m.Summary.Sum, _ = canonicalValue(m.Summary.Sum)
+			m.Summary.Quantiles = canonicalQuantiles(m.Summary.Quantiles)
+		}
+		if m.Histogram != nil {
+			m.Histogram.Sum, _ = canonicalValue(m.Histogram.Sum)
+			for j := range m.Histogram.Buckets {
+				b := &m.Histogram.Buckets[j]
+				b.LE, _ = canonicalValue(b.LE)
+			}
+		}
+	}
+}
+
+// canonicalQuantiles rewrites a summary's quantiles and their values. If two
+// quantiles would collapse into one, like "0.5" and "0.50", the quantiles are
+// left as pushed for the values rule to reject.
+func canonicalQuantiles(quantiles map[string]string) map[string]string {
+	canonical := make(map[string]string, len(quantiles))
+	for q, v := range quantiles {
+		q, _ = canonicalValue(q)
+		if _, ok := canonical[q]; ok {
+			return quantiles
+		}
+		canonical[q], _ = canonicalValue(v)
+	}
+	return canonical
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func sameValue(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	return math.Float64bits(a) == math.Float64bits(b)
+}
+
+func FuzzParseValue(f *testing.F) {
+	for _, s := range []string{
+		"0", "-0", "1", "+1.5", "1.50", "15e-1", ".5", "5.", "1e21", "1E-6",
+		"NaN", "+Inf", "-Inf", "nan", "inf", "Infinity", "0x1p3", "1_000",
+		"", ".", "e5", "1e", "1e+", "--1", "1e400", "-1e400",
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		v, err := parseValue(s)
+		if err != nil {
+			if validValue(s) {
+				t.Fatalf("validValue(%q) is true but parseValue failed: %s", s, err)
+			}
+			return
+		}
+		switch s {
+		case "NaN", "+Inf", "-Inf":
+		default:
+			if !isDecimal(s) {
+				t.Fatalf("parseValue accepted %q, which is not decimal", s)
+			}
+			if math.IsInf(v, 0) || math.IsNaN(v) {
+				t.Fatalf("parseValue(%q) = %v from a decimal", s, v)
+			}
+		}
+
+		formatted := formatValue(v)
+		back, err := parseValue(formatted)
+		if err != nil {
+			t.Fatalf("parseValue(formatValue(%q)) = %q failed: %s", s, formatted, err)
+		}
+		if !sameValue(v, back) {
+			t.Fatalf("%q parsed to %v but %q parsed back to %v", s, v, formatted, back)
+		}
+		canonical, ok := canonicalValue(formatted)
+		if !ok || canonical != formatted {
+			t.Fatalf("canonicalValue(%q) = %q, %t", formatted, canonical, ok)
+		}
+	})
+}
+
+func FuzzFormatValue(f *testing.F) {
+	for _, v := range []float64{
+		math.NaN(), math.Inf(1), math.Inf(-1), 0, math.Copysign(0, -1),
+		1e-6, math.Nextafter(1e-6, 0), -1e-6, 1e21, math.Nextafter(1e21, 0), -1e21,
+		math.SmallestNonzeroFloat64, math.MaxFloat64, 0.1, 123456789,
+	} {
+		f.Add(v)
+	}
+	f.Fuzz(func(t *testing.T, v float64) {
+		formatted := formatValue(v)
+		back, err := parseValue(formatted)
+		if err != nil {
+			t.Fatalf("parseValue(formatValue(%v)) = %q failed: %s", v, formatted, err)
+		}
+		if !sameValue(v, back) {
+			t.Fatalf("%v formatted as %q, which parses to %v", v, formatted, back)
+		}
+		if a := math.Abs(v); a >= 1e-6 && a < 1e21 && strings.ContainsAny(formatted, "eE") {
+			t.Fatalf("%v formatted with an exponent: %q", v, formatted)
+		}
+	})
+}
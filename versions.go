@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/akerl/go-lambda/apigw/events"
+	"github.com/akerl/go-lambda/mux"
+)
+
+type routeConfig struct {
+	Disabled   bool   `json:"disabled"`
+	Deprecated bool   `json:"deprecated"`
+	Sunset     string `json:"sunset"`
+	Successor  string `json:"successor"`
+}
+
+// routeSuccessors are the default replacements advertised for deprecated
+// routes when the config doesn't name one
+var routeSuccessors = map[string]string{
+	"metric": "/v1/push",
+}
+
+// versionedRoute lets config disable a push route or mark it deprecated, so
+// the API can move to versioned paths without breaking existing pushers.
+// Deprecated routes keep working but advertise their successor and sunset.
+func versionedRoute(name string, handler mux.HandleFunc) mux.HandleFunc {
+	return func(req events.Request) (events.Response, error) {
+		rc := c.Routes[name]
+		if rc.Disabled {
+			return events.Respond(404, fmt.Sprintf("the %s route is disabled", req.Path))
+		}
+
+		resp, err := handler(req)
+		if err != nil || !rc.Deprecated {
+			return resp, err
+		}
+
+		if resp.Headers == nil {
+			resp.Headers = map[string]string{}
+		}
+		resp.Headers["Deprecation"] = "true"
+		warning := fmt.Sprintf("%s is deprecated", req.Path)
+		successor := rc.Successor
+		if successor == "" {
+			successor = routeSuccessors[name]
+		}
+		if successor != "" {
+			resp.Headers["Link"] = fmt.Sprintf("<%s>; rel=\"successor-version\"", successor)
+			warning += fmt.Sprintf("; use %s", successor)
+		}
+		if rc.Sunset != "" {
+			resp.Headers["Sunset"] = rc.Sunset
+			warning += fmt.Sprintf(" before %s", rc.Sunset)
+		}
+		resp.Headers["Warning"] = fmt.Sprintf("299 - \"%s\"", warning)
+		return resp, nil
+	}
+}
+
+// fileHandler serves /v1/files/<name>: GET returns the stored file, PUT
+// pushes a metricFile to that name, and DELETE removes it.
+func fileHandler(req events.Request) (events.Response, error) {
+	name := req.PathParameters["name"]
+	switch req.HTTPMethod {
+	case "GET":
+		return getFileHandler(req, name)
+	case "PUT":
+		return pushRoute(func(req events.Request) (events.Response, error) {
+			body, err := req.DecodedBody()
+			if err != nil {
+				return events.Fail(fmt.Sprintf("failed to decode: %s", err))
+			}
+			err = checkJSONLimits([]byte(body))
+			if err != nil {
+				return events.Respond(400, fmt.Sprintf("rejected body: %s", err))
+			}
+			mf, err := parseMetricFile([]byte(body))
+			if err != nil {
+				return events.Respond(400, fmt.Sprintf("failed to unmarshal: %s", err))
+			}
+			if mf.FileName != "" && mf.FileName != name {
+				return events.Respond(400, "body name does not match path")
+			}
+			mf.FileName = name
+			return pushMetricFile(req, mf)
+		})(req)
+	case "DELETE":
+		return pushRoute(func(req events.Request) (events.Response, error) {
+			client, err := getClient()
+			if err != nil {
+				return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+			}
+			err = deleteMetricFile(client, name)
+			if err != nil {
+				return events.Fail(fmt.Sprintf("failed to delete: %s", err))
+			}
+			return events.Succeed("")
+		})(req)
+	}
+	return events.Respond(405, "files require GET, PUT, or DELETE")
+}
+
+func getFileHandler(req events.Request, name string) (events.Response, error) {
+	client, err := getClient()
+	if err != nil {
+		return events.Fail(fmt.Sprintf("failed to load client: %s", err))
+	}
+	mf, err := readMetricFile(client, name)
+	if errors.Is(err, errMetricFileMissing) {
+		return events.Respond(404, fmt.Sprintf("%s not found", name))
+	} else if err != nil {
+		return events.Fail(fmt.Sprintf("failed to read %s: %s", name, err))
+	}
+
+	files, ok := scopeMetricFiles(req, []metricFile{mf})
+	if !ok {
+		return events.Reject("bad auth token")
+	}
+	if len(files) == 0 {
+		return events.Respond(404, fmt.Sprintf("%s not found", name))
+	}
+	return respondJSON(200, redactMetricFiles(files)[0])
+}